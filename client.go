@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -11,11 +12,88 @@ import (
 	"protocore"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Transport modes for delivering RPC payload to the server.
+const (
+	// Payload is base64-encoded into the URL path of a GET request.
+	clientTransportGET = "get"
+	// Payload is sent as the body of a POST request.
+	clientTransportPOST = "post"
+)
+
+const (
+	// Header carrying client-generated ID of retried RPC. It stays the same
+	// across retries. Servers aren't required to honor it, so only read-only
+	// RPCs are retried and carry it.
+	requestIDHeader = "Idempotency-Key"
+
+	defaultRPCAttempts = 3
+	defaultRPCBackoff  = 1 * time.Second
+	maxRPCBackoff      = 30 * time.Second
+)
+
+// transportError indicates that RPC outcome is unknown: the request might
+// or might not have been executed by the server.
+type transportError struct {
+	cause error
+}
+
+func (e *transportError) Error() string {
+	return e.cause.Error()
+}
+
+func isAmbiguousRPCError(err error) bool {
+	_, ok := errors.Cause(err).(*transportError)
+	return ok
+}
+
+// rpcStatusError is returned when server answered with a failure status that
+// carries no protobuf response. The server did answer, so the outcome is not
+// ambiguous.
+type rpcStatusError struct {
+	status int
+	cause  error
+}
+
+func (e *rpcStatusError) Error() string {
+	return e.cause.Error()
+}
+
+// isRetryableRPCError tells whether RPC that only queries state is worth
+// repeating after err.
+func isRetryableRPCError(err error) bool {
+	if isAmbiguousRPCError(err) {
+		return true
+	}
+	statusErr, ok := errors.Cause(err).(*rpcStatusError)
+	return ok && statusErr.status >= 500
+}
+
+// isReadOnlyRPC tells whether RPC only queries state, so that repeating it is
+// harmless.
+func isReadOnlyRPC(m *protoapi.Request) bool {
+	switch m.R.(type) {
+	case *protoapi.Request_LinodeTunnelStatus,
+		*protoapi.Request_LinodeListInstances,
+		*protoapi.Request_LinodeListPlans,
+		*protoapi.Request_LinodeListRegions,
+		*protoapi.Request_LinodeListImages,
+		*protoapi.Request_LinodeListStackscripts,
+		*protoapi.Request_DigitalOceanTunnelStatus,
+		*protoapi.Request_DigitalOceanListDroplets,
+		*protoapi.Request_DigitalOceanListSizes,
+		*protoapi.Request_DigitalOceanListRegions,
+		*protoapi.Request_DigitalOceanListImages:
+		return true
+	}
+	return false
+}
+
 type aHolepuncherClient interface {
 	DoRequest(m *protoapi.Request) (*protoapi.Response, error)
 }
@@ -24,6 +102,7 @@ type holepuncherClient struct {
 	client  *http.Client
 	proto   *protocore.Proto
 	options *programOptions
+	sleep   func(time.Duration)
 }
 
 func newHolepuncherClient(
@@ -44,6 +123,13 @@ func newHolepuncherClient(
 		return nil, logConfigurationError("client_protobuf.peer_key server key is empty or missing")
 	}
 
+	switch strings.ToLower(options.Runtime.Transport) {
+	case "", clientTransportGET, clientTransportPOST:
+	default:
+		return nil, logConfigurationError("runtime.transport must be either \"get\" or \"post\"",
+			log.Fields{"transport": options.Runtime.Transport})
+	}
+
 	srvKey, err := decodeProtobufKey(options.ProtobufClient.ServerKey, "client_protobuf.server_key")
 	if err != nil {
 		return nil, err
@@ -57,31 +143,70 @@ func newHolepuncherClient(
 		client:  httpClient,
 		proto:   protocore.NewProto(peerKey, srvKey),
 		options: options,
+		sleep:   time.Sleep,
 	}, nil
 }
 
 func (c *holepuncherClient) DoRequest(m *protoapi.Request) (*protoapi.Response, error) {
-	var requestURL string
 	var payload bytes.Buffer
 	if err := c.proto.WriteMessage(&payload, m); err != nil {
 		return nil, err
 	}
 
-	payloadB64 := base64.RawStdEncoding.EncodeToString(payload.Bytes())
-	prefix := c.options.Runtime.ServerAddress
-	if prefix[len(prefix)-1] != '/' {
-		requestURL = fmt.Sprintf("%s/proto/%s", prefix, payloadB64)
-	} else {
-		requestURL = fmt.Sprintf("%sproto/%s", prefix, payloadB64)
+	// Creating, rebuilding or destroying tunnel twice is not harmless, so
+	// their failures are reconciled by callers instead.
+	attempts := 1
+	requestID := ""
+	if isReadOnlyRPC(m) {
+		attempts = defaultRPCAttempts
+		if c.options.Runtime.RPCAttempts > 0 {
+			attempts = int(c.options.Runtime.RPCAttempts)
+		}
+		// The same request ID is sent with every attempt, so that the
+		// server is able to recognize retries of the same RPC.
+		var err error
+		if requestID, err = newRequestID(); err != nil {
+			return nil, err
+		}
 	}
+	backoff := defaultRPCBackoff
+	if c.options.Runtime.RPCBackoff > 0 {
+		backoff = time.Duration(c.options.Runtime.RPCBackoff) * time.Millisecond
+	}
+
+	for attempt := 1; ; attempt++ {
+		responseMsg, err := c.doAttempt(m, payload.Bytes(), requestID)
+		if err == nil || !isRetryableRPCError(err) || attempt >= attempts {
+			return responseMsg, err
+		}
 
-	response, err := c.client.Get(requestURL)
+		log.WithFields(log.Fields{
+			"rpc":     c.reflectRPCName(m),
+			"attempt": attempt,
+			"delay":   backoff,
+		}).Warning("Retrying RPC")
+		c.sleep(backoff)
+		if backoff *= 2; backoff > maxRPCBackoff {
+			backoff = maxRPCBackoff
+		}
+	}
+}
+
+// doAttempt performs a single round-trip to the server. Failures after which
+// the server might have executed the RPC are returned as *transportError,
+// failure statuses received from server as *rpcStatusError.
+func (c *holepuncherClient) doAttempt(
+	m *protoapi.Request,
+	payload []byte,
+	requestID string,
+) (*protoapi.Response, error) {
+	response, err := c.send(payload, requestID)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"rpc":   c.reflectRPCName(m),
 			"cause": err,
 		}).Error("I/O error during RPC")
-		return nil, err
+		return nil, &transportError{cause: err}
 	}
 	defer response.Body.Close()
 
@@ -92,7 +217,7 @@ func (c *holepuncherClient) DoRequest(m *protoapi.Request) (*protoapi.Response,
 			"cause":  err,
 			"status": response.StatusCode,
 		}).Error("I/O error during RPC")
-		return nil, err
+		return nil, &transportError{cause: err}
 	}
 
 	if response.StatusCode < 200 || response.StatusCode > 299 {
@@ -102,24 +227,60 @@ func (c *holepuncherClient) DoRequest(m *protoapi.Request) (*protoapi.Response,
 			strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain;") {
 			cause := string(body)
 			log.WithFields(log.Fields{
-				"rpc":   c.reflectRPCName(m),
-				"cause": cause,
+				"rpc":    c.reflectRPCName(m),
+				"cause":  cause,
+				"status": response.StatusCode,
 			}).Error("Early RPC failure")
-			return nil, errors.New(cause)
+			return nil, &rpcStatusError{status: response.StatusCode, cause: errors.New(cause)}
 		}
 	}
 
 	responseMsg := &protoapi.Response{}
 	if err = c.proto.ReadMessage(responseMsg, body); err != nil {
 		log.WithFields(log.Fields{
-			"rpc":   c.reflectRPCName(m),
-			"cause": err,
+			"rpc":    c.reflectRPCName(m),
+			"cause":  err,
+			"status": response.StatusCode,
 		}).Error("RPC return value could not be decoded")
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return nil, &rpcStatusError{status: response.StatusCode, cause: err}
+		}
 		return nil, err
 	}
 	return responseMsg, nil
 }
 
+// send delivers encrypted payload to the server using configured transport.
+func (c *holepuncherClient) send(payload []byte, requestID string) (*http.Response, error) {
+	var request *http.Request
+	var err error
+	if strings.ToLower(c.options.Runtime.Transport) == clientTransportPOST {
+		request, err = http.NewRequest(http.MethodPost, c.endpointURL("proto"),
+			bytes.NewReader(payload))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/octet-stream")
+		}
+	} else {
+		payloadB64 := base64.RawStdEncoding.EncodeToString(payload)
+		request, err = http.NewRequest(http.MethodGet, c.endpointURL("proto/"+payloadB64), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(requestID) > 0 {
+		request.Header.Set(requestIDHeader, requestID)
+	}
+	return c.client.Do(request)
+}
+
+func (c *holepuncherClient) endpointURL(endpoint string) string {
+	prefix := c.options.Runtime.ServerAddress
+	if prefix[len(prefix)-1] != '/' {
+		return fmt.Sprintf("%s/%s", prefix, endpoint)
+	}
+	return fmt.Sprintf("%s%s", prefix, endpoint)
+}
+
 func (c *holepuncherClient) reflectRPCName(m *protoapi.Request) string {
 	if msgType := reflect.TypeOf(m.R); msgType != nil && msgType.Kind() == reflect.Ptr {
 		return msgType.Elem().PkgPath() + "." + msgType.Elem().Name()
@@ -127,6 +288,15 @@ func (c *holepuncherClient) reflectRPCName(m *protoapi.Request) string {
 	return "nil"
 }
 
+func newRequestID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.WithField("cause", err).Error("Unable to generate request ID")
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
 func decodeProtobufKey(key string, keyName string) ([]byte, error) {
 	raw, err := hex.DecodeString(key)
 	if err != nil {
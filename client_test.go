@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"protoapi"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedRequest is a summary of HTTP request received by test server.
+type recordedRequest struct {
+	method      string
+	path        string
+	contentType string
+	requestID   string
+	body        []byte
+}
+
+// newRecordingServer creates server that records requests and responds with
+// text/plain "recorded" error. Status codes of responses are taken from
+// statuses, the last one is repeated indefinitely.
+func newRecordingServer(t *testing.T, statuses ...int) (*httptest.Server, *[]recordedRequest) {
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadRequest}
+	}
+	requests := &[]recordedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, recordedRequest{
+			method:      r.Method,
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+			requestID:   r.Header.Get(requestIDHeader),
+			body:        body,
+		})
+		status := statuses[len(statuses)-1]
+		if len(*requests) <= len(statuses) {
+			status = statuses[len(*requests)-1]
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte("recorded"))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newTestHolepuncherClient(t *testing.T, serverAddress, transport string) *holepuncherClient {
+	o := validTestOptions()
+	o.Runtime.ServerAddress = serverAddress
+	o.Runtime.Transport = transport
+	o.ProtobufClient.ServerKey = mockProtobufKey
+	o.ProtobufClient.PeerKey = mockProtobufKey
+
+	client, err := newHolepuncherClient(o)
+	require.NoError(t, err)
+	client.sleep = func(time.Duration) {}
+	return client
+}
+
+func TestNewHolepuncherClientValidation(t *testing.T) {
+	o := validTestOptions()
+	_, err := newHolepuncherClient(o)
+	assert.Error(t, err, "missing keys")
+
+	o.ProtobufClient.ServerKey = "zz"
+	o.ProtobufClient.PeerKey = mockProtobufKey
+	_, err = newHolepuncherClient(o)
+	assert.Error(t, err, "malformed key")
+
+	o.ProtobufClient.ServerKey = mockProtobufKey
+	o.Runtime.Transport = "carrier-pigeon"
+	_, err = newHolepuncherClient(o)
+	assert.Error(t, err, "unknown transport")
+}
+
+func TestDoRequestGET(t *testing.T) {
+	server, requests := newRecordingServer(t)
+	client := newTestHolepuncherClient(t, server.URL, "get")
+
+	_, err := client.DoRequest(&protoapi.Request{})
+	assert.EqualError(t, err, "recorded")
+	require.Len(t, *requests, 1)
+	assert.Equal(t, http.MethodGet, (*requests)[0].method)
+	assert.True(t, strings.HasPrefix((*requests)[0].path, "/proto/"))
+	assert.Empty(t, (*requests)[0].body)
+}
+
+func TestDoRequestPOST(t *testing.T) {
+	server, requests := newRecordingServer(t)
+	client := newTestHolepuncherClient(t, server.URL+"/", "POST")
+
+	_, err := client.DoRequest(&protoapi.Request{})
+	assert.EqualError(t, err, "recorded")
+	require.Len(t, *requests, 1)
+	assert.Equal(t, http.MethodPost, (*requests)[0].method)
+	assert.Equal(t, "/proto", (*requests)[0].path)
+	assert.Equal(t, "application/octet-stream", (*requests)[0].contentType)
+}
+
+// testReadOnlyRequest is an RPC that is safe to retry.
+func testReadOnlyRequest() *protoapi.Request {
+	return &protoapi.Request{R: &protoapi.Request_LinodeTunnelStatus{
+		LinodeTunnelStatus: &protoapi.LinodeGetTunnelStatusRequest{},
+	}}
+}
+
+func TestDoRequestRetriesServerErrors(t *testing.T) {
+	server, requests := newRecordingServer(t,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusBadRequest)
+	client := newTestHolepuncherClient(t, server.URL, "get")
+	delays := []time.Duration{}
+	client.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	_, err := client.DoRequest(testReadOnlyRequest())
+	assert.EqualError(t, err, "recorded")
+	assert.False(t, isAmbiguousRPCError(err), "4xx is a definite failure")
+	require.Len(t, *requests, 3)
+	assert.NotEmpty(t, (*requests)[0].requestID)
+	assert.Equal(t, (*requests)[0].requestID, (*requests)[1].requestID)
+	assert.Equal(t, (*requests)[0].requestID, (*requests)[2].requestID)
+	assert.Equal(t, []time.Duration{defaultRPCBackoff, 2 * defaultRPCBackoff}, delays)
+}
+
+func TestDoRequestGivesUpAfterAttempts(t *testing.T) {
+	server, requests := newRecordingServer(t, http.StatusInternalServerError)
+	client := newTestHolepuncherClient(t, server.URL, "get")
+	client.options.Runtime.RPCAttempts = 5
+
+	_, err := client.DoRequest(testReadOnlyRequest())
+	assert.False(t, isAmbiguousRPCError(err), "server answered")
+	assert.Len(t, *requests, 5)
+
+	// Separate RPCs get different IDs.
+	_, err = client.DoRequest(testReadOnlyRequest())
+	assert.Error(t, err)
+	assert.NotEqual(t, (*requests)[0].requestID, (*requests)[5].requestID)
+}
+
+func TestDoRequestConnectionFailureIsAmbiguous(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	client := newTestHolepuncherClient(t, server.URL, "post")
+	client.options.Runtime.RPCAttempts = 1
+
+	_, err := client.DoRequest(&protoapi.Request{})
+	assert.True(t, isAmbiguousRPCError(err))
+}
+
+func TestDoRequestDoesNotRetryMutatingRPCs(t *testing.T) {
+	server, requests := newRecordingServer(t, http.StatusBadGateway)
+	client := newTestHolepuncherClient(t, server.URL, "get")
+
+	_, err := client.DoRequest(&protoapi.Request{R: &protoapi.Request_LinodeCreateTunnel{
+		LinodeCreateTunnel: &protoapi.LinodeCreateTunnelRequest{},
+	}})
+	assert.EqualError(t, err, "recorded")
+	assert.False(t, isAmbiguousRPCError(err), "server answered")
+	require.Len(t, *requests, 1)
+	assert.Empty(t, (*requests)[0].requestID, "RPC that is not retried has no ID")
+}
@@ -8,6 +8,9 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -15,12 +18,30 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// envVariablePattern matches ${ENV:NAME} references in runtime_dir.
+var envVariablePattern = regexp.MustCompile(`\$\{ENV:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 type programOptions struct {
 	Runtime struct {
 		RuntimeDir    string `toml:"runtime_dir"`
 		ServerAddress string `toml:"server_address"`
 		ClientProto   string `toml:"client_proto"`
+		Transport     string `toml:"transport"`
+		Proxy         string `toml:"proxy"`
 		Provider      string `toml:"provider"`
+
+		// RPC timeout in seconds. Zero means default timeout.
+		RequestTimeout uint `toml:"request_timeout"`
+
+		// Retry policy. Zero values mean defaults.
+		RPCAttempts uint `toml:"rpc_attempts"`
+		RPCBackoff  uint `toml:"rpc_backoff"`
+
+		// Control channel TLS settings.
+		TLSCAFile     string   `toml:"tls_ca_file"`
+		TLSPins       []string `toml:"tls_pins"`
+		TLSClientCert string   `toml:"tls_client_cert"`
+		TLSClientKey  string   `toml:"tls_client_key"`
 	} `toml:"runtime"`
 
 	// Protocol settings.
@@ -31,15 +52,21 @@ type programOptions struct {
 
 	// Provider settings.
 	LinodeParams struct {
-		AccessToken string `toml:"access_token"`
-		Region      string `toml:"region"`
-		Plan        string `toml:"plan"`
+		AccessToken string                `toml:"access_token"`
+		Region      string                `toml:"region"`
+		Plan        string                `toml:"plan"`
+		Selection   linodeSelectionPolicy `toml:"selection"`
 	} `toml:"provider_linode"`
 	DigitalOceanParams struct {
 		AccessToken string `toml:"access_token"`
 		Region      string `toml:"region"`
 		Plan        string `toml:"plan"`
 	} `toml:"provider_digitalocean"`
+	MockParams struct {
+		Backend  string   `toml:"backend"`
+		Fail     []string `toml:"fail"`
+		FailHTTP []string `toml:"fail_http"`
+	} `toml:"provider_mock"`
 
 	// User settings.
 	AllUsers struct {
@@ -60,6 +87,15 @@ type programOptions struct {
 		PeerKeys  []string `toml:"peer_keys"`
 		Port      uint     `toml:"port"`
 	} `toml:"wireguard"`
+	// Client side settings used by `export wireguard`.
+	WireGuardClient struct {
+		Addresses           []string `toml:"addresses"`
+		PrivateKeyFiles     []string `toml:"private_key_files"`
+		DNS                 []string `toml:"dns"`
+		AllowedIPs          []string `toml:"allowed_ips"`
+		PersistentKeepalive uint     `toml:"persistent_keepalive"`
+		MTU                 uint     `toml:"mtu"`
+	} `toml:"wireguard_client"`
 	ObfsproxyIPv4 struct {
 		Enable bool   `toml:"enable"`
 		Secret string `toml:"secret"`
@@ -70,6 +106,45 @@ type programOptions struct {
 		Secret string `toml:"secret"`
 		Port   uint   `toml:"port"`
 	} `toml:"obfsproxy_ipv6"`
+
+	// Spending limit checked before creating tunnels.
+	Budget struct {
+		Monthly float64 `toml:"monthly"`
+		Action  string  `toml:"action"`
+	} `toml:"budget"`
+
+	// Encryption of session cache at rest.
+	SessionCache struct {
+		Encryption string `toml:"encryption"`
+		Passphrase string `toml:"passphrase"`
+	} `toml:"session_cache"`
+
+	// Per-session overrides of provider settings.
+	Profiles map[string]profileOptions `toml:"profile"`
+
+	// Name of selected session. Not read from config file.
+	Session string `toml:"-"`
+	// Print requests instead of sending them. Set by --dry-run.
+	DryRun bool `toml:"-"`
+	// Profile recorded in session cache when options were resolved. Not
+	// read from config file.
+	CachedProfile string `toml:"-"`
+}
+
+// profileOptions overrides provider settings for a named session. Empty
+// values leave corresponding settings intact.
+type profileOptions struct {
+	Provider     string `toml:"provider"`
+	LinodeParams struct {
+		AccessToken string `toml:"access_token"`
+		Region      string `toml:"region"`
+		Plan        string `toml:"plan"`
+	} `toml:"provider_linode"`
+	DigitalOceanParams struct {
+		AccessToken string `toml:"access_token"`
+		Region      string `toml:"region"`
+		Plan        string `toml:"plan"`
+	} `toml:"provider_digitalocean"`
 }
 
 func newProgramOptions(filename string) (*programOptions, error) {
@@ -116,8 +191,43 @@ func newProgramOptions(filename string) (*programOptions, error) {
 			"${EXE}", path.Dir(exePath), -1)
 	}
 
+	for _, match := range envVariablePattern.FindAllStringSubmatch(config.Runtime.RuntimeDir, -1) {
+		value, ok := os.LookupEnv(match[1])
+		if !ok {
+			log.WithFields(log.Fields{
+				"variable": match[1],
+				"path":     filename,
+			}).Error("Environment variable referenced in runtime.runtime_dir is not set")
+			return nil, fmt.Errorf("environment variable %s is not set", match[1])
+		}
+		config.Runtime.RuntimeDir = strings.Replace(config.Runtime.RuntimeDir,
+			match[0], value, -1)
+	}
+
 	if strings.Contains(config.Runtime.RuntimeDir, "${AUTO}") {
-		panic("runtime.runtime_dir ${AUTO} substitution is not implemented yet.")
+		autoDir, err := autoRuntimeDir()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  filename,
+			}).Error("Unable to determine OS-specific runtime dir when trying " +
+				"to substitute ${AUTO}")
+			return nil, err
+		}
+		config.Runtime.RuntimeDir = strings.Replace(config.Runtime.RuntimeDir,
+			"${AUTO}", autoDir, -1)
+
+		if err = os.MkdirAll(config.Runtime.RuntimeDir, 0700); err != nil {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"dir":   config.Runtime.RuntimeDir,
+			}).Error("Unable to create runtime dir")
+			return nil, err
+		}
+	}
+
+	if config.Runtime.Provider == providerTypeMock.String() {
+		applyMockDefaults(&config)
 	}
 
 	// Generate random service ports, if needed.
@@ -133,6 +243,84 @@ func newProgramOptions(filename string) (*programOptions, error) {
 	return &config, nil
 }
 
+// applySessionProfile selects session and applies profile of the same name,
+// if there's one.
+func applySessionProfile(o *programOptions, session string) error {
+	if err := validateSessionName(session); err != nil {
+		return err
+	}
+	o.Session = session
+	applyProfile(o, session)
+	return nil
+}
+
+// applyProfile overrides provider settings with profile of the given name.
+// Returns false if there's no such profile.
+func applyProfile(o *programOptions, name string) bool {
+	profile, ok := o.Profiles[name]
+	if !ok {
+		return false
+	}
+	log.WithField("profile", name).Debug("Applying profile")
+
+	override := func(dst *string, value string) {
+		if len(value) > 0 {
+			*dst = value
+		}
+	}
+	override(&o.Runtime.Provider, profile.Provider)
+	override(&o.LinodeParams.AccessToken, profile.LinodeParams.AccessToken)
+	override(&o.LinodeParams.Region, profile.LinodeParams.Region)
+	override(&o.LinodeParams.Plan, profile.LinodeParams.Plan)
+	override(&o.DigitalOceanParams.AccessToken, profile.DigitalOceanParams.AccessToken)
+	override(&o.DigitalOceanParams.Region, profile.DigitalOceanParams.Region)
+	override(&o.DigitalOceanParams.Plan, profile.DigitalOceanParams.Plan)
+
+	if o.Runtime.Provider == providerTypeMock.String() {
+		applyMockDefaults(o)
+	}
+	return true
+}
+
+// autoRuntimeDir returns OS-specific directory for storing program state.
+func autoRuntimeDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); len(dir) > 0 {
+			return filepath.Join(dir, "holepuncher"), nil
+		}
+		return "", errors.New("%LOCALAPPDATA% is not set")
+	case "darwin":
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, "Library", "Application Support", "holepuncher"), nil
+	default:
+		// XDG Base Directory Specification: $XDG_STATE_HOME must be an
+		// absolute path, otherwise it's ignored.
+		if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+			return filepath.Join(dir, "holepuncher"), nil
+		}
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".local", "state", "holepuncher"), nil
+	}
+}
+
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); len(home) > 0 {
+		return home, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.HomeDir, nil
+}
+
 func logConfigurationError(cause string, extra ...log.Fields) error {
 	fields := log.Fields{
 		"cause": cause,
@@ -198,6 +386,25 @@ func validateGeneralProgramOptions(o *programOptions) error {
 			return logConfigurationError("obfsproxy ipv6: missing or invalid port number")
 		}
 	}
+
+	// Budget section.
+	if o.Budget.Monthly < 0 {
+		return logConfigurationError("budget: monthly limit must not be negative")
+	}
+	switch o.Budget.Action {
+	case "", budgetActionWarn, budgetActionRefuse:
+	default:
+		return logConfigurationError("budget: action must be either warn or refuse",
+			log.Fields{"action": o.Budget.Action})
+	}
+
+	// Session cache section.
+	switch o.SessionCache.Encryption {
+	case "", sessionEncryptionPassphrase, sessionEncryptionPeerKey:
+	default:
+		return logConfigurationError("session cache: encryption must be either passphrase or peer_key",
+			log.Fields{"encryption": o.SessionCache.Encryption})
+	}
 	return nil
 }
 
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "holepuncher-config-*.toml")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+func validTestOptions() *programOptions {
+	o := &programOptions{}
+	o.Runtime.ServerAddress = "http://127.0.0.1:9000"
+	o.Runtime.Provider = "linode"
+	o.Runtime.RuntimeDir = "/tmp"
+	o.WireGuard.Enable = true
+	o.WireGuard.ServerKey = "MBaaA+HgkX4EGbtFmN5A2GY9aEZxc6cdaMZnIZ9o02o="
+	o.WireGuard.PeerKeys = []string{"9HYUqL2BAGjzTDLdSeIEMxX4Jk4dNVOon8ugjVuGkHU="}
+	o.WireGuard.Port = 55000
+	o.ObfsproxyIPv4.Enable = true
+	o.ObfsproxyIPv4.Secret = "MI3WYVCBMVLGS4TFIZYDMOKBNVLUM43Y"
+	o.ObfsproxyIPv4.Port = 56000
+	o.ObfsproxyIPv6.Enable = true
+	o.ObfsproxyIPv6.Secret = "INVWYTBYKJXDA6CFLFSVGVDSPJFWSUKJ"
+	o.ObfsproxyIPv6.Port = 57000
+	return o
+}
+
+func TestNewProgramOptionsMissingPath(t *testing.T) {
+	_, err := newProgramOptions("")
+	assert.Error(t, err)
+}
+
+func TestNewProgramOptionsMalformedFile(t *testing.T) {
+	_, err := newProgramOptions(writeTestConfig(t, "[runtime\n"))
+	assert.Error(t, err)
+}
+
+func TestNewProgramOptionsHomeSubstitution(t *testing.T) {
+	u, err := user.Current()
+	require.NoError(t, err)
+
+	o, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+runtime_dir = "${HOME}/.holepuncher"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(u.HomeDir, ".holepuncher"), o.Runtime.RuntimeDir)
+}
+
+func TestNewProgramOptionsExeSubstitution(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	o, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+runtime_dir = "${EXE}"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, path.Dir(exe), o.Runtime.RuntimeDir)
+}
+
+func TestNewProgramOptionsRandomPorts(t *testing.T) {
+	o, err := newProgramOptions(writeTestConfig(t, `
+[wireguard]
+enable = true
+port = 0
+
+[obfsproxy_ipv4]
+enable = true
+port = 0
+
+[obfsproxy_ipv6]
+enable = false
+port = 0
+`))
+	require.NoError(t, err)
+	assert.True(t, o.WireGuard.Port >= 10000 && o.WireGuard.Port < 64000)
+	assert.True(t, o.ObfsproxyIPv4.Port >= 10000 && o.ObfsproxyIPv4.Port < 64000)
+	assert.Equal(t, uint(0), o.ObfsproxyIPv6.Port, "disabled service must not get a port")
+}
+
+func TestNewProgramOptionsStaticPorts(t *testing.T) {
+	o, err := newProgramOptions(writeTestConfig(t, `
+[wireguard]
+enable = true
+port = 55000
+
+[obfsproxy_ipv4]
+enable = true
+port = 56000
+`))
+	require.NoError(t, err)
+	assert.Equal(t, uint(55000), o.WireGuard.Port)
+	assert.Equal(t, uint(56000), o.ObfsproxyIPv4.Port)
+}
+
+func TestValidateGeneralProgramOptions(t *testing.T) {
+	assert.NoError(t, validateGeneralProgramOptions(validTestOptions()))
+
+	cases := map[string]func(o *programOptions){
+		"malformed server address": func(o *programOptions) { o.Runtime.ServerAddress = "http://[::1" },
+		"missing provider":         func(o *programOptions) { o.Runtime.Provider = "" },
+		"missing runtime dir":      func(o *programOptions) { o.Runtime.RuntimeDir = "" },
+		"missing wg server key":    func(o *programOptions) { o.WireGuard.ServerKey = "" },
+		"missing wg peer keys":     func(o *programOptions) { o.WireGuard.PeerKeys = nil },
+		"zero wg port":             func(o *programOptions) { o.WireGuard.Port = 0 },
+		"large wg port":            func(o *programOptions) { o.WireGuard.Port = 65536 },
+		"missing obfs4 secret":     func(o *programOptions) { o.ObfsproxyIPv4.Secret = "" },
+		"invalid obfs4 port":       func(o *programOptions) { o.ObfsproxyIPv4.Port = 70000 },
+		"missing obfs6 secret":     func(o *programOptions) { o.ObfsproxyIPv6.Secret = "" },
+		"invalid obfs6 port":       func(o *programOptions) { o.ObfsproxyIPv6.Port = 0 },
+	}
+	for name, mutate := range cases {
+		o := validTestOptions()
+		mutate(o)
+		assert.Error(t, validateGeneralProgramOptions(o), name)
+	}
+}
+
+func TestValidateGeneralProgramOptionsIgnoresDisabledServices(t *testing.T) {
+	o := validTestOptions()
+	o.WireGuard.Enable = false
+	o.WireGuard.ServerKey = ""
+	o.WireGuard.PeerKeys = nil
+	o.ObfsproxyIPv4.Enable = false
+	o.ObfsproxyIPv4.Secret = ""
+	o.ObfsproxyIPv6.Enable = false
+	o.ObfsproxyIPv6.Port = 0
+	assert.NoError(t, validateGeneralProgramOptions(o))
+}
+
+func TestNewProgramOptionsEnvSubstitution(t *testing.T) {
+	t.Setenv("HOLEPUNCHER_TEST_DIR", "/srv/holepuncher")
+
+	o, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+runtime_dir = "${ENV:HOLEPUNCHER_TEST_DIR}/state"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "/srv/holepuncher/state", o.Runtime.RuntimeDir)
+}
+
+func TestNewProgramOptionsEnvSubstitutionUnset(t *testing.T) {
+	os.Unsetenv("HOLEPUNCHER_TEST_UNSET")
+
+	_, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+runtime_dir = "${ENV:HOLEPUNCHER_TEST_UNSET}"
+`))
+	assert.Error(t, err)
+}
+
+func TestNewProgramOptionsAutoSubstitution(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("XDG directories are only used on Linux and BSDs")
+	}
+	stateHome := tempRuntimeDir(t)
+	t.Setenv("XDG_STATE_HOME", stateHome)
+
+	o, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+runtime_dir = "${AUTO}"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, path.Join(stateHome, "holepuncher"), o.Runtime.RuntimeDir)
+
+	info, err := os.Stat(o.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestAutoRuntimeDirFallsBackToHome(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("XDG directories are only used on Linux and BSDs")
+	}
+	t.Setenv("HOME", "/home/user")
+	t.Setenv("XDG_STATE_HOME", "relative/path/is/ignored")
+
+	dir, err := autoRuntimeDir()
+	require.NoError(t, err)
+	assert.Equal(t, "/home/user/.local/state/holepuncher", dir)
+}
+
+func TestApplySessionProfile(t *testing.T) {
+	o, err := newProgramOptions(writeTestConfig(t, `
+[runtime]
+provider = "linode"
+
+[provider_linode]
+access_token = "token"
+region = "eu-central"
+plan = "g6-nanode-1"
+
+[profile.us1.provider_linode]
+region = "us-east"
+
+[profile.do1]
+provider = "digital_ocean"
+
+[profile.do1.provider_digitalocean]
+region = "ams3"
+`))
+	require.NoError(t, err)
+
+	us1 := *o
+	require.NoError(t, applySessionProfile(&us1, "us1"))
+	assert.Equal(t, "us1", us1.Session)
+	assert.Equal(t, "linode", us1.Runtime.Provider)
+	assert.Equal(t, "token", us1.LinodeParams.AccessToken)
+	assert.Equal(t, "us-east", us1.LinodeParams.Region)
+	assert.Equal(t, "g6-nanode-1", us1.LinodeParams.Plan)
+
+	do1 := *o
+	require.NoError(t, applySessionProfile(&do1, "do1"))
+	assert.Equal(t, "digital_ocean", do1.Runtime.Provider)
+	assert.Equal(t, "ams3", do1.DigitalOceanParams.Region)
+
+	plain := *o
+	require.NoError(t, applySessionProfile(&plain, "no-profile"))
+	assert.Equal(t, "no-profile", plain.Session)
+	assert.Equal(t, "eu-central", plain.LinodeParams.Region)
+
+	assert.Error(t, applySessionProfile(o, "../escape"))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal line-based TOML editor. Unlike re-encoding the whole document, it
+// preserves comments and formatting of the rest of config file.
+
+var (
+	tomlSectionPattern      = regexp.MustCompile(`^\s*\[\s*([^\[\]]+?)\s*\]\s*(#.*)?$`)
+	tomlArraySectionPattern = regexp.MustCompile(`^\s*\[\[\s*([^\[\]]+?)\s*\]\]\s*(#.*)?$`)
+	tomlKeyPattern          = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=`)
+)
+
+// tomlString encodes s as TOML basic string.
+func tomlString(s string) string {
+	return strconv.Quote(s)
+}
+
+// tomlStringArray encodes values as TOML array of basic strings.
+func tomlStringArray(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, tomlString(v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// setConfigValue sets key in section of config file to already encoded TOML
+// value. Missing key or section are created. Config file holds secrets, so
+// it's always left readable by the owner only.
+func setConfigValue(filename, section, key, value string) error {
+	// Config file may be a symlink, e.g. into a dotfiles repository, which
+	// must not be replaced with a regular file.
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = resolved
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error reading config file")
+		return err
+	}
+	if info, statErr := os.Stat(filename); statErr == nil && info.Mode().Perm()&0077 != 0 {
+		log.WithFields(log.Fields{
+			"path": filename,
+			"mode": info.Mode().Perm(),
+		}).Warning("Config file was accessible by other users, its permissions are changed to 0600")
+	}
+
+	updated, err := setTOMLValue(string(data), section, key, value)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, []byte(updated), 0600)
+}
+
+// setTOMLValue sets key in section of TOML document. Sections defined as
+// arrays of tables are not supported.
+func setTOMLValue(doc, section, key, value string) (string, error) {
+	lines := strings.Split(doc, "\n")
+	assignment := key + " = " + value
+
+	sectionStart, sectionEnd := -1, len(lines)
+	for i, line := range lines {
+		if m := tomlArraySectionPattern.FindStringSubmatch(line); m != nil {
+			if m[1] == section {
+				return "", logConfigurationError("config: unable to edit array of tables",
+					log.Fields{"section": section})
+			}
+			if sectionStart >= 0 {
+				sectionEnd = i
+				break
+			}
+			continue
+		}
+		m := tomlSectionPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if sectionStart >= 0 {
+			sectionEnd = i
+			break
+		}
+		if m[1] == section {
+			sectionStart = i
+		}
+	}
+
+	if sectionStart < 0 {
+		suffix := ""
+		if len(doc) > 0 && !strings.HasSuffix(doc, "\n") {
+			suffix = "\n"
+		}
+		if len(doc) > 0 {
+			suffix += "\n"
+		}
+		return doc + suffix + "[" + section + "]\n" + assignment + "\n", nil
+	}
+
+	for i := sectionStart + 1; i < sectionEnd; i++ {
+		m := tomlKeyPattern.FindStringSubmatch(lines[i])
+		if m == nil || m[1] != key {
+			continue
+		}
+		last := i + tomlValueExtraLines(lines[i:sectionEnd])
+		result := append([]string{}, lines[:i]...)
+		result = append(result, assignment)
+		result = append(result, lines[last+1:]...)
+		return strings.Join(result, "\n"), nil
+	}
+
+	// Insert after the last non-blank line of the section, so that the new
+	// key doesn't end up below the next section's header comments.
+	insertAt := sectionStart + 1
+	for i := sectionStart + 1; i < sectionEnd; i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") {
+			insertAt = i + 1
+		}
+	}
+	result := append([]string{}, lines[:insertAt]...)
+	result = append(result, assignment)
+	result = append(result, lines[insertAt:]...)
+	return strings.Join(result, "\n"), nil
+}
+
+// tomlValueExtraLines returns number of continuation lines occupied by the
+// value assigned on the first line, e.g. by a multi-line array.
+func tomlValueExtraLines(lines []string) int {
+	depth := 0
+	var quote rune
+	for n, line := range lines {
+		text := line
+		if n == 0 {
+			text = line[strings.Index(line, "=")+1:]
+		}
+		escaped := false
+	chars:
+		for _, r := range text {
+			switch {
+			case quote != 0:
+				if escaped {
+					escaped = false
+				} else if r == '\\' && quote == '"' {
+					escaped = true
+				} else if r == quote {
+					quote = 0
+				}
+			case r == '"' || r == '\'':
+				quote = r
+			case r == '#':
+				break chars
+			case r == '[':
+				depth++
+			case r == ']':
+				depth--
+			}
+		}
+		if depth <= 0 {
+			return n
+		}
+	}
+	return len(lines) - 1
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigDoc = `# Header comment.
+[runtime]
+provider = "linode"
+
+[wireguard]
+enable = true
+server_key = ""
+peer_keys = [
+	"a", # first
+	"b",
+]
+
+# Obfsproxy.
+[obfsproxy_ipv4]
+enable = false
+`
+
+func TestSetTOMLValueReplacesKey(t *testing.T) {
+	doc, err := setTOMLValue(testConfigDoc, "wireguard", "server_key", tomlString("KEY"))
+	require.NoError(t, err)
+	assert.Contains(t, doc, "server_key = \"KEY\"\n")
+	assert.Contains(t, doc, "# Header comment.")
+
+	doc, err = setTOMLValue(doc, "wireguard", "peer_keys", tomlStringArray([]string{"a", "b", "c"}))
+	require.NoError(t, err)
+	var o programOptions
+	_, err = toml.Decode(doc, &o)
+	require.NoError(t, err)
+	assert.Equal(t, "KEY", o.WireGuard.ServerKey)
+	assert.Equal(t, []string{"a", "b", "c"}, o.WireGuard.PeerKeys)
+	assert.True(t, o.WireGuard.Enable)
+	assert.Equal(t, "linode", o.Runtime.Provider)
+	assert.Contains(t, doc, "# Obfsproxy.\n[obfsproxy_ipv4]")
+}
+
+func TestSetTOMLValueAddsKeyAndSection(t *testing.T) {
+	doc := testConfigDoc
+	for _, value := range [][]string{
+		{"obfsproxy_ipv4", "secret", tomlString("S")},
+		{"runtime", "proxy", tomlString("direct")},
+		{"client_protobuf", "peer_key", tomlString("P")},
+	} {
+		var err error
+		doc, err = setTOMLValue(doc, value[0], value[1], value[2])
+		require.NoError(t, err)
+	}
+
+	var o programOptions
+	_, err := toml.Decode(doc, &o)
+	require.NoError(t, err)
+	assert.Equal(t, "S", o.ObfsproxyIPv4.Secret)
+	assert.Equal(t, "direct", o.Runtime.Proxy)
+	assert.Equal(t, "P", o.ProtobufClient.PeerKey)
+	assert.Equal(t, []string{"a", "b"}, o.WireGuard.PeerKeys)
+}
+
+func TestSetTOMLValueArrayOfTables(t *testing.T) {
+	doc := "[runtime]\nproxy = \"direct\"\n\n[[peers]]\nproxy = \"socks\"\n"
+	doc, err := setTOMLValue(doc, "runtime", "proxy", tomlString("http"))
+	require.NoError(t, err)
+	assert.Equal(t, "[runtime]\nproxy = \"http\"\n\n[[peers]]\nproxy = \"socks\"\n", doc)
+
+	doc, err = setTOMLValue(doc, "runtime", "provider", tomlString("linode"))
+	require.NoError(t, err)
+	assert.Contains(t, doc, "provider = \"linode\"\n\n[[peers]]")
+
+	_, err = setTOMLValue(doc, "peers", "proxy", tomlString("http"))
+	assert.Error(t, err)
+}
+
+func TestSetConfigValueRestrictsMode(t *testing.T) {
+	filename := path.Join(tempRuntimeDir(t), "config.toml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testConfigDoc), 0644))
+
+	require.NoError(t, setConfigValue(filename, "wireguard", "server_key", tomlString("KEY")))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	created := path.Join(tempRuntimeDir(t), "new.toml")
+	require.NoError(t, setConfigValue(created, "wireguard", "server_key", tomlString("KEY")))
+	info, err = os.Stat(created)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestSetConfigValueKeepsSymlink(t *testing.T) {
+	dir := tempRuntimeDir(t)
+	target := path.Join(dir, "dotfiles.toml")
+	link := path.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(target, []byte(testConfigDoc), 0600))
+	require.NoError(t, os.Symlink(target, link))
+
+	require.NoError(t, setConfigValue(link, "wireguard", "server_key", tomlString("KEY")))
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSymlink)
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "server_key = \"KEY\"\n")
+}
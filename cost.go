@@ -0,0 +1,335 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Providers bill by calendar month, which is 730 hours on average.
+	hoursPerMonth = 730
+	// Hours after which providers charge monthly price instead of hourly.
+	linodeMonthlyHours       = 730
+	digitalOceanMonthlyHours = 672
+
+	budgetActionWarn   = "warn"
+	budgetActionRefuse = "refuse"
+)
+
+// costRecord describes a destroyed tunnel.
+type costRecord struct {
+	Session      string    `json:"session"`
+	Provider     string    `json:"provider"`
+	Label        string    `json:"label"`
+	Plan         string    `json:"plan"`
+	PriceHourly  float64   `json:"price_hourly"`
+	PriceMonthly float64   `json:"price_monthly"`
+	MonthlyHours int       `json:"monthly_hours,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	DestroyedAt  time.Time `json:"destroyed_at"`
+	Total        float64   `json:"total"`
+}
+
+// tunnelCost describes spending on a live tunnel.
+type tunnelCost struct {
+	Plan             string  `json:"plan"`
+	PriceHourly      float64 `json:"price_hourly"`
+	Accrued          float64 `json:"accrued"`
+	ProjectedMonthly float64 `json:"projected_monthly"`
+}
+
+type sessionCostSummary struct {
+	Session string `json:"session"`
+	*tunnelCost
+}
+
+type costReport struct {
+	Active       []*sessionCostSummary `json:"active"`
+	History      []*costRecord         `json:"history"`
+	HistoryTotal float64               `json:"history_total"`
+	MonthToDate  float64               `json:"month_to_date"`
+	Budget       float64               `json:"budget,omitempty"`
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// billedCost returns cost of running instance between from and to. Every
+// started hour is billed and each month is capped at monthly price.
+func billedCost(price *tunnelPrice, from, to time.Time) float64 {
+	if price == nil || !to.After(from) {
+		return 0
+	}
+	monthly := price.Monthly
+	if monthly <= 0 {
+		monthlyHours := price.MonthlyHours
+		if monthlyHours <= 0 {
+			monthlyHours = hoursPerMonth
+		}
+		monthly = price.Hourly * float64(monthlyHours)
+	}
+
+	hours := int64(math.Ceil(to.Sub(from).Hours()))
+	months := hours / hoursPerMonth
+	rest := math.Min(float64(hours%hoursPerMonth)*price.Hourly, monthly)
+	return roundCents(float64(months)*monthly + rest)
+}
+
+func projectedMonthlyCost(price *tunnelPrice) float64 {
+	return billedCost(price, time.Time{}, time.Time{}.Add(hoursPerMonth*time.Hour))
+}
+
+// sessionCost returns nil if price of the tunnel is unknown.
+func sessionCost(cache *sessionCache, now time.Time) *tunnelCost {
+	if cache.Price == nil {
+		return nil
+	}
+	return &tunnelCost{
+		Plan:             cache.Price.Plan,
+		PriceHourly:      cache.Price.Hourly,
+		Accrued:          billedCost(cache.Price, cache.InstanceInfo.CreatedAt, now),
+		ProjectedMonthly: projectedMonthlyCost(cache.Price),
+	}
+}
+
+// lookupPlanPrice returns nil when provider can't tell plan price. Missing
+// price only disables cost tracking, so errors are not fatal.
+func lookupPlanPrice(provider aCloudProvider) *tunnelPrice {
+	priced, ok := provider.(aPricedCloudProvider)
+	if !ok {
+		return nil
+	}
+	price, err := priced.PlanPrice()
+	if err != nil {
+		log.Warning("Unable to look up plan price, cost won't be tracked")
+		return nil
+	}
+	return price
+}
+
+// loadCostHistory returns cost of destroyed tunnels, which is taken from
+// tunnel history records that carry cost.
+func loadCostHistory(runtimeDir string) ([]*costRecord, error) {
+	records, err := loadHistory(runtimeDir)
+	if err != nil {
+		return nil, err
+	}
+	history := []*costRecord{}
+	for _, record := range records {
+		if cost := costRecordFromHistory(record); cost != nil {
+			history = append(history, cost)
+		}
+	}
+	return history, nil
+}
+
+// costRecordFromHistory returns nil if record doesn't carry cost.
+func costRecordFromHistory(record *historyRecord) *costRecord {
+	if record.Price == nil || record.CreatedAt == nil {
+		return nil
+	}
+	return &costRecord{
+		Session:      record.Session,
+		Provider:     record.Provider,
+		Label:        record.Label,
+		Plan:         record.Price.Plan,
+		PriceHourly:  record.Price.Hourly,
+		PriceMonthly: record.Price.Monthly,
+		MonthlyHours: record.Price.MonthlyHours,
+		CreatedAt:    *record.CreatedAt,
+		DestroyedAt:  record.Time,
+		Total:        record.Total,
+	}
+}
+
+// activeSessionCaches returns caches of all sessions in runtime dir by name.
+func activeSessionCaches(options *programOptions) (map[string]*sessionCache, error) {
+	names, err := listSessions(options.Runtime.RuntimeDir)
+	if err != nil {
+		return nil, err
+	}
+	caches := map[string]*sessionCache{}
+	for _, name := range names {
+		named, err := sessionOptions(options, name)
+		if err != nil {
+			return nil, err
+		}
+		cache, err := restoreSessionCacheIfExists(named)
+		if err != nil {
+			log.WithField("session", name).Error("Unable to read session cache")
+			return nil, err
+		}
+		if cache != nil {
+			caches[name] = cache
+		}
+	}
+	return caches, nil
+}
+
+func monthBounds(now time.Time) (time.Time, time.Time) {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+func laterTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// monthToDateSpend returns amount spent on tunnels during the current
+// calendar month.
+func monthToDateSpend(
+	history []*costRecord,
+	active map[string]*sessionCache,
+	now time.Time,
+) float64 {
+	start, _ := monthBounds(now)
+	total := 0.0
+	for _, record := range history {
+		price := &tunnelPrice{
+			Hourly:       record.PriceHourly,
+			Monthly:      record.PriceMonthly,
+			MonthlyHours: record.MonthlyHours,
+		}
+		total += billedCost(price, laterTime(record.CreatedAt, start), record.DestroyedAt)
+	}
+	for _, cache := range active {
+		total += billedCost(cache.Price, laterTime(cache.InstanceInfo.CreatedAt, start), now)
+	}
+	return roundCents(total)
+}
+
+// plannedMonthSpend adds cost of a new tunnel running until the end of
+// month, or until its ttl expires, to month-to-date spend.
+func plannedMonthSpend(spent float64, price *tunnelPrice, ttl time.Duration, now time.Time) float64 {
+	_, end := monthBounds(now)
+	if ttl > 0 && now.Add(ttl).Before(end) {
+		end = now.Add(ttl)
+	}
+	return roundCents(spent + billedCost(price, now, end))
+}
+
+// checkBudget warns or refuses to create tunnel if it would exceed monthly
+// budget.
+func checkBudget(options *programOptions, price *tunnelPrice, ttl time.Duration, now time.Time) error {
+	budget := options.Budget.Monthly
+	if budget <= 0 {
+		return nil
+	}
+	if price == nil {
+		log.Warning("Plan price is unknown, budget can't be checked")
+		return nil
+	}
+
+	history, err := loadCostHistory(options.Runtime.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	active, err := activeSessionCaches(options)
+	if err != nil {
+		return err
+	}
+	spent := monthToDateSpend(history, active, now)
+	planned := plannedMonthSpend(spent, price, ttl, now)
+	if planned <= budget {
+		return nil
+	}
+
+	entry := log.WithFields(log.Fields{
+		"budget":        budget,
+		"month_to_date": spent,
+		"planned":       planned,
+	})
+	if options.Budget.Action == budgetActionRefuse {
+		entry.Error("Creating tunnel would exceed monthly budget")
+		return errors.New("budget exceeded")
+	}
+	entry.Warning("Creating tunnel will exceed monthly budget")
+	return nil
+}
+
+// checkTunnelBudget checks price of tunnel about to be created by provider.
+// Providers that pick plan at create time check every plan they try. Each
+// plan is checked once.
+func checkTunnelBudget(
+	provider aCloudProvider,
+	options *programOptions,
+	price *tunnelPrice,
+	ttl time.Duration,
+	now time.Time,
+) error {
+	checked := map[string]error{}
+	check := func(price *tunnelPrice) error {
+		plan := ""
+		if price != nil {
+			plan = price.Plan
+		}
+		if err, ok := checked[plan]; ok {
+			return err
+		}
+		err := checkBudget(options, price, ttl, now)
+		checked[plan] = err
+		return err
+	}
+	if budgeted, ok := provider.(aBudgetedCloudProvider); ok {
+		budgeted.SetBudgetCheck(check)
+	}
+	return check(price)
+}
+
+func handleCostCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	history, err := loadCostHistory(options.Runtime.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	active, err := activeSessionCaches(options)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	report := &costReport{
+		Active:      []*sessionCostSummary{},
+		History:     history,
+		MonthToDate: monthToDateSpend(history, active, now),
+		Budget:      options.Budget.Monthly,
+	}
+	names, _ := listSessions(options.Runtime.RuntimeDir)
+	for _, name := range names {
+		if cache, ok := active[name]; ok && cache.Price != nil {
+			report.Active = append(report.Active, &sessionCostSummary{
+				Session:    name,
+				tunnelCost: sessionCost(cache, now),
+			})
+		}
+	}
+	for _, record := range history {
+		report.HistoryTotal += record.Total
+	}
+	report.HistoryTotal = roundCents(report.HistoryTotal)
+
+	return printer.Print(report)
+}
+
+func costCommand() cli.Command {
+	return cli.Command{
+		Name:   "cost",
+		Usage:  "report spending on current and past tunnels",
+		Action: handleCostCommand,
+	}
+}
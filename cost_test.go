@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTunnelPrice = &tunnelPrice{Plan: "g6-nanode-1", Hourly: 0.0075, Monthly: 5}
+
+func TestBilledCost(t *testing.T) {
+	from := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 0.0, billedCost(testTunnelPrice, from, from))
+	assert.Equal(t, 0.0, billedCost(nil, from, from.Add(time.Hour)))
+	// Every started hour is billed.
+	assert.Equal(t, 0.01, billedCost(testTunnelPrice, from, from.Add(time.Minute)))
+	assert.Equal(t, 0.02, billedCost(testTunnelPrice, from, from.Add(2*time.Hour)))
+	assert.Equal(t, 0.18, billedCost(testTunnelPrice, from, from.Add(24*time.Hour)))
+	// Monthly cap.
+	assert.Equal(t, 5.0, billedCost(testTunnelPrice, from, from.Add(700*time.Hour)))
+	assert.Equal(t, 5.08, billedCost(testTunnelPrice, from, from.Add(741*time.Hour)))
+
+	assert.Equal(t, 5.0, projectedMonthlyCost(testTunnelPrice))
+	assert.Equal(t, 7.3, projectedMonthlyCost(&tunnelPrice{Hourly: 0.01}))
+	assert.Equal(t, 6.72, projectedMonthlyCost(&tunnelPrice{Hourly: 0.01, MonthlyHours: digitalOceanMonthlyHours}))
+	assert.Equal(t, 6.72, billedCost(&tunnelPrice{Hourly: 0.01, MonthlyHours: digitalOceanMonthlyHours},
+		from, from.Add(700*time.Hour)))
+}
+
+func TestSessionCost(t *testing.T) {
+	cache := testSessionCache()
+	assert.Nil(t, sessionCost(cache, time.Now()))
+
+	cache.Price = testTunnelPrice
+	cost := sessionCost(cache, cache.InstanceInfo.CreatedAt.Add(10*time.Hour))
+	assert.Equal(t, &tunnelCost{
+		Plan:             "g6-nanode-1",
+		PriceHourly:      0.0075,
+		Accrued:          0.08,
+		ProjectedMonthly: 5,
+	}, cost)
+}
+
+func TestCostHistory(t *testing.T) {
+	options := testSessionOptions(t, "evening")
+	options.Runtime.Provider = providerTypeLinode.String()
+	history, err := loadCostHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	cache := testSessionCache()
+	destroyedAt := cache.InstanceInfo.CreatedAt.Add(4 * time.Hour)
+	// Neither tunnel of unknown price nor failed destroy carry cost.
+	require.NoError(t, appendHistory(options, newDestroyHistoryRecord(options, cache, destroyedAt, destroyedAt, nil)))
+	cache.Price = testTunnelPrice
+	require.NoError(t, appendHistory(options, newDestroyHistoryRecord(options, cache, destroyedAt, destroyedAt,
+		errors.New("rpc method returned an error"))))
+	require.NoError(t, appendHistory(options, newDestroyHistoryRecord(options, cache, destroyedAt, destroyedAt, nil)))
+
+	history, err = loadCostHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "evening", history[0].Session)
+	assert.Equal(t, "linode", history[0].Provider)
+	assert.Equal(t, "g6-nanode-1", history[0].Plan)
+	assert.Equal(t, 0.03, history[0].Total)
+	assert.True(t, destroyedAt.Equal(history[0].DestroyedAt))
+}
+
+func TestMonthToDateSpend(t *testing.T) {
+	now := time.Date(2018, 6, 3, 0, 0, 0, 0, time.UTC)
+	history := []*costRecord{
+		// Last month only.
+		{
+			PriceHourly: 0.01,
+			CreatedAt:   time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+			DestroyedAt: time.Date(2018, 5, 2, 0, 0, 0, 0, time.UTC),
+		},
+		// 10 hours of this month.
+		{
+			PriceHourly: 0.01,
+			CreatedAt:   time.Date(2018, 5, 31, 0, 0, 0, 0, time.UTC),
+			DestroyedAt: time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	active := map[string]*sessionCache{"default": testSessionCache()}
+	assert.Equal(t, 0.1, monthToDateSpend(history, active, now))
+
+	// Created on June 1 at 12:00.
+	active["default"].Price = testTunnelPrice
+	assert.Equal(t, 0.37, monthToDateSpend(history, active, now))
+
+	assert.Equal(t, 0.37+0.08, plannedMonthSpend(0.37, testTunnelPrice, 10*time.Hour, now))
+	assert.Equal(t, 0.37+5, plannedMonthSpend(0.37, testTunnelPrice, 0, now))
+}
+
+func TestCheckBudget(t *testing.T) {
+	options := testSessionOptions(t, "")
+	now := time.Date(2018, 6, 3, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, checkBudget(options, testTunnelPrice, 0, now))
+
+	options.Budget.Monthly = 1
+	options.Budget.Action = budgetActionWarn
+	assert.NoError(t, checkBudget(options, testTunnelPrice, 0, now))
+
+	options.Budget.Action = budgetActionRefuse
+	assert.Error(t, checkBudget(options, testTunnelPrice, 0, now))
+	assert.NoError(t, checkBudget(options, testTunnelPrice, 24*time.Hour, now))
+	assert.NoError(t, checkBudget(options, nil, 0, now))
+
+	cache := testSessionCache()
+	cache.Price = &tunnelPrice{Hourly: 0.05}
+	require.NoError(t, saveSessionCache(cache, options))
+	assert.Error(t, checkBudget(options, testTunnelPrice, 24*time.Hour, now))
+}
+
+// fakePricedProvider picks plans at create time like Linode selection
+// policy.
+type fakePricedProvider struct {
+	fakeCloudProvider
+	price       *tunnelPrice
+	budgetCheck func(price *tunnelPrice) error
+}
+
+func (p *fakePricedProvider) PlanPrice() (*tunnelPrice, error) {
+	return p.price, nil
+}
+
+func (p *fakePricedProvider) SetBudgetCheck(check func(price *tunnelPrice) error) {
+	p.budgetCheck = check
+}
+
+func TestCheckTunnelBudget(t *testing.T) {
+	options := testSessionOptions(t, "")
+	options.Budget.Monthly = 1
+	options.Budget.Action = budgetActionRefuse
+	now := time.Date(2018, 6, 3, 0, 0, 0, 0, time.UTC)
+	provider := &fakePricedProvider{}
+
+	cheap := &tunnelPrice{Plan: "cheap", Hourly: 0.001}
+	require.NoError(t, checkTunnelBudget(provider, options, cheap, 0, now))
+	require.NotNil(t, provider.budgetCheck)
+	assert.Error(t, provider.budgetCheck(testTunnelPrice))
+
+	// Result of each plan is remembered.
+	cache := testSessionCache()
+	cache.Price = &tunnelPrice{Hourly: 1}
+	require.NoError(t, saveSessionCache(cache, options))
+	assert.NoError(t, provider.budgetCheck(cheap))
+	assert.Error(t, checkTunnelBudget(provider, options, cheap, 0, now))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"protoapi"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const redactedValue = "<redacted>"
+
+// errDryRun is returned by dryRunClient instead of a response.
+var errDryRun = errors.New("dry run")
+
+// secretFieldMarkers match normalized names of request fields that hold
+// secrets. Names are normalized by lowercasing and removing underscores, so
+// that both Go and JSON field names match.
+var secretFieldMarkers = []string{"token", "password", "secret", "private", "serverkey"}
+
+// dryRunClient prints requests instead of sending them. Read-only RPCs are
+// sent with queries, if set, so that e.g. selection policy can be resolved.
+type dryRunClient struct {
+	out     io.Writer
+	queries aHolepuncherClient
+}
+
+func (c *dryRunClient) DoRequest(m *protoapi.Request) (*protoapi.Response, error) {
+	if c.queries != nil && isReadOnlyRPC(m) {
+		return c.queries.DoRequest(m)
+	}
+	redacted, err := redactRequest(m)
+	if err != nil {
+		log.WithField("cause", err).Error("Unable to encode request")
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(redacted); err != nil {
+		return nil, err
+	}
+	log.Info("Dry run, request was not sent")
+	return nil, errDryRun
+}
+
+func isDryRun(err error) bool {
+	return errors.Cause(err) == errDryRun
+}
+
+// dryRunResult turns errDryRun returned by provider into success.
+func dryRunResult(err error) error {
+	if isDryRun(err) {
+		return nil
+	}
+	return err
+}
+
+// dryRunFlag is accepted by commands that modify tunnels.
+var dryRunFlag = cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "print request with secrets redacted instead of sending it, read-only queries are still sent",
+}
+
+// redactRequest converts request to generic JSON value with secrets
+// replaced.
+func redactRequest(m *protoapi.Request) (interface{}, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return redactSecrets(generic), nil
+}
+
+func redactSecrets(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if isSecretField(name) {
+				value[name] = redactValue(field)
+			} else {
+				value[name] = redactSecrets(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactSecrets(item)
+		}
+	}
+	return v
+}
+
+// redactValue keeps empty values as is, so that missing secrets are still
+// visible.
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		if len(value) == 0 {
+			return value
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redactValue(value[i])
+		}
+		return value
+	case nil:
+		return nil
+	}
+	return redactedValue
+}
+
+func isSecretField(name string) bool {
+	normalized := strings.ToLower(strings.Replace(name, "_", "", -1))
+	for _, marker := range secretFieldMarkers {
+		if strings.Contains(normalized, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// newClientFromOptions returns client for Holepuncher server, or a client
+// that only prints requests in dry-run mode. Configuration is validated in
+// both cases.
+func newClientFromOptions(options *programOptions) (aHolepuncherClient, error) {
+	httpClient, err := newHTTPClient(options)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHolepuncherClient(options, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		return &dryRunClient{out: os.Stdout, queries: client}, nil
+	}
+	return client, nil
+}
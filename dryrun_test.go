@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"protoapi"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDryRunRequest() *protoapi.Request {
+	return &protoapi.Request{
+		R: &protoapi.Request_LinodeCreateTunnel{
+			LinodeCreateTunnel: &protoapi.LinodeCreateTunnelRequest{
+				Auth:         &protoapi.LinodeAuth{AccessToken: "token"},
+				Region:       "eu-central",
+				RootPassword: "hunter2",
+				SshKeys:      []string{"ssh-ed25519 AAAA"},
+				WireguardOptions: &protoapi.WireguardOptions{
+					Port:      51820,
+					ServerKey: "server-private-key",
+					PeerKeys:  []string{"peer-public-key"},
+				},
+				Obfsproxy4Options: &protoapi.ObfsproxyIPv4Options{
+					Port:   443,
+					Secret: "",
+				},
+			},
+		},
+	}
+}
+
+func TestDryRunClientPrintsRedactedRequest(t *testing.T) {
+	out := &bytes.Buffer{}
+	client := &dryRunClient{out: out}
+
+	response, err := client.DoRequest(testDryRunRequest())
+	assert.Nil(t, response)
+	assert.True(t, isDryRun(err))
+	assert.Nil(t, dryRunResult(err))
+
+	printed := out.String()
+	assert.Contains(t, printed, "eu-central")
+	assert.Contains(t, printed, "peer-public-key")
+	assert.Contains(t, printed, "ssh-ed25519 AAAA")
+	assert.Contains(t, printed, redactedValue)
+	for _, secret := range []string{`"token"`, "hunter2", "server-private-key"} {
+		assert.NotContains(t, printed, secret)
+	}
+
+	var decoded interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+}
+
+func TestRedactSecretsKeepsEmptyValues(t *testing.T) {
+	redacted := redactSecrets(map[string]interface{}{
+		"secret":       "",
+		"access_token": "token",
+		"port":         443.0,
+	}).(map[string]interface{})
+
+	assert.Equal(t, "", redacted["secret"])
+	assert.Equal(t, redactedValue, redacted["access_token"])
+	assert.Equal(t, 443.0, redacted["port"])
+}
+
+func TestIsSecretField(t *testing.T) {
+	for _, name := range []string{"AccessToken", "access_token", "RootPassword",
+		"regular_account_password", "ServerKey", "server_key", "Secret"} {
+		assert.True(t, isSecretField(name), name)
+	}
+	for _, name := range []string{"PeerKeys", "peer_keys", "SshKeys", "Region", "Port"} {
+		assert.False(t, isSecretField(name), name)
+	}
+}
+
+func TestDryRunResultPassesOtherErrors(t *testing.T) {
+	err := errors.New("connection refused")
+	assert.Equal(t, err, dryRunResult(err))
+	assert.Nil(t, dryRunResult(nil))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// exportArtifact is a rendered client configuration.
+type exportArtifact struct {
+	// File name used when artifacts are written into a directory.
+	Name    string
+	Content string
+}
+
+// writeExportArtifacts prints artifacts to stdout or, when dir is not empty,
+// stores each of them in a separate file readable only by owner, since
+// artifacts contain secrets.
+func writeExportArtifacts(artifacts []*exportArtifact, dir string) error {
+	if len(dir) == 0 {
+		for i, artifact := range artifacts {
+			if i > 0 {
+				os.Stdout.WriteString("\n")
+			}
+			os.Stdout.WriteString(artifact.Content)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"dir":   dir,
+		}).Error("Unable to create output directory")
+		return err
+	}
+	for _, artifact := range artifacts {
+		filename := filepath.Join(dir, artifact.Name)
+		if err := ioutil.WriteFile(filename, []byte(artifact.Content), 0600); err != nil {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  filename,
+			}).Error("Error writing exported file")
+			return err
+		}
+		log.WithField("path", filename).Info("Exported client configuration")
+	}
+	return nil
+}
+
+// exportSessionName returns session name suitable for use in file names.
+func exportSessionName(options *programOptions) string {
+	if len(options.Session) == 0 {
+		return defaultSessionName
+	}
+	return options.Session
+}
+
+func exportCommand() cli.Command {
+	outputDirFlag := cli.StringFlag{
+		Name:  "output-dir, o",
+		Usage: "write each artifact into a separate file in `DIR` instead of stdout",
+	}
+
+	return cli.Command{
+		Name:  "export",
+		Usage: "export client configuration for current session",
+		Subcommands: []cli.Command{
+			{
+				Name:   "wireguard",
+				Usage:  "render wireguard client configs, one per peer key",
+				Action: handleExportWireGuardCommand,
+				Flags: []cli.Flag{
+					outputDirFlag,
+					cli.StringFlag{
+						Name:  "format, f",
+						Usage: "output format: wg-quick, nmconnection or qr",
+						Value: wireGuardFormatWGQuick,
+					},
+					cli.IntFlag{
+						Name:  "peer",
+						Usage: "export only peer with given index in wireguard.peer_keys (starts from 0)",
+						Value: -1,
+					},
+					cli.BoolFlag{
+						Name:  "ipv6",
+						Usage: "use IPv6 address of the tunnel as endpoint",
+					},
+				},
+			},
+			{
+				Name:   "obfsproxy",
+				Usage:  "render obfs4 bridge lines, torrc snippet and obfs4proxy invocation",
+				Action: handleExportObfsproxyCommand,
+				Flags: []cli.Flag{
+					outputDirFlag,
+					cli.StringFlag{
+						Name:  "format, f",
+						Usage: "artifact to export: all, bridge, torrc or obfs4proxy",
+						Value: obfsproxyFormatAll,
+					},
+					cli.StringFlag{
+						Name:  "fingerprint",
+						Usage: "bridge `FINGERPRINT` to include into bridge lines",
+					},
+					cli.IntFlag{
+						Name:  "iat-mode",
+						Usage: "inter-arrival time obfuscation mode (0, 1 or 2)",
+					},
+					cli.StringFlag{
+						Name:  "obfs4proxy",
+						Usage: "`PATH` to obfs4proxy executable on client machine",
+						Value: "/usr/bin/obfs4proxy",
+					},
+				},
+			},
+		},
+	}
+}
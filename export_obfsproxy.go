@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	obfsproxyTransport        = "obfs4"
+	obfsproxyFormatAll        = "all"
+	obfsproxyFormatBridge     = "bridge"
+	obfsproxyFormatTorrc      = "torrc"
+	obfsproxyFormatObfs4proxy = "obfs4proxy"
+)
+
+// obfsproxyBridge is a single obfsproxy endpoint of the tunnel.
+type obfsproxyBridge struct {
+	Address     string
+	Port        uint
+	Fingerprint string
+	Secret      string
+	IATMode     int
+}
+
+// Args returns transport arguments of the bridge. Holepuncher server uses
+// obfsproxy secret as bridge certificate.
+func (b *obfsproxyBridge) Args() string {
+	return fmt.Sprintf("cert=%s iat-mode=%d", b.Secret, b.IATMode)
+}
+
+// Line returns bridge line in the format accepted by Tor Browser and by
+// `Bridge` torrc option.
+func (b *obfsproxyBridge) Line() string {
+	parts := []string{
+		obfsproxyTransport,
+		net.JoinHostPort(b.Address, strconv.Itoa(int(b.Port))),
+	}
+	if len(b.Fingerprint) > 0 {
+		parts = append(parts, b.Fingerprint)
+	}
+	parts = append(parts, b.Args())
+	return strings.Join(parts, " ")
+}
+
+// obfsproxyBridges returns bridges for every obfsproxy service enabled at
+// creation time.
+func obfsproxyBridges(session *sessionCache, fingerprint string, iatMode int) ([]*obfsproxyBridge, error) {
+	params := session.CreationParams
+	instance := session.InstanceInfo
+	if !params.ObfsproxyIPv4Enabled && !params.ObfsproxyIPv6Enabled {
+		log.Error("Obfsproxy was not enabled when tunnel was created")
+		return nil, errors.New("obfsproxy is disabled")
+	}
+
+	bridges := []*obfsproxyBridge{}
+	if params.ObfsproxyIPv4Enabled {
+		if len(instance.IPv4) > 0 {
+			bridges = append(bridges, &obfsproxyBridge{
+				Address:     instance.IPv4[0],
+				Port:        params.ObfsproxyIPv4Port,
+				Fingerprint: fingerprint,
+				Secret:      params.ObfsproxyIPv4Secret,
+				IATMode:     iatMode,
+			})
+		} else {
+			log.Warning("Tunnel instance has no IPv4 address, skipping IPv4 bridge")
+		}
+	}
+	if params.ObfsproxyIPv6Enabled {
+		if len(instance.IPv6) > 0 {
+			bridges = append(bridges, &obfsproxyBridge{
+				Address:     instance.IPv6[0],
+				Port:        params.ObfsproxyIPv6Port,
+				Fingerprint: fingerprint,
+				Secret:      params.ObfsproxyIPv6Secret,
+				IATMode:     iatMode,
+			})
+		} else {
+			log.Warning("Tunnel instance has no IPv6 address, skipping IPv6 bridge")
+		}
+	}
+	if len(bridges) == 0 {
+		log.Error("Tunnel instance has no address to use as bridge endpoint")
+		return nil, errors.New("missing bridge address")
+	}
+	return bridges, nil
+}
+
+func renderBridgeLines(bridges []*obfsproxyBridge) string {
+	var b strings.Builder
+	for _, bridge := range bridges {
+		b.WriteString(bridge.Line())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// renderTorrc renders torrc snippet that makes Tor connect through the
+// bridges.
+func renderTorrc(bridges []*obfsproxyBridge, obfs4proxy string) string {
+	var b strings.Builder
+	b.WriteString("UseBridges 1\n")
+	fmt.Fprintf(&b, "ClientTransportPlugin %s exec %s\n", obfsproxyTransport, obfs4proxy)
+	for _, bridge := range bridges {
+		fmt.Fprintf(&b, "Bridge %s\n", bridge.Line())
+	}
+	return b.String()
+}
+
+// renderObfs4proxyInvocation renders shell snippet that runs obfs4proxy as
+// standalone client-side managed transport, for use without Tor.
+func renderObfs4proxyInvocation(bridges []*obfsproxyBridge, obfs4proxy, stateDir string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# obfs4proxy reports local SOCKS5 listener as\n")
+	fmt.Fprintf(&b, "# `CMETHOD %s socks5 127.0.0.1:PORT`. Applications connect to the bridge\n",
+		obfsproxyTransport)
+	b.WriteString("# through that listener, passing transport arguments as SOCKS5 username:\n")
+	for _, bridge := range bridges {
+		fmt.Fprintf(&b, "#   %s  %s\n",
+			net.JoinHostPort(bridge.Address, strconv.Itoa(int(bridge.Port))),
+			strings.Replace(bridge.Args(), " ", ";", -1))
+	}
+	b.WriteString("TOR_PT_MANAGED_TRANSPORT_VER=1 \\\n")
+	fmt.Fprintf(&b, "TOR_PT_STATE_LOCATION=%s \\\n", shellQuote(stateDir))
+	fmt.Fprintf(&b, "TOR_PT_CLIENT_TRANSPORTS=%s \\\n", obfsproxyTransport)
+	b.WriteString("TOR_PT_EXIT_ON_STDIN_CLOSE=0 \\\n")
+	fmt.Fprintf(&b, "exec %s\n", shellQuote(obfs4proxy))
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func handleExportObfsproxyCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	session, err := restoreSessionCache(options)
+	if err != nil {
+		return err
+	}
+	bridges, err := obfsproxyBridges(session, c.String("fingerprint"), c.Int("iat-mode"))
+	if err != nil {
+		return err
+	}
+
+	obfs4proxy := c.String("obfs4proxy")
+	baseName := fmt.Sprintf("holepuncher-%s", exportSessionName(options))
+	stateDir := filepath.Join(options.Runtime.RuntimeDir, baseName+"-obfs4proxy")
+	all := []*exportArtifact{
+		{
+			Name:    baseName + "-bridges.txt",
+			Content: renderBridgeLines(bridges),
+		},
+		{
+			Name:    baseName + ".torrc",
+			Content: renderTorrc(bridges, obfs4proxy),
+		},
+		{
+			Name:    baseName + "-obfs4proxy.sh",
+			Content: renderObfs4proxyInvocation(bridges, obfs4proxy, stateDir),
+		},
+	}
+
+	var artifacts []*exportArtifact
+	switch c.String("format") {
+	case obfsproxyFormatAll:
+		artifacts = all
+	case obfsproxyFormatBridge:
+		artifacts = all[:1]
+	case obfsproxyFormatTorrc:
+		artifacts = all[1:2]
+	case obfsproxyFormatObfs4proxy:
+		artifacts = all[2:]
+	default:
+		log.WithField("format", c.String("format")).Error("Unsupported export format")
+		return errors.New("unsupported format")
+	}
+	return writeExportArtifacts(artifacts, c.String("output-dir"))
+}
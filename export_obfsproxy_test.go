@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObfsproxyBridges(t *testing.T) {
+	cache := testSessionCache()
+
+	bridges, err := obfsproxyBridges(cache, "", 0)
+	require.NoError(t, err)
+	require.Len(t, bridges, 2)
+	assert.Equal(t, "obfs4 192.0.2.1:56000 cert=MI3WYVCBMVLGS4TFIZYDMOKBNVLUM43Y iat-mode=0",
+		bridges[0].Line())
+	assert.Equal(t, "obfs4 [2001:db8::1]:57000 cert=INVWYTBYKJXDA6CFLFSVGVDSPJFWSUKJ iat-mode=0",
+		bridges[1].Line())
+
+	bridges, err = obfsproxyBridges(cache, "4352E58420E68F5E40BF7C74FADDCCD9D1349413", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "obfs4 192.0.2.1:56000 4352E58420E68F5E40BF7C74FADDCCD9D1349413 "+
+		"cert=MI3WYVCBMVLGS4TFIZYDMOKBNVLUM43Y iat-mode=1", bridges[0].Line())
+
+	cache.InstanceInfo.IPv6 = nil
+	bridges, err = obfsproxyBridges(cache, "", 0)
+	require.NoError(t, err)
+	assert.Len(t, bridges, 1)
+
+	cache.CreationParams.ObfsproxyIPv4Enabled = false
+	_, err = obfsproxyBridges(cache, "", 0)
+	assert.Error(t, err)
+
+	cache.CreationParams.ObfsproxyIPv6Enabled = false
+	_, err = obfsproxyBridges(cache, "", 0)
+	assert.Error(t, err)
+}
+
+func TestRenderTorrc(t *testing.T) {
+	bridges, err := obfsproxyBridges(testSessionCache(), "", 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, "UseBridges 1\n"+
+		"ClientTransportPlugin obfs4 exec /usr/bin/obfs4proxy\n"+
+		"Bridge "+bridges[0].Line()+"\n"+
+		"Bridge "+bridges[1].Line()+"\n",
+		renderTorrc(bridges, "/usr/bin/obfs4proxy"))
+	assert.Equal(t, bridges[0].Line()+"\n"+bridges[1].Line()+"\n", renderBridgeLines(bridges))
+}
+
+func TestRenderObfs4proxyInvocation(t *testing.T) {
+	bridges, err := obfsproxyBridges(testSessionCache(), "", 0)
+	require.NoError(t, err)
+
+	rendered := renderObfs4proxyInvocation(bridges, "/usr/bin/obfs4proxy", "/tmp/it's")
+	assert.Contains(t, rendered, "#   192.0.2.1:56000  cert=MI3WYVCBMVLGS4TFIZYDMOKBNVLUM43Y;iat-mode=0\n")
+	assert.Contains(t, rendered, "TOR_PT_MANAGED_TRANSPORT_VER=1 \\\n")
+	assert.Contains(t, rendered, "TOR_PT_STATE_LOCATION='/tmp/it'\\''s' \\\n")
+	assert.Contains(t, rendered, "TOR_PT_CLIENT_TRANSPORTS=obfs4 \\\n")
+	assert.Contains(t, rendered, "exec '/usr/bin/obfs4proxy'\n")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	qrcode "github.com/skip2/go-qrcode"
+	"github.com/urfave/cli"
+)
+
+const (
+	wireGuardFormatWGQuick         = "wg-quick"
+	wireGuardFormatNMConnection    = "nmconnection"
+	wireGuardFormatQR              = "qr"
+	wireGuardPrivateKeyPlaceholder = "<peer private key>"
+)
+
+// wireGuardPeerConfig holds everything needed to render client config of a
+// single peer.
+type wireGuardPeerConfig struct {
+	Index           int
+	PublicKey       string
+	PrivateKey      string
+	Addresses       []string
+	DNS             []string
+	MTU             uint
+	ServerPublicKey string
+	Endpoint        string
+	AllowedIPs      []string
+	Keepalive       uint
+}
+
+// InterfaceName returns name of the peer's WireGuard interface. Interface
+// names are limited to 15 characters, and wg-quick names interface after
+// config file, so the name doesn't include session name.
+func (c *wireGuardPeerConfig) InterfaceName() string {
+	return fmt.Sprintf("wg-hp%d", c.Index)
+}
+
+// wireGuardPeerConfigs combines session cache with [wireguard_client]
+// settings. If only is not negative, just the peer with that index is
+// returned.
+func wireGuardPeerConfigs(
+	options *programOptions,
+	session *sessionCache,
+	only int,
+	useIPv6 bool,
+) ([]*wireGuardPeerConfig, error) {
+	params := session.CreationParams
+	if !params.WireGuardEnabled {
+		log.Error("WireGuard was not enabled when tunnel was created")
+		return nil, errors.New("wireguard is disabled")
+	}
+
+	serverPublicKey, err := wireGuardPublicKey(params.WireGuardServerKey)
+	if err != nil {
+		log.WithField("cause", err).Error("Unable to derive WireGuard server public key")
+		return nil, err
+	}
+
+	addresses := session.InstanceInfo.IPv4
+	if useIPv6 {
+		addresses = session.InstanceInfo.IPv6
+	}
+	if len(addresses) == 0 {
+		log.WithField("ipv6", useIPv6).Error("Tunnel instance has no address to use as endpoint")
+		return nil, errors.New("missing endpoint address")
+	}
+	endpoint := net.JoinHostPort(addresses[0], strconv.Itoa(int(params.WireGuardPort)))
+
+	client := &options.WireGuardClient
+	allowedIPs := client.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+
+	if only >= len(params.WireGuardPeerKeys) {
+		log.WithField("peer", only).Error("No such WireGuard peer")
+		return nil, errors.New("no such peer")
+	}
+
+	configs := []*wireGuardPeerConfig{}
+	for i, publicKey := range params.WireGuardPeerKeys {
+		if only >= 0 && i != only {
+			continue
+		}
+		if i >= len(client.Addresses) || len(strings.TrimSpace(client.Addresses[i])) == 0 {
+			log.WithField("peer", i).Error(
+				"wireguard_client.addresses has no tunnel address for this peer")
+			return nil, errors.New("missing peer tunnel address")
+		}
+
+		privateKey := wireGuardPrivateKeyPlaceholder
+		if i < len(client.PrivateKeyFiles) && len(client.PrivateKeyFiles[i]) > 0 {
+			privateKey, err = readWireGuardPrivateKey(client.PrivateKeyFiles[i], publicKey)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			log.WithField("peer", i).Warning(
+				"Private key file is not configured, private key must be filled in manually")
+		}
+
+		configs = append(configs, &wireGuardPeerConfig{
+			Index:           i,
+			PublicKey:       publicKey,
+			PrivateKey:      privateKey,
+			Addresses:       splitList(client.Addresses[i]),
+			DNS:             client.DNS,
+			MTU:             client.MTU,
+			ServerPublicKey: serverPublicKey,
+			Endpoint:        endpoint,
+			AllowedIPs:      allowedIPs,
+			Keepalive:       client.PersistentKeepalive,
+		})
+	}
+	return configs, nil
+}
+
+// readWireGuardPrivateKey reads private key from file and makes sure that it
+// belongs to the peer.
+func readWireGuardPrivateKey(filename, publicKey string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error reading WireGuard private key")
+		return "", err
+	}
+	privateKey := strings.TrimSpace(string(data))
+	derived, err := wireGuardPublicKey(privateKey)
+	if err != nil {
+		log.WithField("path", filename).Error("Malformed WireGuard private key")
+		return "", err
+	}
+	if derived != publicKey {
+		log.WithFields(log.Fields{
+			"path":       filename,
+			"public_key": publicKey,
+		}).Error("WireGuard private key does not match peer public key")
+		return "", errors.New("private key mismatch")
+	}
+	return privateKey, nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// renderWGQuickConfig renders config in the format understood by wg-quick
+// and most WireGuard mobile apps.
+func renderWGQuickConfig(c *wireGuardPeerConfig) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Peer #%d (%s)\n", c.Index, c.PublicKey)
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.PrivateKey)
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(c.Addresses, ", "))
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(c.DNS, ", "))
+	}
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", c.MTU)
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", c.ServerPublicKey)
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(c.AllowedIPs, ", "))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", c.Keepalive)
+	}
+	return b.String()
+}
+
+// renderNMConnection renders NetworkManager keyfile, which can be placed
+// into /etc/NetworkManager/system-connections.
+func renderNMConnection(c *wireGuardPeerConfig, name string) string {
+	var ipv4, ipv6 []string
+	for _, address := range c.Addresses {
+		if strings.Contains(address, ":") {
+			ipv6 = append(ipv6, address)
+		} else {
+			ipv4 = append(ipv4, address)
+		}
+	}
+	var dns4, dns6 []string
+	for _, server := range c.DNS {
+		if strings.Contains(server, ":") {
+			dns6 = append(dns6, server)
+		} else {
+			dns4 = append(dns4, server)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("[connection]\n")
+	fmt.Fprintf(&b, "id=%s\n", name)
+	b.WriteString("type=wireguard\n")
+	fmt.Fprintf(&b, "interface-name=%s\n", c.InterfaceName())
+	b.WriteString("\n[wireguard]\n")
+	fmt.Fprintf(&b, "private-key=%s\n", c.PrivateKey)
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "mtu=%d\n", c.MTU)
+	}
+	fmt.Fprintf(&b, "\n[wireguard-peer.%s]\n", c.ServerPublicKey)
+	fmt.Fprintf(&b, "endpoint=%s\n", c.Endpoint)
+	fmt.Fprintf(&b, "allowed-ips=%s;\n", strings.Join(c.AllowedIPs, ";"))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", c.Keepalive)
+	}
+	renderNMIPSection(&b, "ipv4", ipv4, dns4)
+	renderNMIPSection(&b, "ipv6", ipv6, dns6)
+	return b.String()
+}
+
+func renderNMIPSection(b *strings.Builder, section string, addresses, dns []string) {
+	fmt.Fprintf(b, "\n[%s]\n", section)
+	if len(addresses) == 0 {
+		b.WriteString("method=disabled\n")
+		return
+	}
+	for i, address := range addresses {
+		fmt.Fprintf(b, "address%d=%s\n", i+1, address)
+	}
+	if len(dns) > 0 {
+		fmt.Fprintf(b, "dns=%s;\n", strings.Join(dns, ";"))
+	}
+	b.WriteString("method=manual\n")
+}
+
+// renderWireGuardQR renders wg-quick config as QR code for scanning with
+// WireGuard mobile app.
+func renderWireGuardQR(c *wireGuardPeerConfig) (string, error) {
+	code, err := qrcode.New(renderWGQuickConfig(c), qrcode.Low)
+	if err != nil {
+		log.WithField("cause", err).Error("Unable to encode QR code")
+		return "", err
+	}
+	return fmt.Sprintf("Peer #%d (%s)\n%s", c.Index, c.PublicKey, code.ToSmallString(false)), nil
+}
+
+func handleExportWireGuardCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	session, err := restoreSessionCache(options)
+	if err != nil {
+		return err
+	}
+	configs, err := wireGuardPeerConfigs(options, session, c.Int("peer"), c.Bool("ipv6"))
+	if err != nil {
+		return err
+	}
+
+	artifacts := []*exportArtifact{}
+	baseName := fmt.Sprintf("holepuncher-%s", exportSessionName(options))
+	for _, config := range configs {
+		name := fmt.Sprintf("%s-peer%d", baseName, config.Index)
+		switch c.String("format") {
+		case wireGuardFormatWGQuick:
+			artifacts = append(artifacts, &exportArtifact{
+				Name:    config.InterfaceName() + ".conf",
+				Content: renderWGQuickConfig(config),
+			})
+		case wireGuardFormatNMConnection:
+			artifacts = append(artifacts, &exportArtifact{
+				Name:    name + ".nmconnection",
+				Content: renderNMConnection(config, name),
+			})
+		case wireGuardFormatQR:
+			content, err := renderWireGuardQR(config)
+			if err != nil {
+				return err
+			}
+			artifacts = append(artifacts, &exportArtifact{
+				Name:    name + ".txt",
+				Content: content,
+			})
+		default:
+			log.WithField("format", c.String("format")).Error("Unsupported export format")
+			return errors.New("unsupported format")
+		}
+	}
+	return writeExportArtifacts(artifacts, c.String("output-dir"))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testWireGuardExport(t *testing.T) (*programOptions, *sessionCache, *wireGuardKeyPair) {
+	pair, err := generateWireGuardKeyPair()
+	require.NoError(t, err)
+	keyFile := filepath.Join(tempRuntimeDir(t), "peer.key")
+	require.NoError(t, writePrivateKeyFile(keyFile, pair.PrivateKey))
+
+	o := testSessionOptions(t, "")
+	o.WireGuard.PeerKeys = []string{pair.PublicKey, o.WireGuard.PeerKeys[0]}
+	o.WireGuardClient.Addresses = []string{"10.66.0.2/32, fd66::2/128", "10.66.0.3/32"}
+	o.WireGuardClient.PrivateKeyFiles = []string{keyFile}
+	o.WireGuardClient.DNS = []string{"1.1.1.1", "2606:4700:4700::1111"}
+	o.WireGuardClient.PersistentKeepalive = 25
+
+	cache := testSessionCache()
+	params := creationParamsFromProgramOptions(o)
+	cache.CreationParams = &params
+	return o, cache, pair
+}
+
+func TestWireGuardPeerConfigs(t *testing.T) {
+	o, cache, pair := testWireGuardExport(t)
+	serverPublicKey, err := wireGuardPublicKey(o.WireGuard.ServerKey)
+	require.NoError(t, err)
+
+	configs, err := wireGuardPeerConfigs(o, cache, -1, false)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	assert.Equal(t, pair.PrivateKey, configs[0].PrivateKey)
+	assert.Equal(t, []string{"10.66.0.2/32", "fd66::2/128"}, configs[0].Addresses)
+	assert.Equal(t, serverPublicKey, configs[0].ServerPublicKey)
+	assert.Equal(t, "192.0.2.1:55000", configs[0].Endpoint)
+	assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, configs[0].AllowedIPs)
+	assert.Equal(t, wireGuardPrivateKeyPlaceholder, configs[1].PrivateKey)
+
+	configs, err = wireGuardPeerConfigs(o, cache, 1, true)
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, 1, configs[0].Index)
+	assert.Equal(t, "[2001:db8::1]:55000", configs[0].Endpoint)
+}
+
+func TestWireGuardPeerConfigsErrors(t *testing.T) {
+	o, cache, _ := testWireGuardExport(t)
+
+	_, err := wireGuardPeerConfigs(o, cache, 2, false)
+	assert.Error(t, err)
+
+	o.WireGuardClient.Addresses = o.WireGuardClient.Addresses[:1]
+	_, err = wireGuardPeerConfigs(o, cache, -1, false)
+	assert.Error(t, err)
+	_, err = wireGuardPeerConfigs(o, cache, 0, false)
+	assert.NoError(t, err)
+
+	// Private key file belonging to another peer.
+	o.WireGuardClient.PrivateKeyFiles = []string{"", o.WireGuardClient.PrivateKeyFiles[0]}
+	o.WireGuardClient.Addresses = append(o.WireGuardClient.Addresses, "10.66.0.3/32")
+	_, err = wireGuardPeerConfigs(o, cache, 1, false)
+	assert.Error(t, err)
+
+	cache.CreationParams.WireGuardEnabled = false
+	_, err = wireGuardPeerConfigs(o, cache, -1, false)
+	assert.Error(t, err)
+}
+
+func TestRenderWGQuickConfig(t *testing.T) {
+	o, cache, pair := testWireGuardExport(t)
+	configs, err := wireGuardPeerConfigs(o, cache, 0, false)
+	require.NoError(t, err)
+
+	rendered := renderWGQuickConfig(configs[0])
+	assert.Contains(t, rendered, "[Interface]\nPrivateKey = "+pair.PrivateKey+"\n")
+	assert.Contains(t, rendered, "Address = 10.66.0.2/32, fd66::2/128\n")
+	assert.Contains(t, rendered, "DNS = 1.1.1.1, 2606:4700:4700::1111\n")
+	assert.Contains(t, rendered, "[Peer]\nPublicKey = "+configs[0].ServerPublicKey+"\n")
+	assert.Contains(t, rendered, "Endpoint = 192.0.2.1:55000\n")
+	assert.Contains(t, rendered, "AllowedIPs = 0.0.0.0/0, ::/0\n")
+	assert.Contains(t, rendered, "PersistentKeepalive = 25\n")
+	assert.NotContains(t, rendered, "MTU")
+}
+
+func TestWireGuardInterfaceName(t *testing.T) {
+	config := &wireGuardPeerConfig{Index: 12}
+	assert.Equal(t, "wg-hp12", config.InterfaceName())
+}
+
+func TestRenderNMConnection(t *testing.T) {
+	o, cache, _ := testWireGuardExport(t)
+	configs, err := wireGuardPeerConfigs(o, cache, -1, false)
+	require.NoError(t, err)
+
+	rendered := renderNMConnection(configs[0], "hp")
+	assert.Contains(t, rendered, "type=wireguard\ninterface-name=wg-hp0\n")
+	assert.Contains(t, rendered, "[wireguard-peer."+configs[0].ServerPublicKey+"]\n")
+	assert.Contains(t, rendered, "allowed-ips=0.0.0.0/0;::/0;\n")
+	assert.Contains(t, rendered, "[ipv4]\naddress1=10.66.0.2/32\ndns=1.1.1.1;\nmethod=manual\n")
+	assert.Contains(t, rendered, "[ipv6]\naddress1=fd66::2/128\ndns=2606:4700:4700::1111;\nmethod=manual\n")
+
+	rendered = renderNMConnection(configs[1], "hp")
+	assert.Contains(t, rendered, "[ipv6]\nmethod=disabled\n")
+}
+
+func TestRenderWireGuardQR(t *testing.T) {
+	o, cache, _ := testWireGuardExport(t)
+	configs, err := wireGuardPeerConfigs(o, cache, 0, false)
+	require.NoError(t, err)
+
+	rendered, err := renderWireGuardQR(configs[0])
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rendered, "Peer #0 "))
+	assert.Contains(t, rendered, "█")
+}
+
+func TestWriteExportArtifacts(t *testing.T) {
+	dir := filepath.Join(tempRuntimeDir(t), "out")
+	artifacts := []*exportArtifact{
+		{Name: "a.conf", Content: "a\n"},
+		{Name: "b.conf", Content: "b\n"},
+	}
+	require.NoError(t, writeExportArtifacts(artifacts, dir))
+
+	for _, artifact := range artifacts {
+		filename := filepath.Join(dir, artifact.Name)
+		data, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, artifact.Content, string(data))
+		info, err := os.Stat(filename)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Actions recorded in tunnel history.
+const (
+	historyActionCreate  = "create"
+	historyActionRebuild = "rebuild"
+	historyActionRotate  = "rotate"
+	historyActionDestroy = "destroy"
+	// Live tunnel was recorded by `sync --adopt`.
+	historyActionAdopt = "adopt"
+)
+
+// Outcomes of recorded actions. Outcome is unknown when the request may or
+// may not have been executed by the server.
+const (
+	historyOutcomeOK      = "ok"
+	historyOutcomeFailed  = "failed"
+	historyOutcomeUnknown = "unknown"
+)
+
+// historyRecord describes an action taken on a tunnel.
+type historyRecord struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Session  string    `json:"session"`
+	Provider string    `json:"provider"`
+	Region   string    `json:"region,omitempty"`
+	Plan     string    `json:"plan,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	IPv4     []string  `json:"ipv4,omitempty"`
+	IPv6     []string  `json:"ipv6,omitempty"`
+	// How long the action took.
+	Duration string `json:"duration"`
+	// How long destroyed tunnel existed.
+	Lifetime string `json:"lifetime,omitempty"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error,omitempty"`
+	// Set when session stops tracking tunnel of known price, which makes the
+	// record part of cost history.
+	Price     *tunnelPrice `json:"price,omitempty"`
+	CreatedAt *time.Time   `json:"created_at,omitempty"`
+	Total     float64      `json:"total,omitempty"`
+}
+
+// historyFilter selects history records. Zero values match everything.
+type historyFilter struct {
+	Since   time.Time
+	Until   time.Time
+	Session string
+	Action  string
+}
+
+func (f *historyFilter) Match(record *historyRecord) bool {
+	switch {
+	case !f.Since.IsZero() && record.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !record.Time.Before(f.Until):
+		return false
+	case len(f.Session) > 0 && record.Session != f.Session:
+		return false
+	case len(f.Action) > 0 && record.Action != f.Action:
+		return false
+	}
+	return true
+}
+
+func (f *historyFilter) Apply(records []*historyRecord) []*historyRecord {
+	matched := []*historyRecord{}
+	for _, record := range records {
+		if f.Match(record) {
+			matched = append(matched, record)
+		}
+	}
+	return matched
+}
+
+func historyFilename(runtimeDir string) string {
+	return path.Join(runtimeDir, "history.jsonl")
+}
+
+// tunnelPlacement returns region and plan new tunnels are created with.
+// They are recorded in session cache, since configuration may change during
+// tunnel lifetime.
+func tunnelPlacement(options *programOptions) (string, string) {
+	switch options.Runtime.Provider {
+	case providerTypeLinode.String():
+		return options.LinodeParams.Region, options.LinodeParams.Plan
+	case providerTypeDigitalOcean.String():
+		return options.DigitalOceanParams.Region, options.DigitalOceanParams.Plan
+	default:
+		return "", ""
+	}
+}
+
+func historyOutcome(err error) string {
+	switch {
+	case err == nil:
+		return historyOutcomeOK
+	case isAmbiguousRPCError(err):
+		return historyOutcomeUnknown
+	default:
+		return historyOutcomeFailed
+	}
+}
+
+// newHistoryRecord describes action started at started, which ended with
+// err. Cache describes the tunnel the action was taken on, if known.
+func newHistoryRecord(
+	options *programOptions,
+	action string,
+	cache *sessionCache,
+	started time.Time,
+	now time.Time,
+	err error,
+) *historyRecord {
+	record := &historyRecord{
+		Time:     now,
+		Action:   action,
+		Session:  exportSessionName(options),
+		Provider: options.Runtime.Provider,
+		Duration: now.Sub(started).Round(time.Second).String(),
+		Outcome:  historyOutcome(err),
+	}
+	if cache != nil {
+		record.Region = cache.Region
+		record.Plan = cache.Plan
+	}
+	if cache != nil && cache.InstanceInfo != nil {
+		record.Label = cache.InstanceInfo.Label
+		record.IPv4 = cache.InstanceInfo.IPv4
+		record.IPv6 = cache.InstanceInfo.IPv6
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// newDestroyHistoryRecord describes destroying tunnel recorded in cache,
+// which may be nil.
+func newDestroyHistoryRecord(
+	options *programOptions,
+	cache *sessionCache,
+	started time.Time,
+	now time.Time,
+	err error,
+) *historyRecord {
+	record := newHistoryRecord(options, historyActionDestroy, cache, started, now, err)
+	if err == nil && cache != nil && !cache.InstanceInfo.CreatedAt.IsZero() {
+		record.Lifetime = now.Sub(cache.InstanceInfo.CreatedAt).Round(time.Second).String()
+	}
+	if err == nil {
+		record.setCost(cache)
+	}
+	return record
+}
+
+// setCost records cost of tunnel described by cache, which has been running
+// until the record's time.
+func (r *historyRecord) setCost(cache *sessionCache) {
+	if cache == nil || cache.Price == nil {
+		return
+	}
+	createdAt := cache.InstanceInfo.CreatedAt
+	r.Price = cache.Price
+	r.CreatedAt = &createdAt
+	r.Total = billedCost(cache.Price, createdAt, r.Time)
+}
+
+// appendHistory appends record to tunnel history. History is only kept for
+// reference, so callers are free to ignore errors, which are logged.
+func appendHistory(options *programOptions, record *historyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.WithField("cause", err).Error("Error encoding history record")
+		return err
+	}
+
+	filename := historyFilename(options.Runtime.RuntimeDir)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error opening history for writing")
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error writing history")
+		return err
+	}
+	return nil
+}
+
+// loadHistory reads tunnel history. Malformed lines, e.g. the last one
+// after a crash, are skipped.
+func loadHistory(runtimeDir string) ([]*historyRecord, error) {
+	filename := historyFilename(runtimeDir)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []*historyRecord{}, nil
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error reading history")
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []*historyRecord{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &historyRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  filename,
+				"line":  line,
+			}).Warning("Skipping malformed history record")
+			continue
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error reading history")
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseHistoryTime parses either a date, a RFC 3339 timestamp or a duration
+// counted back from now.
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, logConfigurationError("history: time must be a date, RFC 3339 timestamp or duration",
+		log.Fields{"value": value})
+}
+
+func historyFilterFromContext(c *cli.Context, now time.Time) (*historyFilter, error) {
+	filter := &historyFilter{
+		Session: c.String("session"),
+		Action:  c.String("action"),
+	}
+	switch filter.Action {
+	case "", historyActionCreate, historyActionRebuild, historyActionRotate, historyActionDestroy,
+		historyActionAdopt:
+	default:
+		return nil, logConfigurationError("history: unknown action", log.Fields{"action": filter.Action})
+	}
+
+	var err error
+	if since := c.String("since"); len(since) > 0 {
+		if filter.Since, err = parseHistoryTime(since, now); err != nil {
+			return nil, err
+		}
+	}
+	if until := c.String("until"); len(until) > 0 {
+		if filter.Until, err = parseHistoryTime(until, now); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func handleHistoryCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	filter, err := historyFilterFromContext(c, time.Now())
+	if err != nil {
+		return err
+	}
+	records, err := loadHistory(options.Runtime.RuntimeDir)
+	if err != nil {
+		return err
+	}
+	return printer.Print(filter.Apply(records))
+}
+
+func historyCommand() cli.Command {
+	return cli.Command{
+		Name:   "history",
+		Usage:  "show actions taken on tunnels, including destroyed ones",
+		Action: handleHistoryCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "since",
+				Usage: "show records since `TIME`, which is a date, RFC 3339 timestamp or duration ago",
+			},
+			cli.StringFlag{
+				Name:  "until",
+				Usage: "show records before `TIME`",
+			},
+			cli.StringFlag{
+				Name:  "session",
+				Usage: "show records of `NAME` session only",
+			},
+			cli.StringFlag{
+				Name:  "action",
+				Usage: "show create, rebuild, rotate, destroy or adopt records only",
+			},
+		},
+	}
+}
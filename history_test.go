@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	options := validTestOptions()
+	options.Runtime.Provider = providerTypeLinode.String()
+	options.LinodeParams.Region = "eu-central"
+	options.LinodeParams.Plan = "g6-nanode-1"
+	started := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := testSessionCache()
+	cache.Region, cache.Plan = tunnelPlacement(options)
+	// Placement the tunnel was created with is recorded, not the current one.
+	options.LinodeParams.Region = "us-east"
+
+	record := newHistoryRecord(options, historyActionCreate, cache, started, started.Add(90*time.Second), nil)
+	assert.Equal(t, defaultSessionName, record.Session)
+	assert.Equal(t, "eu-central", record.Region)
+	assert.Equal(t, "g6-nanode-1", record.Plan)
+	assert.Equal(t, []string{"192.0.2.1"}, record.IPv4)
+	assert.Equal(t, "1m30s", record.Duration)
+	assert.Equal(t, historyOutcomeOK, record.Outcome)
+
+	record = newHistoryRecord(options, historyActionCreate, &sessionCache{Region: "eu-central"}, started, started,
+		errors.New("rpc method returned an error"))
+	assert.Equal(t, historyOutcomeFailed, record.Outcome)
+	assert.Equal(t, "eu-central", record.Region)
+	assert.Empty(t, record.Label)
+	assert.Equal(t, "rpc method returned an error", record.Error)
+	record = newHistoryRecord(options, historyActionCreate, nil, started, started,
+		&transportError{cause: errors.New("timeout")})
+	assert.Equal(t, historyOutcomeUnknown, record.Outcome)
+}
+
+func TestDestroyHistoryRecord(t *testing.T) {
+	options := validTestOptions()
+	cache := testSessionCache()
+	cache.Plan = "g6-standard-1"
+	cache.Price = &tunnelPrice{Plan: "g6-standard-1", Hourly: 0.015}
+	now := cache.InstanceInfo.CreatedAt.Add(26 * time.Hour)
+
+	record := newDestroyHistoryRecord(options, cache, now.Add(-time.Second), now, nil)
+	assert.Equal(t, historyActionDestroy, record.Action)
+	assert.Equal(t, "g6-standard-1", record.Plan)
+	assert.Equal(t, "holepuncher", record.Label)
+	assert.Equal(t, "26h0m0s", record.Lifetime)
+
+	record = newDestroyHistoryRecord(options, cache, now, now, errors.New("rpc method returned an error"))
+	assert.Empty(t, record.Lifetime, "tunnel still exists")
+	record = newDestroyHistoryRecord(options, nil, now, now, nil)
+	assert.Empty(t, record.Label)
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	options := testSessionOptions(t, "")
+	records, err := loadHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	started := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, appendHistory(options,
+		newHistoryRecord(options, historyActionCreate, nil, started, started, nil)))
+	// Record torn by a crash is skipped.
+	filename := historyFilename(options.Runtime.RuntimeDir)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.WriteString("{\"time\":\n")
+	require.NoError(t, err)
+	file.Close()
+	require.NoError(t, appendHistory(options,
+		newHistoryRecord(options, historyActionDestroy, nil, started, started.Add(time.Hour), nil)))
+
+	records, err = loadHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, historyActionCreate, records[0].Action)
+	assert.Equal(t, historyActionDestroy, records[1].Action)
+	assert.True(t, started.Add(time.Hour).Equal(records[1].Time))
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	sessions, err := listSessions(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Empty(t, sessions, "history must not be taken for a session")
+}
+
+func TestHistoryFilter(t *testing.T) {
+	day := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	records := []*historyRecord{
+		{Time: day, Action: historyActionCreate, Session: defaultSessionName},
+		{Time: day.Add(24 * time.Hour), Action: historyActionDestroy, Session: defaultSessionName},
+		{Time: day.Add(48 * time.Hour), Action: historyActionCreate, Session: "evening"},
+	}
+
+	assert.Len(t, (&historyFilter{}).Apply(records), 3)
+	assert.Equal(t, records[1:], (&historyFilter{Since: day.Add(time.Hour)}).Apply(records))
+	assert.Equal(t, records[:1], (&historyFilter{Until: day.Add(24 * time.Hour)}).Apply(records))
+	assert.Equal(t, records[2:], (&historyFilter{Session: "evening"}).Apply(records))
+	assert.Equal(t, []*historyRecord{records[0], records[2]},
+		(&historyFilter{Action: historyActionCreate}).Apply(records))
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	now := time.Date(2018, 6, 10, 12, 0, 0, 0, time.UTC)
+	parsed, err := parseHistoryTime("2018-06-01", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC), parsed)
+
+	parsed, err = parseHistoryTime("2018-06-01T10:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC), parsed)
+
+	parsed, err = parseHistoryTime("720h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-720*time.Hour), parsed)
+
+	_, err = parseHistoryTime("last month", now)
+	assert.Error(t, err)
+}
+
+func TestTunnelWatcherRecordsHistory(t *testing.T) {
+	provider := &fakeCloudProvider{}
+	watcher, options := newTestTunnelWatcher(t, provider)
+	watcher.idle = time.Hour
+	require.NoError(t, saveSessionCache(testSessionCache(), options))
+
+	destroyed, err := watcher.checkSession(defaultSessionName)
+	require.NoError(t, err)
+	assert.True(t, destroyed)
+	records, err := loadHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, historyActionDestroy, records[0].Action)
+	assert.Equal(t, "8h0m0s", records[0].Lifetime)
+}
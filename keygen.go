@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	protobufKeySize = 32
+	// Obfsproxy shared secret is 20 bytes encoded as unpadded base32.
+	obfsproxySecretSize = 20
+)
+
+type wireGuardKeyPair struct {
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key"`
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		log.WithField("cause", err).Error("Random generator error")
+		return nil, err
+	}
+	return buf, nil
+}
+
+func generateProtobufKey() (string, error) {
+	key, err := randomBytes(protobufKeySize)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func generateObfsproxySecret() (string, error) {
+	secret, err := randomBytes(obfsproxySecretSize)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// generateWireGuardKeyPair creates Curve25519 key pair encoded the same way
+// as `wg genkey` and `wg pubkey` do.
+func generateWireGuardKeyPair() (*wireGuardKeyPair, error) {
+	private, err := randomBytes(curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &wireGuardKeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(private),
+		PublicKey:  base64.StdEncoding.EncodeToString(public),
+	}, nil
+}
+
+// wireGuardPublicKey derives public key from base64-encoded private key.
+func wireGuardPublicKey(privateKey string) (string, error) {
+	private, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(private) != curve25519.ScalarSize {
+		return "", errors.New("malformed wireguard private key")
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// writePrivateKeyFile stores private key in a file readable only by owner.
+func writePrivateKeyFile(filename, key string) error {
+	if err := ioutil.WriteFile(filename, []byte(key+"\n"), 0600); err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error writing private key file")
+		return err
+	}
+	// WriteFile doesn't change permissions of existing file.
+	return os.Chmod(filename, 0600)
+}
+
+func handleKeygenProtobufCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	serverKey, err := generateProtobufKey()
+	if err != nil {
+		return err
+	}
+	peerKey, err := generateProtobufKey()
+	if err != nil {
+		return err
+	}
+
+	if filename := c.String("write"); len(filename) > 0 {
+		if err = setConfigValue(filename, "client_protobuf", "server_key", tomlString(serverKey)); err != nil {
+			return err
+		}
+		if err = setConfigValue(filename, "client_protobuf", "peer_key", tomlString(peerKey)); err != nil {
+			return err
+		}
+		log.WithField("path", filename).Info("Protobuf keys were written to config. " +
+			"The same keys must be configured on Holepuncher server")
+	}
+
+	return printer.Print(struct {
+		ServerKey string `json:"server_key"`
+		PeerKey   string `json:"peer_key"`
+	}{serverKey, peerKey})
+}
+
+func handleKeygenWireGuardServerCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	pair, err := generateWireGuardKeyPair()
+	if err != nil {
+		return err
+	}
+
+	if filename := c.String("private-key-file"); len(filename) > 0 {
+		if err = writePrivateKeyFile(filename, pair.PrivateKey); err != nil {
+			return err
+		}
+	}
+	if filename := c.String("write"); len(filename) > 0 {
+		err = setConfigValue(filename, "wireguard", "server_key", tomlString(pair.PrivateKey))
+		if err != nil {
+			return err
+		}
+		log.WithField("path", filename).Info("WireGuard server key was written to config")
+	}
+
+	// Private key is only printed when it's not saved anywhere else.
+	if len(c.String("write")) > 0 || len(c.String("private-key-file")) > 0 {
+		pair.PrivateKey = ""
+	}
+	return printer.Print(pair)
+}
+
+func handleKeygenWireGuardPeerCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	pair, err := generateWireGuardKeyPair()
+	if err != nil {
+		return err
+	}
+
+	configFile := c.String("write")
+	keyFile := c.String("private-key-file")
+	if len(configFile) > 0 && len(keyFile) == 0 {
+		log.Error("--private-key-file is required with --write, otherwise peer's " +
+			"private key would be lost")
+		return errors.New("missing private key file")
+	}
+
+	if len(keyFile) > 0 {
+		if err = writePrivateKeyFile(keyFile, pair.PrivateKey); err != nil {
+			return err
+		}
+		log.WithField("path", keyFile).Info("WireGuard peer private key was saved")
+	}
+	if len(configFile) > 0 {
+		var current programOptions
+		if _, err = toml.DecodeFile(configFile, &current); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  configFile,
+			}).Error("Error reading config file")
+			return err
+		}
+
+		peerKeys := []string{}
+		for _, key := range current.WireGuard.PeerKeys {
+			if len(key) > 0 {
+				peerKeys = append(peerKeys, key)
+			}
+		}
+		peerKeys = append(peerKeys, pair.PublicKey)
+		err = setConfigValue(configFile, "wireguard", "peer_keys", tomlStringArray(peerKeys))
+		if err != nil {
+			return err
+		}
+		log.WithField("path", configFile).Info("WireGuard peer public key was added to config")
+	}
+
+	if len(keyFile) > 0 {
+		pair.PrivateKey = ""
+	}
+	return printer.Print(pair)
+}
+
+func handleKeygenObfsproxyCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	secret, err := generateObfsproxySecret()
+	if err != nil {
+		return err
+	}
+
+	section := "obfsproxy_ipv4"
+	if c.Bool("ipv6") {
+		section = "obfsproxy_ipv6"
+	}
+	if filename := c.String("write"); len(filename) > 0 {
+		if err = setConfigValue(filename, section, "secret", tomlString(secret)); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"path":    filename,
+			"section": section,
+		}).Info("Obfsproxy secret was written to config")
+	}
+
+	return printer.Print(struct {
+		Secret string `json:"secret"`
+	}{secret})
+}
+
+func keygenCommand() cli.Command {
+	writeFlag := cli.StringFlag{
+		Name:  "write, w",
+		Usage: "write generated key into config `FILE`",
+	}
+	privateKeyFlag := cli.StringFlag{
+		Name:  "private-key-file",
+		Usage: "save private key into `FILE` with 0600 permissions",
+	}
+
+	return cli.Command{
+		Name:  "keygen",
+		Usage: "generate keys and secrets",
+		Subcommands: []cli.Command{
+			{
+				Name:   "protobuf",
+				Usage:  "generate client_protobuf pre-shared keys",
+				Action: handleKeygenProtobufCommand,
+				Flags:  []cli.Flag{writeFlag},
+			},
+			{
+				Name:   "wireguard-server",
+				Usage:  "generate wireguard server key pair",
+				Action: handleKeygenWireGuardServerCommand,
+				Flags:  []cli.Flag{writeFlag, privateKeyFlag},
+			},
+			{
+				Name:   "wireguard-peer",
+				Usage:  "generate wireguard peer key pair and authorize its public key",
+				Action: handleKeygenWireGuardPeerCommand,
+				Flags:  []cli.Flag{writeFlag, privateKeyFlag},
+			},
+			{
+				Name:   "obfsproxy",
+				Usage:  "generate obfsproxy shared secret",
+				Action: handleKeygenObfsproxyCommand,
+				Flags: []cli.Flag{
+					writeFlag,
+					cli.BoolFlag{
+						Name:  "ipv6",
+						Usage: "write into obfsproxy_ipv6 section instead of obfsproxy_ipv4",
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateProtobufKey(t *testing.T) {
+	key, err := generateProtobufKey()
+	require.NoError(t, err)
+	raw, err := hex.DecodeString(key)
+	require.NoError(t, err)
+	assert.Len(t, raw, protobufKeySize)
+
+	other, err := generateProtobufKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
+
+func TestGenerateObfsproxySecret(t *testing.T) {
+	secret, err := generateObfsproxySecret()
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+	assert.Len(t, raw, obfsproxySecretSize)
+}
+
+func TestGenerateWireGuardKeyPair(t *testing.T) {
+	pair, err := generateWireGuardKeyPair()
+	require.NoError(t, err)
+
+	private, err := base64.StdEncoding.DecodeString(pair.PrivateKey)
+	require.NoError(t, err)
+	require.Len(t, private, 32)
+	assert.Equal(t, byte(0), private[0]&7, "private key must be clamped")
+	assert.Equal(t, byte(64), private[31]&192, "private key must be clamped")
+
+	public, err := wireGuardPublicKey(pair.PrivateKey)
+	require.NoError(t, err)
+	assert.Equal(t, pair.PublicKey, public)
+}
+
+func TestWireGuardPublicKey(t *testing.T) {
+	// RFC 7748, section 6.1.
+	private, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	public, _ := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	derived, err := wireGuardPublicKey(base64.StdEncoding.EncodeToString(private))
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(public), derived)
+
+	_, err = wireGuardPublicKey("not a key")
+	assert.Error(t, err)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+type linodePlanLess func(a, b *linodePlan) bool
+type linodeRegionLess func(a, b *linodeRegion) bool
+type linodeImageLess func(a, b *linodeImage) bool
+
+// Sort keys are the same as field names in JSON output.
+var linodePlanSortKeys = map[string]linodePlanLess{
+	"id":            func(a, b *linodePlan) bool { return a.ID < b.ID },
+	"class":         func(a, b *linodePlan) bool { return a.Class < b.Class },
+	"price_hourly":  func(a, b *linodePlan) bool { return a.PriceHourly < b.PriceHourly },
+	"price_monthly": func(a, b *linodePlan) bool { return a.PriceMonthly < b.PriceMonthly },
+	"memory":        func(a, b *linodePlan) bool { return a.Memory < b.Memory },
+	"transfer":      func(a, b *linodePlan) bool { return a.Transfer < b.Transfer },
+	"vcpus":         func(a, b *linodePlan) bool { return a.Vcpus < b.Vcpus },
+}
+
+var linodeRegionSortKeys = map[string]linodeRegionLess{
+	"id":      func(a, b *linodeRegion) bool { return a.ID < b.ID },
+	"country": func(a, b *linodeRegion) bool { return a.Country < b.Country },
+}
+
+var linodeImageSortKeys = map[string]linodeImageLess{
+	"id":         func(a, b *linodeImage) bool { return a.ID < b.ID },
+	"label":      func(a, b *linodeImage) bool { return a.Label < b.Label },
+	"vendor":     func(a, b *linodeImage) bool { return a.Vendor < b.Vendor },
+	"size":       func(a, b *linodeImage) bool { return a.Size < b.Size },
+	"created_at": func(a, b *linodeImage) bool { return a.CreatedAt.Before(b.CreatedAt) },
+}
+
+// linodePlanQuery filters and sorts plans. Zero values disable filters.
+type linodePlanQuery struct {
+	MaxPriceHourly  float64
+	MaxPriceMonthly float64
+	Class           string
+	MinMemory       uint64
+	MinVcpus        uint
+	Sort            string
+	Reverse         bool
+}
+
+// Match tells whether plan passes all filters.
+func (q *linodePlanQuery) Match(plan *linodePlan) bool {
+	switch {
+	case q.MaxPriceHourly > 0 && float64(plan.PriceHourly) > q.MaxPriceHourly:
+		return false
+	case q.MaxPriceMonthly > 0 && float64(plan.PriceMonthly) > q.MaxPriceMonthly:
+		return false
+	case len(q.Class) > 0 && !strings.EqualFold(plan.Class, q.Class):
+		return false
+	case plan.Memory < q.MinMemory:
+		return false
+	case plan.Vcpus < q.MinVcpus:
+		return false
+	}
+	return true
+}
+
+func (q *linodePlanQuery) Apply(plans []*linodePlan) []*linodePlan {
+	matched := []*linodePlan{}
+	for _, plan := range plans {
+		if q.Match(plan) {
+			matched = append(matched, plan)
+		}
+	}
+	if less, ok := linodePlanSortKeys[q.Sort]; ok {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if q.Reverse {
+				return less(matched[j], matched[i])
+			}
+			return less(matched[i], matched[j])
+		})
+	}
+	return matched
+}
+
+// linodeRegionQuery filters and sorts regions.
+type linodeRegionQuery struct {
+	// Region matches if its country is any of these.
+	Countries []string
+	Sort      string
+	Reverse   bool
+}
+
+func (q *linodeRegionQuery) Match(region *linodeRegion) bool {
+	if len(q.Countries) == 0 {
+		return true
+	}
+	for _, country := range q.Countries {
+		if strings.EqualFold(region.Country, country) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *linodeRegionQuery) Apply(regions []*linodeRegion) []*linodeRegion {
+	matched := []*linodeRegion{}
+	for _, region := range regions {
+		if q.Match(region) {
+			matched = append(matched, region)
+		}
+	}
+	if less, ok := linodeRegionSortKeys[q.Sort]; ok {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if q.Reverse {
+				return less(matched[j], matched[i])
+			}
+			return less(matched[i], matched[j])
+		})
+	}
+	return matched
+}
+
+// linodeImageQuery filters and sorts images.
+type linodeImageQuery struct {
+	Vendor  string
+	Sort    string
+	Reverse bool
+}
+
+func (q *linodeImageQuery) Match(image *linodeImage) bool {
+	return len(q.Vendor) == 0 || strings.EqualFold(image.Vendor, q.Vendor)
+}
+
+func (q *linodeImageQuery) Apply(images []*linodeImage) []*linodeImage {
+	matched := []*linodeImage{}
+	for _, image := range images {
+		if q.Match(image) {
+			matched = append(matched, image)
+		}
+	}
+	if less, ok := linodeImageSortKeys[q.Sort]; ok {
+		sort.SliceStable(matched, func(i, j int) bool {
+			if q.Reverse {
+				return less(matched[j], matched[i])
+			}
+			return less(matched[i], matched[j])
+		})
+	}
+	return matched
+}
+
+// verifySortKey fails if key is given and is not one of valid keys.
+func verifySortKey(key string, valid []string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	for _, name := range valid {
+		if name == key {
+			return nil
+		}
+	}
+	sort.Strings(valid)
+	log.WithFields(log.Fields{
+		"sort":  key,
+		"valid": strings.Join(valid, ", "),
+	}).Error("Unknown sort key")
+	return errors.New("unknown sort key")
+}
+
+func linodePlanQueryFromContext(c *cli.Context) (*linodePlanQuery, error) {
+	keys := []string{}
+	for key := range linodePlanSortKeys {
+		keys = append(keys, key)
+	}
+	if err := verifySortKey(c.String("sort"), keys); err != nil {
+		return nil, err
+	}
+	return &linodePlanQuery{
+		MaxPriceHourly:  c.Float64("max-price-hourly"),
+		MaxPriceMonthly: c.Float64("max-price-monthly"),
+		Class:           c.String("class"),
+		MinMemory:       c.Uint64("min-memory"),
+		MinVcpus:        c.Uint("min-vcpus"),
+		Sort:            c.String("sort"),
+		Reverse:         c.Bool("reverse"),
+	}, nil
+}
+
+func linodeRegionQueryFromContext(c *cli.Context) (*linodeRegionQuery, error) {
+	keys := []string{}
+	for key := range linodeRegionSortKeys {
+		keys = append(keys, key)
+	}
+	if err := verifySortKey(c.String("sort"), keys); err != nil {
+		return nil, err
+	}
+	return &linodeRegionQuery{
+		Countries: splitList(strings.Join(c.StringSlice("country"), ",")),
+		Sort:      c.String("sort"),
+		Reverse:   c.Bool("reverse"),
+	}, nil
+}
+
+func linodeImageQueryFromContext(c *cli.Context) (*linodeImageQuery, error) {
+	keys := []string{}
+	for key := range linodeImageSortKeys {
+		keys = append(keys, key)
+	}
+	if err := verifySortKey(c.String("sort"), keys); err != nil {
+		return nil, err
+	}
+	return &linodeImageQuery{
+		Vendor:  c.String("vendor"),
+		Sort:    c.String("sort"),
+		Reverse: c.Bool("reverse"),
+	}, nil
+}
+
+// sortFlags are accepted by listing commands that support sorting.
+func sortFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "sort",
+			Usage: "sort by `FIELD` as named in json output",
+		},
+		cli.BoolFlag{
+			Name:  "reverse",
+			Usage: "sort in descending order",
+		},
+	}
+}
+
+func linodePlansFlags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.Float64Flag{
+			Name:  "max-price-hourly",
+			Usage: "only list plans costing at most `PRICE` per hour",
+		},
+		cli.Float64Flag{
+			Name:  "max-price-monthly",
+			Usage: "only list plans costing at most `PRICE` per month",
+		},
+		cli.StringFlag{
+			Name:  "class",
+			Usage: "only list plans of `CLASS`, e.g. nanode or standard",
+		},
+		cli.Uint64Flag{
+			Name:  "min-memory",
+			Usage: "only list plans with at least `MB` of memory",
+		},
+		cli.UintFlag{
+			Name:  "min-vcpus",
+			Usage: "only list plans with at least `N` vcpus",
+		},
+	}
+	return append(flags, sortFlags()...)
+}
+
+func linodeRegionsFlags() []cli.Flag {
+	country := cli.StringSliceFlag{
+		Name:  "country",
+		Usage: "only list regions in `COUNTRY` (two-letter code, may be repeated)",
+	}
+	return append([]cli.Flag{country}, sortFlags()...)
+}
+
+func linodeImagesFlags() []cli.Flag {
+	vendor := cli.StringFlag{
+		Name:  "vendor",
+		Usage: "only list images of `VENDOR`, e.g. debian",
+	}
+	return append([]cli.Flag{vendor}, sortFlags()...)
+}
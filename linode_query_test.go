@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLinodePlanIDs(plans []*linodePlan) []string {
+	ids := []string{}
+	for _, plan := range plans {
+		ids = append(ids, plan.ID)
+	}
+	return ids
+}
+
+func TestLinodePlanQuery(t *testing.T) {
+	plans := []*linodePlan{
+		{ID: "g6-standard-2", Class: "standard", Vcpus: 2, Memory: 4096, PriceHourly: 0.03, PriceMonthly: 20},
+		{ID: "g6-nanode-1", Class: "nanode", Vcpus: 1, Memory: 1024, PriceHourly: 0.0075, PriceMonthly: 5},
+		{ID: "g6-standard-1", Class: "standard", Vcpus: 1, Memory: 2048, PriceHourly: 0.015, PriceMonthly: 10},
+		{ID: "g6-dedicated-2", Class: "dedicated", Vcpus: 2, Memory: 4096, PriceHourly: 0.045, PriceMonthly: 30},
+	}
+
+	query := &linodePlanQuery{Sort: "price_hourly"}
+	assert.Equal(t, []string{"g6-nanode-1", "g6-standard-1", "g6-standard-2", "g6-dedicated-2"},
+		testLinodePlanIDs(query.Apply(plans)))
+
+	query = &linodePlanQuery{MaxPriceHourly: 0.03, Sort: "price_hourly", Reverse: true}
+	assert.Equal(t, []string{"g6-standard-2", "g6-standard-1", "g6-nanode-1"},
+		testLinodePlanIDs(query.Apply(plans)))
+
+	query = &linodePlanQuery{Class: "Standard", MinMemory: 4096}
+	assert.Equal(t, []string{"g6-standard-2"}, testLinodePlanIDs(query.Apply(plans)))
+
+	query = &linodePlanQuery{MinVcpus: 2, MaxPriceMonthly: 25}
+	assert.Equal(t, []string{"g6-standard-2"}, testLinodePlanIDs(query.Apply(plans)))
+
+	// Input order is kept without sort key.
+	assert.Equal(t, testLinodePlanIDs(plans), testLinodePlanIDs((&linodePlanQuery{}).Apply(plans)))
+}
+
+func TestLinodeRegionQuery(t *testing.T) {
+	regions := []*linodeRegion{
+		{ID: "us-east", Country: "us"},
+		{ID: "eu-central", Country: "de"},
+		{ID: "eu-west", Country: "uk"},
+	}
+
+	query := &linodeRegionQuery{Countries: []string{"DE", "uk"}, Sort: "id", Reverse: true}
+	assert.Equal(t, []*linodeRegion{regions[2], regions[1]}, query.Apply(regions))
+	assert.Len(t, (&linodeRegionQuery{}).Apply(regions), 3)
+}
+
+func TestLinodeImageQuery(t *testing.T) {
+	older := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	images := []*linodeImage{
+		{ID: "linode/debian9", Vendor: "Debian", CreatedAt: older.AddDate(0, 6, 0)},
+		{ID: "linode/arch", Vendor: "Arch"},
+		{ID: "linode/debian8", Vendor: "Debian", CreatedAt: older},
+	}
+
+	query := &linodeImageQuery{Vendor: "debian", Sort: "created_at"}
+	assert.Equal(t, []*linodeImage{images[2], images[0]}, query.Apply(images))
+}
+
+func TestVerifySortKey(t *testing.T) {
+	valid := []string{"id", "price_hourly"}
+	assert.NoError(t, verifySortKey("", valid))
+	assert.NoError(t, verifySortKey("price_hourly", valid))
+	assert.Error(t, verifySortKey("price", valid))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"protoapi"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Create attempts made by selection policy unless configured otherwise.
+const defaultLinodeSelectionAttempts = 5
+
+// linodeSelectionPolicy picks region and plan at create time. Configured
+// region and plan, if any, are tried first, but only if they satisfy the
+// policy.
+type linodeSelectionPolicy struct {
+	// Regions in order of preference.
+	Regions []string `toml:"regions"`
+	// Two-letter country codes regions must be in. When set, other regions
+	// in these countries are tried after preferred ones.
+	Countries      []string `toml:"countries"`
+	MaxPriceHourly float64  `toml:"max_price_hourly"`
+	MinMemory      uint64   `toml:"min_memory"`
+	MinVcpus       uint     `toml:"min_vcpus"`
+	Class          string   `toml:"class"`
+	MaxAttempts    uint     `toml:"max_attempts"`
+}
+
+func (s *linodeSelectionPolicy) Enabled() bool {
+	return len(s.Regions) > 0 || len(s.Countries) > 0 || s.MaxPriceHourly > 0 ||
+		s.MinMemory > 0 || s.MinVcpus > 0 || len(s.Class) > 0
+}
+
+// linodeCandidateRegions returns IDs of regions to try in order.
+func linodeCandidateRegions(
+	policy *linodeSelectionPolicy,
+	configured string,
+	regions []*linodeRegion,
+) []string {
+	query := &linodeRegionQuery{Countries: policy.Countries, Sort: "id"}
+	allowed := query.Apply(regions)
+	isAllowed := map[string]bool{}
+	for _, region := range allowed {
+		isAllowed[region.ID] = true
+	}
+
+	candidates := []string{}
+	add := func(id string) {
+		if isAllowed[id] {
+			candidates = append(candidates, id)
+			isAllowed[id] = false
+		}
+	}
+	add(configured)
+	for _, id := range policy.Regions {
+		add(id)
+	}
+	if len(policy.Countries) > 0 || len(policy.Regions) == 0 {
+		for _, region := range allowed {
+			add(region.ID)
+		}
+	}
+	return candidates
+}
+
+// linodeCandidatePlans returns IDs of plans to try, cheapest first.
+func linodeCandidatePlans(
+	policy *linodeSelectionPolicy,
+	configured string,
+	plans []*linodePlan,
+) []string {
+	query := &linodePlanQuery{
+		MaxPriceHourly: policy.MaxPriceHourly,
+		Class:          policy.Class,
+		MinMemory:      policy.MinMemory,
+		MinVcpus:       policy.MinVcpus,
+		Sort:           "price_hourly",
+	}
+	matched := query.Apply(plans)
+
+	candidates := []string{}
+	for _, plan := range matched {
+		if plan.ID == configured {
+			candidates = append(candidates, plan.ID)
+		}
+	}
+	for _, plan := range matched {
+		if plan.ID != configured {
+			candidates = append(candidates, plan.ID)
+		}
+	}
+	return candidates
+}
+
+// linodeRPCError is returned when Linode rejects the create request.
+type linodeRPCError struct {
+	linodeErr *protoapi.LinodeError
+}
+
+func (e *linodeRPCError) Error() string {
+	return "rpc method returned an error"
+}
+
+const (
+	linodePlacementRegion   = "region"
+	linodePlacementPlan     = "plan"
+	linodePlacementCapacity = "capacity"
+)
+
+// linodeCapacityReasons are substrings of error reasons Linode gives when
+// it can't place instance.
+var linodeCapacityReasons = []string{"capacity", "unavailable", "not available", "sold out"}
+
+// linodePlacementError tells whether err means that tunnel can't be created
+// with the selected region or plan, and which one is to blame. Empty string
+// is returned for other errors.
+func linodePlacementError(err error) string {
+	rpcErr, ok := errors.Cause(err).(*linodeRPCError)
+	if !ok {
+		return ""
+	}
+	for _, detail := range rpcErr.linodeErr.GetDetails() {
+		switch strings.ToLower(detail.GetField()) {
+		case "region":
+			return linodePlacementRegion
+		case "type", "plan":
+			return linodePlacementPlan
+		}
+	}
+
+	reasons := []string{rpcErr.linodeErr.GetError().GetMessage()}
+	for _, detail := range rpcErr.linodeErr.GetDetails() {
+		reasons = append(reasons, detail.GetReason())
+	}
+	for _, reason := range reasons {
+		for _, marker := range linodeCapacityReasons {
+			if strings.Contains(strings.ToLower(reason), marker) {
+				return linodePlacementCapacity
+			}
+		}
+	}
+	return ""
+}
+
+// resolvePlacement lists regions and plans and selects the first candidate.
+// It's done once per provider.
+func (p *providerLinode) resolvePlacement() error {
+	if p.candidates != nil {
+		return nil
+	}
+	policy := &p.options.LinodeParams.Selection
+	regions, err := p.ListRegions()
+	if err != nil {
+		return err
+	}
+	plans, err := p.ListPlans()
+	if err != nil {
+		return err
+	}
+
+	candidates := &linodePlacementCandidates{
+		Regions: linodeCandidateRegions(policy, p.options.LinodeParams.Region, regions),
+		Plans:   linodeCandidatePlans(policy, p.options.LinodeParams.Plan, plans),
+	}
+	if len(candidates.Regions) == 0 {
+		return logConfigurationError("linode: no region satisfies selection policy")
+	} else if len(candidates.Plans) == 0 {
+		return logConfigurationError("linode: no plan satisfies selection policy")
+	}
+	log.WithFields(log.Fields{
+		"regions": strings.Join(candidates.Regions, ", "),
+		"plans":   strings.Join(candidates.Plans, ", "),
+	}).Debug("Resolved selection policy")
+
+	p.plans = plans
+	p.candidates = candidates
+	p.options.LinodeParams.Region = candidates.Regions[0]
+	p.options.LinodeParams.Plan = candidates.Plans[0]
+	return nil
+}
+
+// linodePlacementCandidates are regions and plans to try in order.
+type linodePlacementCandidates struct {
+	Regions []string
+	Plans   []string
+}
+
+// createTunnelWithPolicy tries candidate regions and plans until the tunnel
+// is created. Only errors that blame region, plan or capacity cause fallback
+// to the next candidate.
+func (p *providerLinode) createTunnelWithPolicy() (*createTunnelResult, error) {
+	if err := p.resolvePlacement(); err != nil {
+		return nil, err
+	}
+	if p.options.DryRun {
+		log.WithFields(log.Fields{
+			"regions": strings.Join(p.candidates.Regions, ", "),
+			"plans":   strings.Join(p.candidates.Plans, ", "),
+		}).Info("Dry run, request for the first candidate is shown")
+		return p.createTunnel()
+	}
+
+	maxAttempts := p.options.LinodeParams.Selection.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultLinodeSelectionAttempts
+	}
+	badRegions := map[string]bool{}
+	badPlans := map[string]bool{}
+	attempts := uint(0)
+	var lastErr error
+	for _, region := range p.candidates.Regions {
+		for _, plan := range p.candidates.Plans {
+			if badRegions[region] {
+				break
+			} else if badPlans[plan] {
+				continue
+			} else if attempts == maxAttempts {
+				log.WithField("attempts", attempts).Error("Giving up creating tunnel")
+				return nil, lastErr
+			}
+			fields := log.Fields{"region": region, "plan": plan}
+			if err := p.checkPlanBudget(plan); err != nil {
+				lastErr = err
+				badPlans[plan] = true
+				log.WithFields(fields).Warning("Plan does not fit budget, trying next candidate")
+				continue
+			}
+			attempts++
+
+			log.WithFields(fields).Info("Creating tunnel")
+			p.options.LinodeParams.Region = region
+			p.options.LinodeParams.Plan = plan
+			result, err := p.createTunnel()
+			if err == nil {
+				return result, nil
+			}
+
+			lastErr = err
+			switch linodePlacementError(err) {
+			case linodePlacementRegion:
+				badRegions[region] = true
+			case linodePlacementPlan:
+				badPlans[plan] = true
+			case linodePlacementCapacity:
+			default:
+				return nil, err
+			}
+			log.WithFields(fields).Warning("Tunnel can't be placed, trying next candidate")
+		}
+	}
+	log.Error("No region and plan left to try")
+	return nil, lastErr
+}
+
+// SetBudgetCheck makes selection policy skip plans rejected by check.
+func (p *providerLinode) SetBudgetCheck(check func(price *tunnelPrice) error) {
+	p.budgetCheck = check
+}
+
+func (p *providerLinode) checkPlanBudget(plan string) error {
+	if p.budgetCheck == nil {
+		return nil
+	}
+	price, err := linodePlanPrice(p.plans, plan)
+	if err != nil {
+		return err
+	}
+	return p.budgetCheck(price)
+}
+
+// createdPlanPrice returns price of the plan tunnel was created with. It
+// differs from price looked up before creation if selection policy fell
+// back to another plan.
+func createdPlanPrice(provider aCloudProvider, options *programOptions, price *tunnelPrice) *tunnelPrice {
+	if options.Runtime.Provider != providerTypeLinode.String() ||
+		!options.LinodeParams.Selection.Enabled() {
+		return price
+	}
+	return lookupPlanPrice(provider)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"protoapi"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedHolepuncherClient returns responses in order.
+type scriptedHolepuncherClient struct {
+	responses []*protoapi.Response
+	requests  []*protoapi.Request
+}
+
+func (c *scriptedHolepuncherClient) DoRequest(m *protoapi.Request) (*protoapi.Response, error) {
+	c.requests = append(c.requests, m)
+	response := c.responses[0]
+	c.responses = c.responses[1:]
+	return response, nil
+}
+
+func testLinodeSelectionResponses(creates ...*protoapi.Response) []*protoapi.Response {
+	regions := &protoapi.Response{R: &protoapi.Response_LinodeListRegionsResult{
+		LinodeListRegionsResult: &protoapi.LinodeListRegionsResponse{
+			Regions: &protoapi.LinodeRegionList{L: []*protoapi.LinodeRegion{
+				{Id: "us-east", Country: "us"},
+				{Id: "eu-central", Country: "de"},
+				{Id: "eu-west", Country: "uk"},
+				{Id: "eu-north", Country: "se"},
+			}},
+		},
+	}}
+	plans := &protoapi.Response{R: &protoapi.Response_LinodeListPlansResult{
+		LinodeListPlansResult: &protoapi.LinodeListPlansResponse{
+			Plans: &protoapi.LinodePlanList{L: []*protoapi.LinodePlan{
+				{Id: "g6-standard-1", Class: "standard", Vcpus: 1, Memory: 2048, PriceHourly: 0.015},
+				{Id: "g6-nanode-1", Class: "nanode", Vcpus: 1, Memory: 1024, PriceHourly: 0.0075},
+				{Id: "g6-standard-2", Class: "standard", Vcpus: 2, Memory: 4096, PriceHourly: 0.03},
+			}},
+		},
+	}}
+	return append([]*protoapi.Response{regions, plans}, creates...)
+}
+
+func testLinodeCreateFailure(field, reason string) *protoapi.Response {
+	return &protoapi.Response{R: &protoapi.Response_LinodeCreateTunnelResult{
+		LinodeCreateTunnelResult: &protoapi.LinodeCreateTunnelResponse{
+			Error: &protoapi.LinodeError{
+				Details: []*protoapi.LinodeErrorDetail{{Field: field, Reason: reason}},
+			},
+		},
+	}}
+}
+
+func newTestLinodeSelectionProvider(t *testing.T, client aHolepuncherClient) *providerLinode {
+	p := newTestLinodeProvider(t, client)
+	p.options.LinodeParams.Region = ""
+	p.options.LinodeParams.Plan = ""
+	p.options.LinodeParams.Selection = linodeSelectionPolicy{
+		Regions:        []string{"eu-west", "eu-central"},
+		Countries:      []string{"de", "uk", "se"},
+		MaxPriceHourly: 0.02,
+	}
+	return p
+}
+
+func testCreatedPlacements(requests []*protoapi.Request) [][2]string {
+	placements := [][2]string{}
+	for _, request := range requests {
+		if create := request.GetLinodeCreateTunnel(); create != nil {
+			placements = append(placements, [2]string{create.Region, create.Plan})
+		}
+	}
+	return placements
+}
+
+func TestLinodeCandidateRegions(t *testing.T) {
+	regions := []*linodeRegion{
+		{ID: "us-east", Country: "us"},
+		{ID: "eu-west", Country: "uk"},
+		{ID: "eu-central", Country: "de"},
+		{ID: "ap-south", Country: "sg"},
+	}
+
+	policy := &linodeSelectionPolicy{Regions: []string{"eu-central", "missing"}, Countries: []string{"de", "uk"}}
+	assert.Equal(t, []string{"eu-central", "eu-west"}, linodeCandidateRegions(policy, "", regions))
+	assert.Equal(t, []string{"eu-central", "eu-west"}, linodeCandidateRegions(policy, "us-east", regions))
+	assert.Equal(t, []string{"eu-west", "eu-central"}, linodeCandidateRegions(policy, "eu-west", regions))
+
+	// Only preferred regions are tried if no countries are given.
+	policy = &linodeSelectionPolicy{Regions: []string{"us-east", "eu-west"}}
+	assert.Equal(t, []string{"us-east", "eu-west"}, linodeCandidateRegions(policy, "", regions))
+
+	policy = &linodeSelectionPolicy{MaxPriceHourly: 1}
+	assert.Equal(t, []string{"ap-south", "eu-central", "eu-west", "us-east"},
+		linodeCandidateRegions(policy, "", regions))
+}
+
+func TestLinodeCandidatePlans(t *testing.T) {
+	plans := []*linodePlan{
+		{ID: "g6-standard-2", Class: "standard", Vcpus: 2, Memory: 4096, PriceHourly: 0.03},
+		{ID: "g6-nanode-1", Class: "nanode", Vcpus: 1, Memory: 1024, PriceHourly: 0.0075},
+		{ID: "g6-standard-1", Class: "standard", Vcpus: 1, Memory: 2048, PriceHourly: 0.015},
+	}
+
+	policy := &linodeSelectionPolicy{MaxPriceHourly: 0.02}
+	assert.Equal(t, []string{"g6-nanode-1", "g6-standard-1"}, linodeCandidatePlans(policy, "", plans))
+	assert.Equal(t, []string{"g6-standard-1", "g6-nanode-1"},
+		linodeCandidatePlans(policy, "g6-standard-1", plans))
+	// Configured plan must satisfy policy too.
+	assert.Equal(t, []string{"g6-nanode-1", "g6-standard-1"},
+		linodeCandidatePlans(policy, "g6-standard-2", plans))
+
+	policy = &linodeSelectionPolicy{MinMemory: 2048}
+	assert.Equal(t, []string{"g6-standard-1", "g6-standard-2"}, linodeCandidatePlans(policy, "", plans))
+}
+
+func TestLinodePlacementError(t *testing.T) {
+	rpcErr := func(message, field, reason string) error {
+		return &linodeRPCError{linodeErr: &protoapi.LinodeError{
+			Error:   &protoapi.Error{Message: message},
+			Details: []*protoapi.LinodeErrorDetail{{Field: field, Reason: reason}},
+		}}
+	}
+	assert.Equal(t, linodePlacementRegion, linodePlacementError(rpcErr("", "region", "invalid")))
+	assert.Equal(t, linodePlacementPlan, linodePlacementError(rpcErr("", "type", "retired")))
+	assert.Equal(t, linodePlacementCapacity,
+		linodePlacementError(rpcErr("", "", "Out of Capacity in this region")))
+	assert.Equal(t, linodePlacementCapacity, linodePlacementError(rpcErr("Plan sold out", "", "")))
+	assert.Equal(t, "", linodePlacementError(rpcErr("", "root_pass", "too weak")))
+	assert.Equal(t, "", linodePlacementError(&transportError{}))
+}
+
+func TestLinodeCreateTunnelWithPolicy(t *testing.T) {
+	client := &scriptedHolepuncherClient{responses: testLinodeSelectionResponses(
+		testLinodeCreateFailure("", "No capacity"),
+		testLinodeCreateFailure("region", "Region is unavailable"),
+		testLinodeCreateFailure("type", "Plan is retired"),
+		linodeRPCTestCases()[0].success,
+	)}
+	p := newTestLinodeSelectionProvider(t, client)
+
+	result, err := p.CreateTunnel()
+	require.NoError(t, err)
+	assert.Equal(t, "holepuncher", result.Instance.Label)
+	assert.Equal(t, [][2]string{
+		{"eu-west", "g6-nanode-1"},
+		{"eu-west", "g6-standard-1"},
+		{"eu-central", "g6-nanode-1"},
+		{"eu-central", "g6-standard-1"},
+	}, testCreatedPlacements(client.requests))
+	assert.Equal(t, "eu-central", p.options.LinodeParams.Region)
+	assert.Equal(t, "g6-standard-1", p.options.LinodeParams.Plan)
+
+	price, err := p.PlanPrice()
+	require.NoError(t, err)
+	assert.Equal(t, "g6-standard-1", price.Plan)
+	assert.Empty(t, client.responses)
+}
+
+func TestLinodeCreateTunnelWithPolicySkipsPlansOverBudget(t *testing.T) {
+	client := &scriptedHolepuncherClient{responses: testLinodeSelectionResponses(
+		testLinodeCreateFailure("", "No capacity"),
+		linodeRPCTestCases()[0].success,
+	)}
+	p := newTestLinodeSelectionProvider(t, client)
+	checked := []string{}
+	p.SetBudgetCheck(func(price *tunnelPrice) error {
+		checked = append(checked, price.Plan)
+		if price.Hourly > 0.01 {
+			return errors.New("budget exceeded")
+		}
+		return nil
+	})
+
+	_, err := p.CreateTunnel()
+	require.NoError(t, err)
+	assert.Equal(t, [][2]string{
+		{"eu-west", "g6-nanode-1"},
+		{"eu-central", "g6-nanode-1"},
+	}, testCreatedPlacements(client.requests))
+	assert.Equal(t, []string{"g6-nanode-1", "g6-standard-1", "g6-nanode-1"}, checked)
+	assert.Equal(t, "eu-central", p.options.LinodeParams.Region)
+}
+
+func TestLinodeCreateTunnelWithPolicyStopsOnOtherErrors(t *testing.T) {
+	client := &scriptedHolepuncherClient{responses: testLinodeSelectionResponses(
+		testLinodeCreateFailure("root_pass", "Password is too weak"),
+	)}
+	p := newTestLinodeSelectionProvider(t, client)
+
+	_, err := p.CreateTunnel()
+	assert.EqualError(t, err, "rpc method returned an error")
+	assert.Len(t, testCreatedPlacements(client.requests), 1)
+}
+
+func TestLinodeCreateTunnelWithPolicyAttemptLimit(t *testing.T) {
+	client := &scriptedHolepuncherClient{responses: testLinodeSelectionResponses(
+		testLinodeCreateFailure("", "No capacity"),
+		testLinodeCreateFailure("", "No capacity"),
+	)}
+	p := newTestLinodeSelectionProvider(t, client)
+	p.options.LinodeParams.Selection.MaxAttempts = 2
+
+	_, err := p.CreateTunnel()
+	assert.Error(t, err)
+	assert.Len(t, testCreatedPlacements(client.requests), 2)
+}
+
+func TestLinodeCreateTunnelWithPolicyDryRun(t *testing.T) {
+	queries := &scriptedHolepuncherClient{responses: testLinodeSelectionResponses()}
+	out := &bytes.Buffer{}
+	p := newTestLinodeSelectionProvider(t, &dryRunClient{out: out, queries: queries})
+	p.options.DryRun = true
+
+	_, err := p.CreateTunnel()
+	assert.True(t, isDryRun(err))
+	assert.Len(t, queries.requests, 2, "only queries must be sent")
+	assert.Empty(t, testCreatedPlacements(queries.requests))
+	assert.Contains(t, out.String(), `"eu-west"`)
+	assert.Contains(t, out.String(), `"g6-nanode-1"`)
+}
+
+func TestLinodeProviderWithPolicyDoesNotRequireRegionAndPlan(t *testing.T) {
+	o := validTestOptions()
+	o.LinodeParams.AccessToken = "token"
+	o.LinodeParams.Selection.Countries = []string{"de"}
+	_, err := newLinodeProvider(&fakeHolepuncherClient{}, o)
+	assert.NoError(t, err)
+}
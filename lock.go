@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const sessionLockPollInterval = 200 * time.Millisecond
+
+// errSessionLocked is returned when another invocation holds session lock.
+var errSessionLocked = errors.New("another operation in progress")
+
+// errLockWouldBlock is returned by lockFile when lock is held elsewhere.
+var errLockWouldBlock = errors.New("lock is held")
+
+// sessionLock is an advisory lock serializing operations that modify a
+// tunnel and its session cache. Lock file is left in place on release,
+// since removing it would race with other invocations opening it.
+type sessionLock struct {
+	file *os.File
+}
+
+// sessionLockFilename returns path to lock file of the session, named after
+// its cache file.
+func sessionLockFilename(runtimeDir string, session string) string {
+	return strings.TrimSuffix(sessionCacheFilename(runtimeDir, session), ".json") + ".lock"
+}
+
+// acquireSessionLock locks the session, waiting up to wait for another
+// invocation to release it.
+func acquireSessionLock(options *programOptions, wait time.Duration) (*sessionLock, error) {
+	lock, holder, err := tryAcquireSessionLock(options, wait)
+	if err == errSessionLocked {
+		log.WithFields(log.Fields{
+			"session": exportSessionName(options),
+			"pid":     holder,
+		}).Error("Another operation on the session is in progress, use --wait-lock to wait for it")
+	}
+	return lock, err
+}
+
+// tryAcquireSessionLock is like acquireSessionLock, but leaves reporting
+// busy session to the caller. Pid of the lock holder is returned then.
+func tryAcquireSessionLock(options *programOptions, wait time.Duration) (*sessionLock, string, error) {
+	filename := sessionLockFilename(options.Runtime.RuntimeDir, options.Session)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Unable to open session lock")
+		return nil, "", err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = lockFile(file)
+		if err == nil {
+			break
+		} else if err != errLockWouldBlock {
+			file.Close()
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  filename,
+			}).Error("Unable to lock session")
+			return nil, "", err
+		}
+
+		if !time.Now().Before(deadline) {
+			holder, _ := ioutil.ReadFile(filename)
+			file.Close()
+			return nil, strings.TrimSpace(string(holder)), errSessionLocked
+		}
+		time.Sleep(sessionLockPollInterval)
+	}
+
+	// Holder's pid only helps diagnosing, so errors are ignored.
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &sessionLock{file: file}, "", nil
+}
+
+func (l *sessionLock) Release() {
+	unlockFile(l.file)
+	l.file.Close()
+}
+
+// lockSessionFromContext locks session selected on command line, waiting as
+// long as --wait-lock tells.
+func lockSessionFromContext(c *cli.Context, options *programOptions) (*sessionLock, error) {
+	lock, err := acquireSessionLock(options, c.GlobalDuration("wait-lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyCachedProfile(options); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// verifyCachedProfile reads session cache again once the lock is held.
+// Options were resolved with profile recorded in the cache before that, and
+// must not be used if another operation has switched the session to another
+// profile meanwhile.
+func verifyCachedProfile(options *programOptions) error {
+	cache, err := restoreSessionCacheIfExists(options)
+	if err != nil {
+		return err
+	}
+	profile := ""
+	if cache != nil {
+		profile = cache.Profile
+	}
+	if profile != options.CachedProfile {
+		log.WithFields(log.Fields{
+			"session":  exportSessionName(options),
+			"resolved": options.CachedProfile,
+			"cached":   profile,
+		}).Error("Session was switched to another profile by another operation, run the command again")
+		return errors.New("session profile changed")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionLockFilename(t *testing.T) {
+	assert.Equal(t, "/run/session.lock", sessionLockFilename("/run", ""))
+	assert.Equal(t, "/run/session-evening.lock", sessionLockFilename("/run", "evening"))
+}
+
+func TestSessionLockIsExclusive(t *testing.T) {
+	o := testSessionOptions(t, "")
+	lock, err := acquireSessionLock(o, 0)
+	require.NoError(t, err)
+
+	_, err = acquireSessionLock(o, 0)
+	assert.Equal(t, errSessionLocked, err)
+	_, holder, err := tryAcquireSessionLock(o, 0)
+	assert.Equal(t, errSessionLocked, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), holder)
+
+	// Other sessions are not affected.
+	other, err := sessionOptions(o, "evening")
+	require.NoError(t, err)
+	otherLock, err := acquireSessionLock(other, 0)
+	require.NoError(t, err)
+	otherLock.Release()
+
+	lock.Release()
+	lock, err = acquireSessionLock(o, 0)
+	require.NoError(t, err)
+	lock.Release()
+}
+
+func TestSessionLockWait(t *testing.T) {
+	o := testSessionOptions(t, "")
+	lock, err := acquireSessionLock(o, 0)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(2 * sessionLockPollInterval)
+		lock.Release()
+	}()
+
+	waited, err := acquireSessionLock(o, time.Minute)
+	require.NoError(t, err)
+	waited.Release()
+}
+
+func TestVerifyCachedProfile(t *testing.T) {
+	o := testSessionOptions(t, "")
+	assert.NoError(t, verifyCachedProfile(o))
+
+	cache := testSessionCache()
+	cache.Profile = "spare"
+	require.NoError(t, saveSessionCache(cache, o))
+	assert.Error(t, verifyCachedProfile(o), "session was switched to spare profile")
+
+	require.NoError(t, applyCachedProfile(o))
+	assert.NoError(t, verifyCachedProfile(o))
+}
@@ -1,36 +1,58 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"net/http"
 	"os"
-	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 type erasedLinodeRPCFn func(*providerLinode) (interface{}, error)
+type erasedDigitalOceanRPCFn func(*providerDigitalOcean) (interface{}, error)
 
-// prettyPrint prints given value as indented JSON.
-func prettyPrint(v interface{}) {
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
+// createdTunnelClockSkew is how much earlier than the create request server
+// may date the created instance.
+const createdTunnelClockSkew = 2 * time.Minute
 
-	if err := encoder.Encode(v); err != nil {
-		log.Warning("Unable to pretty-print tunnel information, will dump raw data instead...")
-		fmt.Printf("%+v\n", v)
+// newProgramOptionsFromContext loads config file and applies the profile of
+// the session selected on command line, or the profile its tunnel was
+// created with.
+func newProgramOptionsFromContext(c *cli.Context) (*programOptions, error) {
+	options, err := newSessionlessProgramOptionsFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyCachedProfile(options); err != nil {
+		return nil, err
 	}
+	return options, nil
 }
 
-func doLinodeRPC(c *cli.Context, fn erasedLinodeRPCFn) (interface{}, error) {
+// newSessionlessProgramOptionsFromContext is like
+// newProgramOptionsFromContext, but doesn't read session cache. It's used by
+// commands that must work even if session cache is unreadable.
+func newSessionlessProgramOptionsFromContext(c *cli.Context) (*programOptions, error) {
 	options, err := newProgramOptions(c.GlobalString("config"))
 	if err != nil {
 		return nil, err
 	}
+	if err = applySessionProfile(options, c.GlobalString("session")); err != nil {
+		return nil, err
+	}
+	options.DryRun = c.Bool("dry-run")
+	return options, nil
+}
+
+func doLinodeRPC(c *cli.Context, fn erasedLinodeRPCFn) (interface{}, error) {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := newHolepuncherClient(options, newHTTPClient(options))
+	client, err := newClientFromOptions(options)
 	if err != nil {
 		return nil, err
 	}
@@ -42,16 +64,48 @@ func doLinodeRPC(c *cli.Context, fn erasedLinodeRPCFn) (interface{}, error) {
 }
 
 func printLinodeResult(c *cli.Context, fn erasedLinodeRPCFn) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
 	result, err := doLinodeRPC(c, fn)
 	if err != nil {
 		return err
 	}
-	prettyPrint(result)
-	return nil
+	return printer.Print(result)
+}
+
+func doDigitalOceanRPC(c *cli.Context, fn erasedDigitalOceanRPCFn) (interface{}, error) {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClientFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := newDigitalOceanProvider(client, options)
+	if err != nil {
+		return nil, err
+	}
+	return fn(provider)
+}
+
+func printDigitalOceanResult(c *cli.Context, fn erasedDigitalOceanRPCFn) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	result, err := doDigitalOceanRPC(c, fn)
+	if err != nil {
+		return err
+	}
+	return printer.Print(result)
 }
 
 func newCloudProviderFromContext(c *cli.Context) (aCloudProvider, *programOptions, error) {
-	options, err := newProgramOptions(c.GlobalString("config"))
+	options, err := newProgramOptionsFromContext(c)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -70,18 +124,125 @@ func handleCreateTunnelCommand(c *cli.Context) error {
 	if err = verifySessionCacheIsWritable(options.Runtime.RuntimeDir); err != nil {
 		return err
 	}
-	result, err := provider.CreateTunnel()
+	if options.DryRun {
+		_, err = provider.CreateTunnel()
+		return dryRunResult(err)
+	}
+	lock, err := lockSessionFromContext(c, options)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Bookkeeping state, which is saved along with the instance.
+	previous, err := restoreSessionCacheIfExists(options)
 	if err != nil {
 		return err
 	}
+	cache := &sessionCache{Price: lookupPlanPrice(provider)}
+	cache.Region, cache.Plan = tunnelPlacement(options)
+	if previous != nil {
+		// Options were resolved using profile from the stale cache.
+		cache.Profile = previous.Profile
+	}
+	now := time.Now()
+	if err = checkTunnelBudget(provider, options, cache.Price, c.Duration("ttl"), now); err != nil {
+		return err
+	}
+	setSessionTTL(cache, c.Duration("ttl"), now)
+
+	result, err := provider.CreateTunnel()
+	if err == nil || isAmbiguousRPCError(err) {
+		// Selection policy may have fallen back to another region and plan.
+		cache.Region, cache.Plan = tunnelPlacement(options)
+		cache.Price = createdPlanPrice(provider, options, cache.Price)
+	}
+	if isAmbiguousRPCError(err) {
+		// Tunnel adopted by reconciliation was created successfully.
+		err = reconcileCreatedTunnel(provider, options, cache, now, err)
+		appendHistory(options, newHistoryRecord(options, historyActionCreate, cache, now, time.Now(), err))
+		return err
+	} else if err != nil {
+		appendHistory(options, newHistoryRecord(options, historyActionCreate, cache, now, time.Now(), err))
+		return err
+	}
 	log.Info("Tunnel instance was successfully created")
 
-	cache := &sessionCache{
-		InstanceInfo:   &result.Instance,
-		CreationParams: &result.CreationParams,
+	cache.InstanceInfo = &result.Instance
+	cache.CreationParams = &result.CreationParams
+	appendHistory(options, newHistoryRecord(options, historyActionCreate, cache, now, time.Now(), nil))
+	if err = saveSessionCache(cache, options); err != nil {
+		return err
 	}
-	saveSessionCache(cache, options.Runtime.RuntimeDir)
-	return nil
+	return waitForTunnelIfRequested(c, provider, cache, options)
+}
+
+// findCreatedTunnel is called when the outcome of tunnel creation request
+// sent at started is unknown. It returns the tunnel if the request created
+// it after all, and cause otherwise. Tunnel created before started is not
+// the one requested, so it's left for the user to sort out.
+func findCreatedTunnel(provider aCloudProvider, started time.Time, cause error) (*tunnelInstance, error) {
+	log.Warning("Outcome of tunnel creation is unknown, querying tunnel status")
+	instance, err := provider.TunnelStatus()
+	if err != nil {
+		log.Error("Unable to confirm that tunnel instance was created")
+		return nil, cause
+	}
+	if instance.CreatedAt.Before(started.Add(-createdTunnelClockSkew)) {
+		log.WithFields(log.Fields{
+			"label":      instance.Label,
+			"created_at": instance.CreatedAt,
+		}).Error("Existing tunnel instance was not created by this request, " +
+			"use sync to inspect it")
+		return nil, cause
+	}
+	return instance, nil
+}
+
+// reconcileCreatedTunnel is called when the outcome of tunnel creation is
+// unknown. If the tunnel was created after all, it is recorded in session
+// cache along with bookkeeping state from cache instead of being orphaned.
+func reconcileCreatedTunnel(
+	provider aCloudProvider,
+	options *programOptions,
+	cache *sessionCache,
+	started time.Time,
+	cause error,
+) error {
+	instance, err := findCreatedTunnel(provider, started, cause)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"label": instance.Label,
+		"ipv4":  instance.IPv4,
+		"ipv6":  instance.IPv6,
+	}).Warning("Tunnel instance exists despite the error, adopting it")
+	params := creationParamsFromProgramOptions(options)
+	cache.InstanceInfo = instance
+	cache.CreationParams = &params
+	return saveSessionCache(cache, options)
+}
+
+// reconcileRebuiltTunnel is called when the outcome of tunnel rebuild is
+// unknown. There's no way to tell whether the instance was rebuilt, so
+// session cache is left intact and the error is always returned.
+func reconcileRebuiltTunnel(provider aCloudProvider, cause error) error {
+	log.Warning("Outcome of tunnel rebuild is unknown, querying tunnel status")
+	instance, err := provider.TunnelStatus()
+	if err != nil {
+		log.Error("Unable to query tunnel instance status")
+		return cause
+	}
+
+	log.WithFields(log.Fields{
+		"label": instance.Label,
+		"ipv4":  instance.IPv4,
+		"ipv6":  instance.IPv6,
+	}).Warning("Tunnel instance exists, but it may not have been rebuilt. " +
+		"Rebuild is safe to repeat")
+	return cause
 }
 
 func handleDestroyTunnelCommand(c *cli.Context) error {
@@ -89,107 +250,207 @@ func handleDestroyTunnelCommand(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if err = provider.DestroyTunnel(); err != nil {
+	if options.DryRun {
+		return dryRunResult(provider.DestroyTunnel())
+	}
+	lock, err := lockSessionFromContext(c, options)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	cache, err := restoreSessionCacheIfExists(options)
+	if err != nil {
+		return err
+	}
+	if cache == nil {
+		log.WithField("session", exportSessionName(options)).Warning(
+			"Session has no record of the tunnel, destroying tunnel found by provider")
+	}
+	started := time.Now()
+	err = provider.DestroyTunnel()
+	appendHistory(options, newDestroyHistoryRecord(options, cache, started, time.Now(), err))
+	if err != nil {
 		return err
 	}
 	log.Info("Tunnel instance was successfully deleted")
 
 	// Remove session cache because as of now it is invalid.
-	clearSessionCache(options.Runtime.RuntimeDir)
+	clearSessionCache(options)
 	return nil
 }
 
 func handleShowTunnelInfoCommand(c *cli.Context) error {
-	provider, _, err := newCloudProviderFromContext(c)
+	printer, err := newOutputPrinterFromContext(c)
 	if err != nil {
 		return err
 	}
-	result, err := provider.TunnelStatus()
+	provider, options, err := newCloudProviderFromContext(c)
 	if err != nil {
 		return err
 	}
-
-	prettyPrint(result)
-	return nil
-}
-
-func handlePrintSessionVarCommand(c *cli.Context, sessionVar string) error {
-	options, err := newProgramOptions(c.GlobalString("config"))
+	lock, err := lockSessionForInfo(c, options)
 	if err != nil {
 		return err
 	}
-	session, err := restoreSessionCache(options.Runtime.RuntimeDir)
+	var result *tunnelInstance
+	if lock != nil {
+		defer lock.Release()
+		result, err = provider.TunnelStatus()
+		reconcileSessionForInfo(provider, options, result, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	cache, err := restoreSessionCacheIfExists(options)
 	if err != nil {
 		return err
 	}
+	if lock == nil {
+		if cache == nil {
+			return errSessionLocked
+		}
+		result = cache.InstanceInfo
+	}
+	info := struct {
+		*tunnelInstance
+		Cost *tunnelCost `json:"cost,omitempty"`
+	}{tunnelInstance: result}
+	if cache != nil {
+		info.Cost = sessionCost(cache, time.Now())
+	}
+	return printer.Print(info)
+}
 
+// sessionVarValue returns value of session variable with given name.
+func sessionVarValue(session *sessionCache, sessionVar string) (interface{}, error) {
 	switch sessionVar {
 	case "acct.username":
-		fmt.Println(session.CreationParams.RegularUserName)
+		return session.CreationParams.RegularUserName, nil
 	case "acct.password":
-		fmt.Println(session.CreationParams.RegularUserPassword)
+		return session.CreationParams.RegularUserPassword, nil
 
 	case "ipv4":
-		fmt.Println(strings.Join(session.InstanceInfo.IPv4, "\n"))
+		return session.InstanceInfo.IPv4, nil
 	case "ipv6":
-		fmt.Println(strings.Join(session.InstanceInfo.IPv6, "\n"))
+		return session.InstanceInfo.IPv6, nil
 	case "created":
-		fmt.Println(session.InstanceInfo.CreatedAt.String())
+		return session.InstanceInfo.CreatedAt.String(), nil
 	case "duration":
-		fmt.Println(time.Since(session.InstanceInfo.CreatedAt).String())
+		return time.Since(session.InstanceInfo.CreatedAt).String(), nil
 
 	case "wg.enabled":
-		fmt.Printf("%t\n", session.CreationParams.WireGuardEnabled)
+		return session.CreationParams.WireGuardEnabled, nil
 	case "wg.server_key":
-		fmt.Println(session.CreationParams.WireGuardServerKey)
+		return session.CreationParams.WireGuardServerKey, nil
 	case "wg.peer_keys":
-		fmt.Println(strings.Join(session.CreationParams.WireGuardPeerKeys, "\n"))
+		return session.CreationParams.WireGuardPeerKeys, nil
 	case "wg.port":
-		fmt.Printf("%d\n", session.CreationParams.WireGuardPort)
+		return session.CreationParams.WireGuardPort, nil
 
 	case "obfs4.enabled":
-		fmt.Printf("%t\n", session.CreationParams.ObfsproxyIPv4Enabled)
+		return session.CreationParams.ObfsproxyIPv4Enabled, nil
 	case "obfs4.secret":
-		fmt.Println(session.CreationParams.ObfsproxyIPv4Secret)
+		return session.CreationParams.ObfsproxyIPv4Secret, nil
 	case "obfs4.port":
-		fmt.Printf("%d\n", session.CreationParams.ObfsproxyIPv4Port)
+		return session.CreationParams.ObfsproxyIPv4Port, nil
 
 	case "obfs6.enabled":
-		fmt.Printf("%t\n", session.CreationParams.ObfsproxyIPv6Enabled)
+		return session.CreationParams.ObfsproxyIPv6Enabled, nil
 	case "obfs6.secret":
-		fmt.Println(session.CreationParams.ObfsproxyIPv6Secret)
+		return session.CreationParams.ObfsproxyIPv6Secret, nil
 	case "obfs6.port":
-		fmt.Printf("%d\n", session.CreationParams.ObfsproxyIPv6Port)
+		return session.CreationParams.ObfsproxyIPv6Port, nil
 	}
-	return nil
+	log.WithField("var", sessionVar).Error("Unknown session variable")
+	return nil, errors.New("unknown session variable")
 }
 
-func handleRebuildLinodeTunnel(c *cli.Context) error {
-	// FIXME: creating programOptions twice (here and within doLinodeRPC).
-	options, err := newProgramOptions(c.GlobalString("config"))
+func handlePrintSessionVarCommand(c *cli.Context, sessionVar string) error {
+	printer, err := newOutputPrinterFromContext(c)
 	if err != nil {
 		return err
 	}
-	if err = verifySessionCacheIsWritable(options.Runtime.RuntimeDir); err != nil {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	session, err := restoreSessionCache(options)
+	if err != nil {
+		return err
+	}
+	value, err := sessionVarValue(session, sessionVar)
+	if err != nil {
 		return err
 	}
+	return printer.PrintPlain(value)
+}
 
-	fn := func(p *providerLinode) (interface{}, error) {
-		return p.RebuildTunnel()
+// handleRebuildTunnel rebuilds tunnel with provider of type kind, whatever
+// provider is configured.
+func handleRebuildTunnel(c *cli.Context, kind providerType) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
 	}
-	result, err := doLinodeRPC(c, fn)
+	if err = verifySessionCacheIsWritable(options.Runtime.RuntimeDir); err != nil {
+		return err
+	}
+	client, err := newClientFromOptions(options)
 	if err != nil {
 		return err
 	}
+	var provider interface {
+		aCloudProvider
+		aRebuildableCloudProvider
+	}
+	switch kind {
+	case providerTypeLinode:
+		provider, err = newLinodeProvider(client, options)
+	case providerTypeDigitalOcean:
+		provider, err = newDigitalOceanProvider(client, options)
+	default:
+		return errors.Errorf("rebuild is not supported by %s", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	var previous *sessionCache
+	if !options.DryRun {
+		lock, err := lockSessionFromContext(c, options)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		if previous, err = restoreSessionCacheIfExists(options); err != nil {
+			return err
+		}
+	}
+
+	started := time.Now()
+	info, err := provider.RebuildTunnel()
+	if isAmbiguousRPCError(err) {
+		err = reconcileRebuiltTunnel(provider, err)
+	}
+	if options.DryRun {
+		return dryRunResult(err)
+	} else if err != nil {
+		appendHistory(options, newHistoryRecord(options, historyActionRebuild, previous, started, time.Now(), err))
+		return err
+	}
 
-	info := result.(*rebuildTunnelResult)
 	cache := &sessionCache{
 		InstanceInfo:   &info.Instance,
 		CreationParams: &info.CreationParams,
 	}
-
-	saveSessionCache(cache, options.Runtime.RuntimeDir)
-	return nil
+	inheritSessionState(cache, previous)
+	appendHistory(options, newHistoryRecord(options, historyActionRebuild, cache, started, time.Now(), nil))
+	if err = saveSessionCache(cache, options); err != nil {
+		return err
+	}
+	return waitForTunnelIfRequested(c, provider, cache, options)
 }
 
 func handleListLinodeInstances(c *cli.Context) error {
@@ -200,22 +461,46 @@ func handleListLinodeInstances(c *cli.Context) error {
 }
 
 func handleListLinodePlans(c *cli.Context) error {
+	query, err := linodePlanQueryFromContext(c)
+	if err != nil {
+		return err
+	}
 	fn := func(p *providerLinode) (interface{}, error) {
-		return p.ListPlans()
+		plans, err := p.ListPlans()
+		if err != nil {
+			return nil, err
+		}
+		return query.Apply(plans), nil
 	}
 	return printLinodeResult(c, fn)
 }
 
 func handleListLinodeRegions(c *cli.Context) error {
+	query, err := linodeRegionQueryFromContext(c)
+	if err != nil {
+		return err
+	}
 	fn := func(p *providerLinode) (interface{}, error) {
-		return p.ListRegions()
+		regions, err := p.ListRegions()
+		if err != nil {
+			return nil, err
+		}
+		return query.Apply(regions), nil
 	}
 	return printLinodeResult(c, fn)
 }
 
 func handleListLinodeImages(c *cli.Context) error {
+	query, err := linodeImageQueryFromContext(c)
+	if err != nil {
+		return err
+	}
 	fn := func(p *providerLinode) (interface{}, error) {
-		return p.ListImages()
+		images, err := p.ListImages()
+		if err != nil {
+			return nil, err
+		}
+		return query.Apply(images), nil
 	}
 	return printLinodeResult(c, fn)
 }
@@ -227,6 +512,157 @@ func handleListLinodeStackScripts(c *cli.Context) error {
 	return printLinodeResult(c, fn)
 }
 
+func handleListDigitalOceanDroplets(c *cli.Context) error {
+	fn := func(p *providerDigitalOcean) (interface{}, error) {
+		return p.ListDroplets()
+	}
+	return printDigitalOceanResult(c, fn)
+}
+
+func handleListDigitalOceanSizes(c *cli.Context) error {
+	fn := func(p *providerDigitalOcean) (interface{}, error) {
+		return p.ListSizes()
+	}
+	return printDigitalOceanResult(c, fn)
+}
+
+func handleListDigitalOceanRegions(c *cli.Context) error {
+	fn := func(p *providerDigitalOcean) (interface{}, error) {
+		return p.ListRegions()
+	}
+	return printDigitalOceanResult(c, fn)
+}
+
+func handleListDigitalOceanImages(c *cli.Context) error {
+	fn := func(p *providerDigitalOcean) (interface{}, error) {
+		return p.ListImages()
+	}
+	return printDigitalOceanResult(c, fn)
+}
+
+// sessionOptions returns copy of options with another session selected.
+func sessionOptions(options *programOptions, session string) (*programOptions, error) {
+	if err := validateSessionName(session); err != nil {
+		return nil, err
+	}
+	copied := *options
+	copied.Session = session
+	return &copied, nil
+}
+
+func handleListSessionsCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	options, err := newSessionlessProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	names, err := listSessions(options.Runtime.RuntimeDir)
+	if err != nil {
+		return err
+	}
+
+	summaries := []*sessionSummary{}
+	for _, name := range names {
+		named, err := sessionOptions(options, name)
+		if err != nil {
+			return err
+		}
+		cache, err := restoreSessionCache(named)
+		if err != nil {
+			log.WithField("session", name).Warning("Session cache is unreadable")
+			summaries = append(summaries, &sessionSummary{Name: name, Error: err.Error()})
+			continue
+		}
+		summaries = append(summaries, &sessionSummary{
+			Name:      name,
+			Provider:  cache.InstanceInfo.Provider.String(),
+			Label:     cache.InstanceInfo.Label,
+			IPv4:      cache.InstanceInfo.IPv4,
+			IPv6:      cache.InstanceInfo.IPv6,
+			CreatedAt: cache.InstanceInfo.CreatedAt,
+		})
+	}
+	return printer.Print(summaries)
+}
+
+func handleShowSessionCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() > 0 {
+		if options, err = sessionOptions(options, c.Args().First()); err != nil {
+			return err
+		}
+	}
+	cache, err := restoreSessionCache(options)
+	if err != nil {
+		return err
+	}
+	return printer.Print(cache)
+}
+
+func handleRemoveSessionCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		log.Error("Expected exactly one session name")
+		return errors.New("missing session name")
+	}
+	options, err := newSessionlessProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	if options, err = sessionOptions(options, c.Args().First()); err != nil {
+		return err
+	}
+	// Session cache may be unreadable, so the lock is taken without checking
+	// its profile.
+	lock, err := acquireSessionLock(options, c.GlobalDuration("wait-lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	filename := sessionCacheFilename(options.Runtime.RuntimeDir, options.Session)
+	if _, err = os.Stat(filename); err != nil {
+		log.WithFields(log.Fields{
+			"cause":   err,
+			"session": options.Session,
+		}).Error("Session does not exist")
+		return err
+	}
+	if err = clearSessionCache(options); err != nil {
+		return err
+	}
+	log.WithField("session", options.Session).Warning(
+		"Session was removed, but its tunnel instance (if any) was not destroyed")
+	return nil
+}
+
+func handleMockServerCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	server, err := newMockServer(options, "")
+	if err != nil {
+		return err
+	}
+
+	log.WithField("address", c.String("listen")).Info("Mock server is listening")
+	if err = http.ListenAndServe(c.String("listen"), server); err != nil {
+		log.WithField("cause", err).Error("Mock server failed")
+		return err
+	}
+	return nil
+}
+
 func initApp(c *cli.Context) error {
 	if c.Bool("verbose") {
 		log.SetLevel(log.DebugLevel)
@@ -250,6 +686,20 @@ func main() {
 			Name:  "verbose, v",
 			Usage: "verbose mode",
 		},
+		cli.StringFlag{
+			Name:   "session, s",
+			Usage:  "name of tunnel session (and profile) to operate on",
+			EnvVar: "HOLEPUNCHER_SESSION",
+		},
+		cli.StringFlag{
+			Name:   "output",
+			Usage:  "print data as json, yaml, table, csv or template=`TEMPLATE` (Go text/template)",
+			EnvVar: "HOLEPUNCHER_OUTPUT",
+		},
+		cli.DurationFlag{
+			Name:  "wait-lock",
+			Usage: "wait up to `DURATION` for another operation on the session to finish",
+		},
 	}
 	app.Before = initApp
 	app.HideVersion = true
@@ -258,11 +708,16 @@ func main() {
 			Name:   "create",
 			Usage:  "create tunnel",
 			Action: handleCreateTunnelCommand,
+			Flags: append(waitFlags(), dryRunFlag, cli.DurationFlag{
+				Name:  "ttl",
+				Usage: "destroy tunnel with watch command after `DURATION`",
+			}),
 		},
 		{
 			Name:   "destroy",
 			Usage:  "destroy tunnel",
 			Action: handleDestroyTunnelCommand,
+			Flags:  []cli.Flag{dryRunFlag},
 		},
 		{
 			Name:   "info",
@@ -274,9 +729,12 @@ func main() {
 			Usage: "linode-specific actions",
 			Subcommands: []cli.Command{
 				{
-					Name:   "rebuild",
-					Usage:  "rebuilds tunnel",
-					Action: handleRebuildLinodeTunnel,
+					Name:  "rebuild",
+					Usage: "rebuilds tunnel",
+					Flags: append(waitFlags(), dryRunFlag),
+					Action: func(c *cli.Context) error {
+						return handleRebuildTunnel(c, providerTypeLinode)
+					},
 				},
 				{
 					Name:   "instances",
@@ -287,16 +745,19 @@ func main() {
 					Name:   "plans",
 					Usage:  "list available instance types",
 					Action: handleListLinodePlans,
+					Flags:  linodePlansFlags(),
 				},
 				{
 					Name:   "regions",
 					Usage:  "list available regions",
 					Action: handleListLinodeRegions,
+					Flags:  linodeRegionsFlags(),
 				},
 				{
 					Name:   "images",
 					Usage:  "list available images",
 					Action: handleListLinodeImages,
+					Flags:  linodeImagesFlags(),
 				},
 				{
 					Name:   "stackscripts",
@@ -305,6 +766,87 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "digitalocean",
+			Usage: "digitalocean-specific actions",
+			Subcommands: []cli.Command{
+				{
+					Name:  "rebuild",
+					Usage: "rebuilds tunnel",
+					Flags: append(waitFlags(), dryRunFlag),
+					Action: func(c *cli.Context) error {
+						return handleRebuildTunnel(c, providerTypeDigitalOcean)
+					},
+				},
+				{
+					Name:   "droplets",
+					Usage:  "list currently active droplets",
+					Action: handleListDigitalOceanDroplets,
+				},
+				{
+					Name:   "sizes",
+					Usage:  "list available droplet sizes",
+					Action: handleListDigitalOceanSizes,
+				},
+				{
+					Name:   "regions",
+					Usage:  "list available regions",
+					Action: handleListDigitalOceanRegions,
+				},
+				{
+					Name:   "images",
+					Usage:  "list available images",
+					Action: handleListDigitalOceanImages,
+				},
+			},
+		},
+		{
+			Name:  "sessions",
+			Usage: "manage tunnel sessions",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list sessions",
+					Action: handleListSessionsCommand,
+				},
+				{
+					Name:      "show",
+					Usage:     "show session cache",
+					ArgsUsage: "[name]",
+					Action:    handleShowSessionCommand,
+				},
+				{
+					Name:      "remove",
+					Usage:     "forget session without destroying its tunnel",
+					ArgsUsage: "name",
+					Action:    handleRemoveSessionCommand,
+				},
+			},
+		},
+		keygenCommand(),
+		exportCommand(),
+		watchCommand(),
+		rotateCommand(),
+		costCommand(),
+		syncCommand(),
+		historyCommand(),
+		{
+			Name:   "touch",
+			Usage:  "mark tunnel as being in use, postponing idle shutdown by watch command",
+			Action: handleTouchSessionCommand,
+		},
+		{
+			Name:   "mock-server",
+			Usage:  "run local Holepuncher server stand-in for testing",
+			Action: handleMockServerCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen, l",
+					Usage: "address to listen on",
+					Value: "127.0.0.1:9000",
+				},
+			},
+		},
 		{
 			Name:  "var",
 			Usage: "print variable from current session",
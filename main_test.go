@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCloudProvider returns canned results and counts calls.
+type fakeCloudProvider struct {
+	createResult *createTunnelResult
+	createErr    error
+	status       *tunnelInstance
+	statusErr    error
+	destroyErr   error
+
+	createCalls  int
+	statusCalls  int
+	destroyCalls int
+}
+
+func (p *fakeCloudProvider) CreateTunnel() (*createTunnelResult, error) {
+	p.createCalls++
+	return p.createResult, p.createErr
+}
+
+func (p *fakeCloudProvider) TunnelStatus() (*tunnelInstance, error) {
+	p.statusCalls++
+	return p.status, p.statusErr
+}
+
+func (p *fakeCloudProvider) DestroyTunnel() error {
+	p.destroyCalls++
+	return p.destroyErr
+}
+
+func TestReconcileCreatedTunnelAdoptsInstance(t *testing.T) {
+	options := validTestOptions()
+	options.Runtime.RuntimeDir = tempRuntimeDir(t)
+	instance := testSessionCache().InstanceInfo
+	provider := &fakeCloudProvider{status: instance}
+	// Server clock may be slightly behind.
+	started := instance.CreatedAt.Add(time.Minute)
+
+	cause := &transportError{cause: errors.New("timeout")}
+	require.NoError(t, reconcileCreatedTunnel(provider, options, &sessionCache{}, started, cause))
+
+	cache, err := restoreSessionCache(options)
+	require.NoError(t, err)
+	assert.Equal(t, instance, cache.InstanceInfo)
+	assert.Equal(t, creationParamsFromProgramOptions(options), *cache.CreationParams)
+}
+
+func TestReconcileCreatedTunnelMissingInstance(t *testing.T) {
+	options := validTestOptions()
+	options.Runtime.RuntimeDir = tempRuntimeDir(t)
+	provider := &fakeCloudProvider{statusErr: errors.New("rpc method returned an error")}
+
+	cause := &transportError{cause: errors.New("timeout")}
+	assert.Equal(t, cause, reconcileCreatedTunnel(provider, options, &sessionCache{}, time.Now(), cause))
+	_, err := restoreSessionCache(options)
+	assert.Error(t, err, "nothing must be saved")
+}
+
+func TestReconcileCreatedTunnelRejectsOlderInstance(t *testing.T) {
+	options := validTestOptions()
+	options.Runtime.RuntimeDir = tempRuntimeDir(t)
+	instance := testSessionCache().InstanceInfo
+	provider := &fakeCloudProvider{status: instance}
+	started := instance.CreatedAt.Add(time.Hour)
+
+	cause := &transportError{cause: errors.New("timeout")}
+	assert.Equal(t, cause, reconcileCreatedTunnel(provider, options, &sessionCache{}, started, cause))
+	_, err := restoreSessionCache(options)
+	assert.Error(t, err, "tunnel created earlier must not be adopted")
+}
+
+func TestReconcileRebuiltTunnelKeepsError(t *testing.T) {
+	provider := &fakeCloudProvider{status: testSessionCache().InstanceInfo}
+	cause := &transportError{cause: errors.New("timeout")}
+	assert.Equal(t, cause, reconcileRebuiltTunnel(provider, cause))
+	assert.Equal(t, 1, provider.statusCalls)
+}
+
+func TestSessionVarValue(t *testing.T) {
+	value, err := sessionVarValue(testSessionCache(), "ipv4")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, value)
+
+	_, err = sessionVarValue(testSessionCache(), "ipv5")
+	assert.Error(t, err)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"protoapi"
+	"protocore"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mockServer is a local stand-in for Holepuncher server. It speaks the same
+// protocol (both GET /proto/<payload> and POST /proto) and keeps track of
+// a single tunnel per provider, answering every RPC with canned data.
+type mockServer struct {
+	mu    sync.Mutex
+	proto *protocore.Proto
+
+	// Names of RPCs (e.g. "LinodeCreateTunnel") that respond with a provider
+	// error object or with text/plain HTTP 500 respectively.
+	fail     map[string]bool
+	failHTTP map[string]bool
+
+	// Responses by Idempotency-Key, so that retries of an RPC are answered
+	// without executing it again.
+	responses map[string]*protoapi.Response
+
+	// When non-empty, state is loaded before and saved after each request,
+	// so that separate program invocations observe the same tunnel.
+	stateFile string
+	state     mockServerState
+}
+
+type mockServerState struct {
+	Linode       *protoapi.LinodeInstance      `json:"linode,omitempty"`
+	DigitalOcean *protoapi.DigitalOceanDroplet `json:"digitalocean,omitempty"`
+	Sequence     int64                         `json:"sequence"`
+}
+
+func newMockServer(options *programOptions, stateFile string) (*mockServer, error) {
+	srvKey, err := decodeProtobufKey(options.ProtobufClient.ServerKey, "client_protobuf.server_key")
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := decodeProtobufKey(options.ProtobufClient.PeerKey, "client_protobuf.peer_key")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &mockServer{
+		proto:     protocore.NewProto(srvKey, peerKey),
+		fail:      map[string]bool{},
+		failHTTP:  map[string]bool{},
+		responses: map[string]*protoapi.Response{},
+		stateFile: stateFile,
+	}
+	for _, name := range options.MockParams.Fail {
+		server.fail[name] = true
+	}
+	for _, name := range options.MockParams.FailHTTP {
+		server.failHTTP[name] = true
+	}
+	return server, nil
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var payload []byte
+	var err error
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/proto/"):
+		payload, err = base64.RawStdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/proto/"))
+		if err != nil {
+			s.writeTextError(w, http.StatusBadRequest, "malformed payload encoding")
+			return
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/proto":
+		payload, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.writeTextError(w, http.StatusBadRequest, "unable to read request body")
+			return
+		}
+	default:
+		s.writeTextError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	request := &protoapi.Request{}
+	if err = s.proto.ReadMessage(request, payload); err != nil {
+		s.writeTextError(w, http.StatusBadRequest, "unable to decode request")
+		return
+	}
+
+	rpcName := s.rpcName(request)
+	requestID := r.Header.Get(requestIDHeader)
+	if response, ok := s.responses[requestID]; ok && len(requestID) > 0 {
+		log.WithField("rpc", rpcName).Debug("Mock server received retry of RPC")
+		s.writeResponse(w, response)
+		return
+	}
+
+	if err = s.loadState(); err != nil {
+		s.writeTextError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.WithField("rpc", rpcName).Debug("Mock server received RPC")
+	if s.failHTTP[rpcName] {
+		s.writeTextError(w, http.StatusInternalServerError, "scripted failure of "+rpcName)
+		return
+	}
+
+	response := s.handleRequest(request, rpcName)
+	if response == nil {
+		s.writeTextError(w, http.StatusBadRequest, "unsupported request")
+		return
+	}
+
+	if err = s.saveState(); err != nil {
+		s.writeTextError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(requestID) > 0 {
+		s.responses[requestID] = response
+	}
+	s.writeResponse(w, response)
+}
+
+func (s *mockServer) writeResponse(w http.ResponseWriter, response *protoapi.Response) {
+	var body bytes.Buffer
+	if err := s.proto.WriteMessage(&body, response); err != nil {
+		s.writeTextError(w, http.StatusInternalServerError, "unable to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body.Bytes())
+}
+
+func (s *mockServer) handleRequest(m *protoapi.Request, rpcName string) *protoapi.Response {
+	failed := s.fail[rpcName]
+
+	switch r := m.R.(type) {
+	case *protoapi.Request_LinodeCreateTunnel:
+		result := &protoapi.LinodeCreateTunnelResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else if s.state.Linode != nil {
+			result.Error = s.linodeError("tunnel instance already exists")
+		} else {
+			s.state.Linode = s.newLinodeInstance(r.LinodeCreateTunnel.Region,
+				r.LinodeCreateTunnel.Plan)
+			result.Instance = s.state.Linode
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeCreateTunnelResult{LinodeCreateTunnelResult: result},
+		}
+
+	case *protoapi.Request_LinodeRebuildTunnel:
+		result := &protoapi.LinodeRebuildTunnelResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else if s.state.Linode == nil {
+			result.Error = s.linodeError("tunnel instance does not exist")
+		} else {
+			s.state.Linode.UpdatedAt = s.now()
+			result.Instance = s.state.Linode
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeRebuildTunnelResult{LinodeRebuildTunnelResult: result},
+		}
+
+	case *protoapi.Request_LinodeDestroyTunnel:
+		result := &protoapi.LinodeDestroyTunnelResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else if s.state.Linode == nil {
+			result.Error = s.linodeError("tunnel instance does not exist")
+		} else {
+			s.state.Linode = nil
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeDestroyTunnelResult{LinodeDestroyTunnelResult: result},
+		}
+
+	case *protoapi.Request_LinodeTunnelStatus:
+		result := &protoapi.LinodeGetTunnelStatusResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else if s.state.Linode == nil {
+			result.Error = s.linodeError("tunnel instance does not exist")
+		} else {
+			result.Instance = s.state.Linode
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeTunnelStatusResult{LinodeTunnelStatusResult: result},
+		}
+
+	case *protoapi.Request_LinodeListInstances:
+		result := &protoapi.LinodeListInstancesResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else {
+			result.Instances = &protoapi.LinodeInstanceList{}
+			if s.state.Linode != nil {
+				result.Instances.L = []*protoapi.LinodeInstance{s.state.Linode}
+			}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeListInstancesResult{LinodeListInstancesResult: result},
+		}
+
+	case *protoapi.Request_LinodeListPlans:
+		result := &protoapi.LinodeListPlansResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else {
+			result.Plans = &protoapi.LinodePlanList{L: []*protoapi.LinodePlan{
+				{Id: "g6-nanode-1", Label: "Nanode 1GB", Class: "nanode", PriceHourly: 0.0075,
+					PriceMonthly: 5, Memory: 1024, NetworkOut: 1000, Transfer: 1000, Vcpus: 1},
+				{Id: "g6-standard-1", Label: "Linode 2GB", Class: "standard", PriceHourly: 0.015,
+					PriceMonthly: 10, Memory: 2048, NetworkOut: 2000, Transfer: 2000, Vcpus: 1},
+				{Id: "g6-standard-2", Label: "Linode 4GB", Class: "standard", PriceHourly: 0.03,
+					PriceMonthly: 20, Memory: 4096, NetworkOut: 4000, Transfer: 4000, Vcpus: 2},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeListPlansResult{LinodeListPlansResult: result},
+		}
+
+	case *protoapi.Request_LinodeListRegions:
+		result := &protoapi.LinodeListRegionsResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else {
+			result.Regions = &protoapi.LinodeRegionList{L: []*protoapi.LinodeRegion{
+				{Id: "eu-central", Country: "de"},
+				{Id: "eu-west", Country: "uk"},
+				{Id: "us-east", Country: "us"},
+				{Id: "ap-northeast", Country: "jp"},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeListRegionsResult{LinodeListRegionsResult: result},
+		}
+
+	case *protoapi.Request_LinodeListImages:
+		result := &protoapi.LinodeListImagesResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else {
+			result.Images = &protoapi.LinodeImageList{L: []*protoapi.LinodeImage{
+				{Id: "linode/debian9", Label: "Debian 9", Size: 1500, CreatedBy: "linode",
+					CreatedAt: "2017-06-16T20:02:29", Vendor: "Debian"},
+				{Id: "linode/ubuntu18.04", Label: "Ubuntu 18.04 LTS", Size: 2500, CreatedBy: "linode",
+					CreatedAt: "2018-04-26T19:29:36", Vendor: "Ubuntu"},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeListImagesResult{LinodeListImagesResult: result},
+		}
+
+	case *protoapi.Request_LinodeListStackscripts:
+		result := &protoapi.LinodeListStackScriptsResponse{}
+		if failed {
+			result.Error = s.linodeError("scripted failure")
+		} else {
+			result.Stackscripts = &protoapi.LinodeStackScriptList{L: []*protoapi.LinodeStackScript{
+				{Id: 1, Label: "holepuncher", Description: "Holepuncher tunnel setup",
+					Body: "#!/bin/sh\ntrue\n"},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_LinodeListStackscriptsResult{LinodeListStackscriptsResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanCreateTunnel:
+		result := &protoapi.DigitalOceanCreateTunnelResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else if s.state.DigitalOcean != nil {
+			result.Error = s.digitalOceanError("tunnel droplet already exists")
+		} else {
+			s.state.DigitalOcean = s.newDigitalOceanDroplet(r.DigitalOceanCreateTunnel.Region,
+				r.DigitalOceanCreateTunnel.Size)
+			result.Droplet = s.state.DigitalOcean
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanCreateTunnelResult{DigitalOceanCreateTunnelResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanRebuildTunnel:
+		result := &protoapi.DigitalOceanRebuildTunnelResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else if s.state.DigitalOcean == nil {
+			result.Error = s.digitalOceanNotFound("tunnel droplet does not exist")
+		} else {
+			result.Droplet = s.state.DigitalOcean
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanRebuildTunnelResult{DigitalOceanRebuildTunnelResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanDestroyTunnel:
+		result := &protoapi.DigitalOceanDestroyTunnelResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else if s.state.DigitalOcean == nil {
+			result.Error = s.digitalOceanNotFound("tunnel droplet does not exist")
+		} else {
+			s.state.DigitalOcean = nil
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanDestroyTunnelResult{DigitalOceanDestroyTunnelResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanTunnelStatus:
+		result := &protoapi.DigitalOceanGetTunnelStatusResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else if s.state.DigitalOcean == nil {
+			result.Error = s.digitalOceanNotFound("tunnel droplet does not exist")
+		} else {
+			result.Droplet = s.state.DigitalOcean
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanTunnelStatusResult{DigitalOceanTunnelStatusResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanListDroplets:
+		result := &protoapi.DigitalOceanListDropletsResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else {
+			result.Droplets = &protoapi.DigitalOceanDropletList{}
+			if s.state.DigitalOcean != nil {
+				result.Droplets.L = []*protoapi.DigitalOceanDroplet{s.state.DigitalOcean}
+			}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanListDropletsResult{DigitalOceanListDropletsResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanListSizes:
+		result := &protoapi.DigitalOceanListSizesResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else {
+			result.Sizes = &protoapi.DigitalOceanSizeList{L: []*protoapi.DigitalOceanSize{
+				{Slug: "s-1vcpu-1gb", PriceHourly: 0.00744, PriceMonthly: 5, Memory: 1024,
+					Vcpus: 1, Disk: 25, Transfer: 1, Regions: []string{"ams3", "fra1"}, Available: true},
+				{Slug: "s-1vcpu-2gb", PriceHourly: 0.01488, PriceMonthly: 10, Memory: 2048,
+					Vcpus: 1, Disk: 50, Transfer: 2, Regions: []string{"ams3", "fra1"}, Available: true},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanListSizesResult{DigitalOceanListSizesResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanListRegions:
+		result := &protoapi.DigitalOceanListRegionsResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else {
+			result.Regions = &protoapi.DigitalOceanRegionList{L: []*protoapi.DigitalOceanRegion{
+				{Slug: "ams3", Name: "Amsterdam 3", Available: true,
+					Sizes: []string{"s-1vcpu-1gb", "s-1vcpu-2gb"}},
+				{Slug: "fra1", Name: "Frankfurt 1", Available: true,
+					Sizes: []string{"s-1vcpu-1gb", "s-1vcpu-2gb"}},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanListRegionsResult{DigitalOceanListRegionsResult: result},
+		}
+
+	case *protoapi.Request_DigitalOceanListImages:
+		result := &protoapi.DigitalOceanListImagesResponse{}
+		if failed {
+			result.Error = s.digitalOceanError("scripted failure")
+		} else {
+			result.Images = &protoapi.DigitalOceanImageList{L: []*protoapi.DigitalOceanImage{
+				{Id: 1, Name: "9.4 x64", Distribution: "Debian", Slug: "debian-9-x64",
+					MinDiskSize: 20, Regions: []string{"ams3", "fra1"},
+					CreatedAt: "2018-03-13T17:30:12Z"},
+			}}
+		}
+		return &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanListImagesResult{DigitalOceanListImagesResult: result},
+		}
+	}
+	return nil
+}
+
+func (s *mockServer) newLinodeInstance(region, plan string) *protoapi.LinodeInstance {
+	s.state.Sequence++
+	n := s.state.Sequence
+	return &protoapi.LinodeInstance{
+		Id:        n,
+		Label:     fmt.Sprintf("holepuncher-mock-%d", n),
+		Region:    region,
+		Plan:      plan,
+		Image:     "linode/debian9",
+		Ipv4:      []string{fmt.Sprintf("192.0.2.%d", n%254+1)},
+		Ipv6:      []string{fmt.Sprintf("2001:db8::%x", n)},
+		CreatedAt: s.now(),
+		UpdatedAt: s.now(),
+		Memory:    1024,
+		Disk:      25600,
+		Transfer:  1000,
+		Vcpus:     1,
+	}
+}
+
+func (s *mockServer) newDigitalOceanDroplet(region, size string) *protoapi.DigitalOceanDroplet {
+	s.state.Sequence++
+	n := s.state.Sequence
+	return &protoapi.DigitalOceanDroplet{
+		Id:        n,
+		Name:      fmt.Sprintf("holepuncher-mock-%d", n),
+		Region:    region,
+		Size:      size,
+		Image:     "debian-9-x64",
+		Status:    "active",
+		Ipv4:      []string{fmt.Sprintf("198.51.100.%d", n%254+1)},
+		Ipv6:      []string{fmt.Sprintf("2001:db8:1::%x", n)},
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Memory:    1024,
+		Disk:      25,
+		Vcpus:     1,
+	}
+}
+
+func (s *mockServer) linodeError(message string) *protoapi.LinodeError {
+	return &protoapi.LinodeError{
+		Error: &protoapi.Error{Message: message},
+	}
+}
+
+func (s *mockServer) digitalOceanError(message string) *protoapi.DigitalOceanError {
+	return &protoapi.DigitalOceanError{
+		Error: &protoapi.Error{Message: message},
+		Id:    "mock_error",
+	}
+}
+
+// digitalOceanNotFound is the error DigitalOcean API reports for missing
+// droplets.
+func (s *mockServer) digitalOceanNotFound(message string) *protoapi.DigitalOceanError {
+	return &protoapi.DigitalOceanError{
+		Error: &protoapi.Error{Message: message},
+		Id:    "not_found",
+	}
+}
+
+// now returns current time in the format used by Linode API.
+func (s *mockServer) now() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05")
+}
+
+func (s *mockServer) rpcName(m *protoapi.Request) string {
+	if msgType := reflect.TypeOf(m.R); msgType != nil && msgType.Kind() == reflect.Ptr {
+		return strings.TrimPrefix(msgType.Elem().Name(), "Request_")
+	}
+	return "nil"
+}
+
+func (s *mockServer) writeTextError(w http.ResponseWriter, status int, cause string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, cause)
+}
+
+func (s *mockServer) loadState() error {
+	if len(s.stateFile) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		s.state = mockServerState{}
+		return nil
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"cause":    err,
+			"filename": s.stateFile,
+		}).Error("Error reading mock server state")
+		return err
+	}
+	s.state = mockServerState{}
+	if err = json.Unmarshal(data, &s.state); err != nil {
+		log.WithFields(log.Fields{
+			"cause":    err,
+			"filename": s.stateFile,
+		}).Error("Error parsing mock server state")
+		return err
+	}
+	return nil
+}
+
+func (s *mockServer) saveState() error {
+	if len(s.stateFile) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(&s.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(s.stateFile, data, 0644); err != nil {
+		log.WithFields(log.Fields{
+			"cause":    err,
+			"filename": s.stateFile,
+		}).Error("Error saving mock server state")
+		return err
+	}
+	return nil
+}
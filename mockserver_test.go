@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockServerReplaysRetriedRPC(t *testing.T) {
+	o := testMockOptions(t, providerTypeLinode.String())
+	client, _ := newTestMockClient(t, o)
+	provider, err := newLinodeProvider(client, o)
+	require.NoError(t, err)
+	request := provider.createCreateTunnelRequest()
+	var payload bytes.Buffer
+	require.NoError(t, client.proto.WriteMessage(&payload, request))
+
+	// Returns label of created instance and error message.
+	attempt := func(requestID string) (string, string) {
+		response, err := client.doAttempt(request, payload.Bytes(), requestID)
+		require.NoError(t, err)
+		result := response.GetLinodeCreateTunnelResult()
+		return result.GetInstance().GetLabel(), result.GetError().GetError().GetMessage()
+	}
+
+	label, cause := attempt("create-1")
+	assert.Equal(t, "holepuncher-mock-1", label)
+	assert.Empty(t, cause)
+	label, cause = attempt("create-1")
+	assert.Equal(t, "holepuncher-mock-1", label, "retry must not create another tunnel")
+	assert.Empty(t, cause)
+	_, cause = attempt("create-2")
+	assert.Equal(t, "tunnel instance already exists", cause)
+}
+
+func TestMockServerFailHTTPRetries(t *testing.T) {
+	o := testMockOptions(t, providerTypeLinode.String())
+	o.MockParams.FailHTTP = []string{"LinodeTunnelStatus"}
+	provider, delays := newTestMockProvider(t, o)
+
+	_, err := provider.TunnelStatus()
+	require.Error(t, err)
+	assert.False(t, isTunnelNotFoundError(err))
+	assert.Equal(t, []time.Duration{defaultRPCBackoff, 2 * defaultRPCBackoff}, *delays)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	outputFormatJSON  = "json"
+	outputFormatYAML  = "yaml"
+	outputFormatTable = "table"
+	outputFormatCSV   = "csv"
+	// Template is given inline, e.g. template={{range .}}{{.id}}{{end}}.
+	outputTemplatePrefix = "template="
+)
+
+// defaultTableColumns lists columns shown in table and CSV output. Types not
+// listed here show all their fields.
+var defaultTableColumns = map[reflect.Type][]string{
+	reflect.TypeOf(linodePlan{}): {
+		"id", "class", "vcpus", "memory", "transfer", "price_hourly", "price_monthly",
+	},
+	reflect.TypeOf(linodeInstance{}): {
+		"id", "label", "Region", "Plan", "Status", "IPv4", "CreatedAt",
+	},
+	reflect.TypeOf(linodeRegion{}):      {"id", "country"},
+	reflect.TypeOf(linodeImage{}):       {"id", "label", "vendor", "size", "created_at"},
+	reflect.TypeOf(linodeStackScript{}): {"id", "label", "description"},
+	reflect.TypeOf(digitalOceanDroplet{}): {
+		"id", "name", "region", "size", "status", "created_at",
+	},
+	reflect.TypeOf(digitalOceanSize{}): {
+		"slug", "vcpus", "memory", "disk", "price_hourly", "price_monthly", "available",
+	},
+	reflect.TypeOf(digitalOceanRegion{}): {"slug", "name", "available"},
+	reflect.TypeOf(digitalOceanImage{}):  {"id", "slug", "distribution", "name", "min_disk_size"},
+	reflect.TypeOf(historyRecord{}): {
+		"time", "action", "session", "provider", "region", "plan", "label", "ipv4", "lifetime", "outcome",
+	},
+}
+
+// outputPrinter prints command results in format selected with --output.
+// Field names in templates and table columns are the same as in JSON output.
+type outputPrinter struct {
+	// Empty format means the command's default, which is JSON for
+	// structured data.
+	format   string
+	template *template.Template
+	out      io.Writer
+}
+
+func newOutputPrinter(spec string, out io.Writer) (*outputPrinter, error) {
+	p := &outputPrinter{format: spec, out: out}
+	switch {
+	case spec == "", spec == outputFormatJSON, spec == outputFormatYAML,
+		spec == outputFormatTable, spec == outputFormatCSV:
+		return p, nil
+	case strings.HasPrefix(spec, outputTemplatePrefix):
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(spec, outputTemplatePrefix))
+		if err != nil {
+			log.WithField("cause", err).Error("Unable to parse output template")
+			return nil, err
+		}
+		p.format = outputTemplatePrefix
+		p.template = tmpl
+		return p, nil
+	default:
+		log.WithField("output", spec).Error("Unknown output format")
+		return nil, errors.New("unknown output format")
+	}
+}
+
+func newOutputPrinterFromContext(c *cli.Context) (*outputPrinter, error) {
+	return newOutputPrinter(c.GlobalString("output"), os.Stdout)
+}
+
+// Print prints v in the selected format.
+func (p *outputPrinter) Print(v interface{}) error {
+	if p.format == "" || p.format == outputFormatJSON {
+		encoder := json.NewEncoder(p.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	generic, err := genericValue(v)
+	if err != nil {
+		return err
+	}
+	switch p.format {
+	case outputFormatYAML:
+		data, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = p.out.Write(data)
+		return err
+	case outputFormatTable, outputFormatCSV:
+		return p.printRows(outputColumns(v), generic)
+	default:
+		buf := &bytes.Buffer{}
+		if err = p.template.Execute(buf, generic); err != nil {
+			log.WithField("cause", err).Error("Unable to execute output template")
+			return err
+		}
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		_, err = p.out.Write(buf.Bytes())
+		return err
+	}
+}
+
+// PrintPlain prints scalars and lists of scalars one value per line unless
+// another format was requested explicitly.
+func (p *outputPrinter) PrintPlain(v interface{}) error {
+	if p.format != "" {
+		return p.Print(v)
+	}
+	if list, ok := v.([]string); ok {
+		_, err := fmt.Fprintln(p.out, strings.Join(list, "\n"))
+		return err
+	}
+	_, err := fmt.Fprintln(p.out, v)
+	return err
+}
+
+// genericValue converts v to the same maps and slices JSON output is made
+// of, so that all formats use JSON field names.
+func genericValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// outputColumns returns columns of v, or of its elements if v is a slice.
+// Nil is returned for values that are not structs.
+func outputColumns(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	if columns, ok := defaultTableColumns[t]; ok {
+		return columns
+	}
+	return jsonFieldNames(t)
+}
+
+// jsonFieldNames returns names of fields of struct type t as they appear in
+// JSON, including fields of embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && len(name) == 0 && fieldType.Kind() == reflect.Struct {
+			names = append(names, jsonFieldNames(fieldType)...)
+			continue
+		}
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// printRows prints generic value as table or CSV. A single object is printed
+// as a field/value table.
+func (p *outputPrinter) printRows(columns []string, generic interface{}) error {
+	items, isList := generic.([]interface{})
+	if !isList {
+		items = []interface{}{generic}
+	}
+
+	header := columns
+	rows := [][]string{}
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok || columns == nil {
+			header = nil
+			rows = append(rows, []string{formatCell(item)})
+			continue
+		}
+		row := []string{}
+		for _, column := range columns {
+			row = append(row, formatCell(object[column]))
+		}
+		rows = append(rows, row)
+	}
+
+	if p.format == outputFormatCSV {
+		w := csv.NewWriter(p.out)
+		if header != nil {
+			w.Write(header)
+		}
+		w.WriteAll(rows)
+		return w.Error()
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	if header != nil && !isList && len(rows) == 1 {
+		for i, column := range header {
+			fmt.Fprintf(w, "%s\t%s\n", strings.ToUpper(column), rows[0][i])
+		}
+		return w.Flush()
+	}
+	if header != nil {
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func formatCell(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []interface{}:
+		cells := []string{}
+		for _, item := range value {
+			cells = append(cells, formatCell(item))
+		}
+		return strings.Join(cells, ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(value)
+		return string(data)
+	default:
+		return fmt.Sprint(value)
+	}
+}
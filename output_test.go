@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLinodePlans() []*linodePlan {
+	return []*linodePlan{
+		{ID: "g6-nanode-1", Class: "nanode", Vcpus: 1, Memory: 1024, Transfer: 1000,
+			PriceHourly: 0.0075, PriceMonthly: 5},
+		{ID: "g6-standard-2", Class: "standard", Vcpus: 2, Memory: 4096, Transfer: 4000,
+			PriceHourly: 0.03, PriceMonthly: 20},
+	}
+}
+
+func printOutput(t *testing.T, spec string, v interface{}) string {
+	out := &bytes.Buffer{}
+	printer, err := newOutputPrinter(spec, out)
+	require.NoError(t, err)
+	require.NoError(t, printer.Print(v))
+	return out.String()
+}
+
+func TestOutputTable(t *testing.T) {
+	expected := "" +
+		"ID             CLASS     VCPUS  MEMORY  TRANSFER  PRICE_HOURLY  PRICE_MONTHLY\n" +
+		"g6-nanode-1    nanode    1      1024    1000      0.0075        5\n" +
+		"g6-standard-2  standard  2      4096    4000      0.03          20\n"
+	assert.Equal(t, expected, printOutput(t, "table", testLinodePlans()))
+}
+
+func TestOutputTableSingleObject(t *testing.T) {
+	info := struct {
+		*tunnelInstance
+		Cost *tunnelCost `json:"cost,omitempty"`
+	}{tunnelInstance: &tunnelInstance{
+		Provider:  providerTypeLinode,
+		Label:     "holepuncher",
+		IPv4:      []string{"192.0.2.1", "192.0.2.2"},
+		CreatedAt: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+	}}
+
+	expected := "" +
+		"PROVIDER    linode\n" +
+		"LABEL       holepuncher\n" +
+		"IPV4        192.0.2.1,192.0.2.2\n" +
+		"IPV6        \n" +
+		"CREATED_AT  2018-06-01T12:00:00Z\n" +
+		"COST        \n"
+	assert.Equal(t, expected, printOutput(t, "table", info))
+}
+
+func TestOutputCSV(t *testing.T) {
+	regions := []*linodeRegion{{ID: "eu-central", Country: "de"}, {ID: "us-east", Country: "us"}}
+	assert.Equal(t, "id,country\neu-central,de\nus-east,us\n", printOutput(t, "csv", regions))
+}
+
+func TestOutputYAML(t *testing.T) {
+	regions := []*linodeRegion{{ID: "eu-central", Country: "de"}}
+	assert.Equal(t, "- country: de\n  id: eu-central\n", printOutput(t, "yaml", regions))
+}
+
+func TestOutputTemplate(t *testing.T) {
+	output := printOutput(t, "template={{range .}}{{.id}} {{.price_monthly}}\n{{end}}", testLinodePlans())
+	assert.Equal(t, "g6-nanode-1 5\ng6-standard-2 20\n", output)
+
+	_, err := newOutputPrinter("template={{.id", &bytes.Buffer{})
+	assert.Error(t, err)
+}
+
+func TestOutputJSONIsDefault(t *testing.T) {
+	regions := []*linodeRegion{{ID: "eu-central", Country: "de"}}
+	expected := "[\n  {\n    \"id\": \"eu-central\",\n    \"country\": \"de\"\n  }\n]\n"
+	assert.Equal(t, expected, printOutput(t, "", regions))
+	assert.Equal(t, expected, printOutput(t, "json", regions))
+}
+
+func TestOutputUnknownFormat(t *testing.T) {
+	_, err := newOutputPrinter("xml", &bytes.Buffer{})
+	assert.Error(t, err)
+}
+
+func TestOutputPrintPlain(t *testing.T) {
+	out := &bytes.Buffer{}
+	printer, err := newOutputPrinter("", out)
+	require.NoError(t, err)
+	require.NoError(t, printer.PrintPlain([]string{"192.0.2.1", "192.0.2.2"}))
+	require.NoError(t, printer.PrintPlain(uint(51820)))
+	assert.Equal(t, "192.0.2.1\n192.0.2.2\n51820\n", out.String())
+
+	assert.Equal(t, "[\n  \"192.0.2.1\"\n]\n", printOutput(t, "json", []string{"192.0.2.1"}))
+	assert.Equal(t, "192.0.2.1\n", printOutput(t, "table", []string{"192.0.2.1"}))
+}
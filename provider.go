@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"protoapi"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,6 +16,7 @@ type providerType int
 const (
 	providerTypeLinode providerType = iota
 	providerTypeDigitalOcean
+	providerTypeMock
 )
 
 type tunnelCreationParams struct {
@@ -52,31 +55,108 @@ type rebuildTunnelResult struct {
 	Instance       tunnelInstance
 }
 
+// tunnelStatusError is returned by TunnelStatus when server reports an
+// error. Only errors that positively say the instance is not found tell
+// anything about the tunnel; others, e.g. a revoked token, an API outage or
+// a rate limit, leave its state unknown.
+type tunnelStatusError struct {
+	notFound bool
+}
+
+func (e *tunnelStatusError) Error() string {
+	return "rpc method returned an error"
+}
+
+func isTunnelNotFoundError(err error) bool {
+	statusErr, ok := errors.Cause(err).(*tunnelStatusError)
+	return ok && statusErr.notFound
+}
+
+// tunnelNotFoundMarkers are substrings of error messages server and provider
+// APIs use for missing instances.
+var tunnelNotFoundMarkers = []string{"not found", "does not exist"}
+
+func isNotFoundMessage(messages ...string) bool {
+	for _, message := range messages {
+		for _, marker := range tunnelNotFoundMarkers {
+			if strings.Contains(strings.ToLower(message), marker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type aCloudProvider interface {
 	CreateTunnel() (*createTunnelResult, error)
 	TunnelStatus() (*tunnelInstance, error)
 	DestroyTunnel() error
 }
 
+// aRebuildableCloudProvider is implemented by providers that can reinstall
+// tunnel instance in place, keeping its addresses.
+type aRebuildableCloudProvider interface {
+	RebuildTunnel() (*rebuildTunnelResult, error)
+}
+
+// tunnelPrice is the price of the plan tunnel instance was created with.
+type tunnelPrice struct {
+	Plan    string  `json:"plan"`
+	Hourly  float64 `json:"hourly"`
+	Monthly float64 `json:"monthly"`
+	// Hours of a month after which monthly price is charged. Zero means
+	// hoursPerMonth.
+	MonthlyHours int `json:"monthly_hours,omitempty"`
+}
+
+// aPricedCloudProvider is implemented by providers that can look up price of
+// the configured plan.
+type aPricedCloudProvider interface {
+	PlanPrice() (*tunnelPrice, error)
+}
+
+// aBudgetedCloudProvider is implemented by providers that may pick another
+// plan at create time, so that budget has to be checked for every plan
+// tried.
+type aBudgetedCloudProvider interface {
+	SetBudgetCheck(check func(price *tunnelPrice) error)
+}
+
 func (p providerType) String() string {
 	switch p {
 	case providerTypeLinode:
 		return "linode"
 	case providerTypeDigitalOcean:
 		return "digital_ocean"
+	case providerTypeMock:
+		return "mock"
 	default:
 		return fmt.Sprintf("%d (unsupported)", p)
 	}
 }
 
-func newHTTPClient(_ *programOptions) *http.Client {
-	return &http.Client{
-		Timeout: 150 * time.Second,
+// MarshalJSON stores provider by name, so that stored data doesn't depend
+// on order of provider types.
+func (p providerType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *providerType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for _, t := range []providerType{providerTypeLinode, providerTypeDigitalOcean, providerTypeMock} {
+		if t.String() == name {
+			*p = t
+			return nil
+		}
 	}
+	return errors.Errorf("unknown provider %q", name)
 }
 
 func newCloudProviderFromOptions(options *programOptions) (aCloudProvider, error) {
-	client, err := newHolepuncherClient(options, newHTTPClient(options))
+	client, err := newClientFromOptions(options)
 	if err != nil {
 		return nil, err
 	}
@@ -84,6 +164,10 @@ func newCloudProviderFromOptions(options *programOptions) (aCloudProvider, error
 	switch options.Runtime.Provider {
 	case providerTypeLinode.String():
 		return newLinodeProvider(client, options)
+	case providerTypeDigitalOcean.String():
+		return newDigitalOceanProvider(client, options)
+	case providerTypeMock.String():
+		return newMockProvider(client, options)
 	default:
 		log.WithField("provider", options.Runtime.Provider).Error("Provider is not supported")
 		return nil, errors.New("unsupported provider")
@@ -113,3 +197,35 @@ func creationParamsFromProgramOptions(options *programOptions) tunnelCreationPar
 	}
 	return params
 }
+
+// netServicesOptions converts circumvention method settings into the protobuf
+// options shared by all providers. Disabled services are left nil.
+func netServicesOptions(options *programOptions) (
+	*protoapi.WireguardOptions,
+	*protoapi.ObfsproxyIPv4Options,
+	*protoapi.ObfsproxyIPv6Options,
+) {
+	var wireguardOptions *protoapi.WireguardOptions
+	var obfs4Options *protoapi.ObfsproxyIPv4Options
+	var obfs6Options *protoapi.ObfsproxyIPv6Options
+	if options.WireGuard.Enable {
+		wireguardOptions = &protoapi.WireguardOptions{
+			Port:      uint32(options.WireGuard.Port),
+			ServerKey: options.WireGuard.ServerKey,
+			PeerKeys:  options.WireGuard.PeerKeys,
+		}
+	}
+	if options.ObfsproxyIPv4.Enable {
+		obfs4Options = &protoapi.ObfsproxyIPv4Options{
+			Port:   uint32(options.ObfsproxyIPv4.Port),
+			Secret: options.ObfsproxyIPv4.Secret,
+		}
+	}
+	if options.ObfsproxyIPv6.Enable {
+		obfs6Options = &protoapi.ObfsproxyIPv6Options{
+			Port:   uint32(options.ObfsproxyIPv6.Port),
+			Secret: options.ObfsproxyIPv6.Secret,
+		}
+	}
+	return wireguardOptions, obfs4Options, obfs6Options
+}
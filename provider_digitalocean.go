@@ -0,0 +1,480 @@
+package main
+
+import (
+	"protoapi"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type providerDigitalOcean struct {
+	client  aHolepuncherClient
+	options *programOptions
+}
+
+type digitalOceanDroplet struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Region    string    `json:"region"`
+	Size      string    `json:"size"`
+	Image     string    `json:"image"`
+	Status    string    `json:"status"`
+	IPv4      []string  `json:"ipv4"`
+	IPv6      []string  `json:"ipv6"`
+	CreatedAt time.Time `json:"created_at"`
+	Disk      uint64    `json:"disk"`
+	Memory    uint64    `json:"memory"`
+	VCPUs     uint      `json:"vcpus"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+type digitalOceanSize struct {
+	Slug         string   `json:"slug"`
+	PriceHourly  float32  `json:"price_hourly"`
+	PriceMonthly float32  `json:"price_monthly"`
+	Memory       uint64   `json:"memory"`
+	Vcpus        uint     `json:"vcpus"`
+	Disk         uint64   `json:"disk"`
+	Transfer     float32  `json:"transfer"`
+	Regions      []string `json:"regions"`
+	Available    bool     `json:"available"`
+}
+
+type digitalOceanRegion struct {
+	Slug      string   `json:"slug"`
+	Name      string   `json:"name"`
+	Available bool     `json:"available"`
+	Sizes     []string `json:"sizes,omitempty"`
+}
+
+type digitalOceanImage struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Distribution string    `json:"distribution"`
+	Slug         string    `json:"slug"`
+	MinDiskSize  uint64    `json:"min_disk_size"`
+	Regions      []string  `json:"regions"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newDigitalOceanProvider(
+	client aHolepuncherClient,
+	opts *programOptions,
+) (*providerDigitalOcean, error) {
+	// General validation should ensure that most of the data is valid, but
+	// it does not check provider parameters.
+	if err := validateGeneralProgramOptions(opts); err != nil {
+		return nil, err
+	}
+
+	if len(opts.DigitalOceanParams.AccessToken) == 0 {
+		return nil, logConfigurationError("digitalocean: access token is empty or missing")
+	} else if len(opts.DigitalOceanParams.Plan) == 0 {
+		return nil, logConfigurationError("digitalocean: plan is empty or missing")
+	} else if len(opts.DigitalOceanParams.Region) == 0 {
+		return nil, logConfigurationError("digitalocean: region is empty or missing")
+	}
+
+	return &providerDigitalOcean{
+		client:  client,
+		options: opts,
+	}, nil
+}
+
+func (p *providerDigitalOcean) CreateTunnel() (*createTunnelResult, error) {
+	generic, err := p.client.DoRequest(p.createCreateTunnelRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanCreateTunnelResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanCreateTunnelResponse, got something else (BUG)")
+		return nil, errors.New("DigitalOceanCreateTunnel RPC bug")
+	} else if doErr := result.GetError(); doErr != nil {
+		p.logError("RPC method returned an error", doErr)
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetDroplet() == nil {
+		// Should be unreachable unless there's a bug in the server code.
+		log.Error("Both result and error objects are empty (BUG)")
+		return nil, errors.New("DigitalOceanCreateTunnel RPC bug")
+	}
+
+	p.logDroplet(result.GetDroplet(), "Successfully created DigitalOcean droplet")
+
+	return &createTunnelResult{
+		CreationParams: creationParamsFromProgramOptions(p.options),
+		Instance:       p.tunnelInstance(result.GetDroplet()),
+	}, nil
+}
+
+func (p *providerDigitalOcean) RebuildTunnel() (*rebuildTunnelResult, error) {
+	generic, err := p.client.DoRequest(p.createRebuildTunnelRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanRebuildTunnelResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanRebuildTunnelResponse, got something else (BUG)")
+		return nil, errors.New("DigitalOceanRebuildTunnel RPC bug")
+	} else if doErr := result.GetError(); doErr != nil {
+		p.logError("RPC method returned an error", doErr)
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetDroplet() == nil {
+		// Should be unreachable unless there's a bug in the server code.
+		log.Error("Both result and error objects are empty (BUG)")
+		return nil, errors.New("DigitalOceanRebuildTunnel RPC bug")
+	}
+
+	p.logDroplet(result.GetDroplet(), "Successfully rebuilt DigitalOcean droplet")
+
+	return &rebuildTunnelResult{
+		CreationParams: creationParamsFromProgramOptions(p.options),
+		Instance:       p.tunnelInstance(result.GetDroplet()),
+	}, nil
+}
+
+func (p *providerDigitalOcean) DestroyTunnel() error {
+	generic, err := p.client.DoRequest(p.createDestroyTunnelRequest())
+	if err != nil {
+		return err
+	}
+
+	result := generic.GetDigitalOceanDestroyTunnelResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanDestroyTunnelResponse, got something else (BUG)")
+		return errors.New("DigitalOceanDestroyTunnel RPC bug")
+	} else if doErr := result.GetError(); doErr != nil {
+		p.logError("RPC method returned an error", doErr)
+		return errors.New("rpc method returned an error")
+	}
+
+	return nil
+}
+
+func (p *providerDigitalOcean) TunnelStatus() (*tunnelInstance, error) {
+	generic, err := p.client.DoRequest(p.createTunnelStatusRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanTunnelStatusResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanGetTunnelStatusResponse, but got something else (BUG)")
+		return nil, errors.New("DigitalOceanGetTunnelStatus RPC bug")
+	} else if result.GetError() != nil {
+		p.logError("RPC method returned an error", result.GetError())
+		return nil, &tunnelStatusError{notFound: digitalOceanNotFound(result.GetError())}
+	} else if result.GetDroplet() == nil {
+		log.Error("Result and error objects are both empty (BUG)")
+		return nil, errors.New("DigitalOceanGetTunnelStatus RPC bug")
+	}
+
+	instance := p.tunnelInstance(result.GetDroplet())
+	return &instance, nil
+}
+
+func (p *providerDigitalOcean) ListDroplets() ([]*digitalOceanDroplet, error) {
+	generic, err := p.client.DoRequest(p.createListDropletsRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanListDropletsResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanListDropletsResponse, but got something else (BUG)")
+		return nil, errors.New("DigitalOceanListDroplets RPC bug")
+	} else if result.GetError() != nil {
+		p.logError("RPC method returned an error", result.GetError())
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetDroplets() == nil {
+		log.Error("Result and error objects are both empty (BUG)")
+		return nil, errors.New("DigitalOceanListDropletsResponse RPC bug")
+	}
+
+	droplets := []*digitalOceanDroplet{}
+	for _, droplet := range result.GetDroplets().GetL() {
+		createdAt, _ := p.parseDate(droplet.CreatedAt)
+		droplets = append(droplets, &digitalOceanDroplet{
+			ID:        droplet.Id,
+			Name:      droplet.Name,
+			Region:    droplet.Region,
+			Size:      droplet.Size,
+			Image:     droplet.Image,
+			Status:    droplet.Status,
+			IPv4:      droplet.Ipv4,
+			IPv6:      droplet.Ipv6,
+			CreatedAt: createdAt,
+			Disk:      droplet.Disk,
+			Memory:    droplet.Memory,
+			VCPUs:     uint(droplet.Vcpus),
+			Tags:      droplet.Tags,
+		})
+	}
+	return droplets, nil
+}
+
+func (p *providerDigitalOcean) ListSizes() ([]*digitalOceanSize, error) {
+	generic, err := p.client.DoRequest(p.createListSizesRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanListSizesResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanListSizesResponse, but got something else (BUG)")
+		return nil, errors.New("DigitalOceanListSizes RPC bug")
+	} else if result.GetError() != nil {
+		p.logError("RPC method returned an error", result.GetError())
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetSizes() == nil {
+		log.Error("Result and error objects are both empty (BUG)")
+		return nil, errors.New("DigitalOceanListSizesResponse RPC bug")
+	}
+
+	sizes := []*digitalOceanSize{}
+	for _, size := range result.GetSizes().GetL() {
+		sizes = append(sizes, &digitalOceanSize{
+			Slug:         size.Slug,
+			PriceHourly:  size.PriceHourly,
+			PriceMonthly: size.PriceMonthly,
+			Memory:       size.Memory,
+			Vcpus:        uint(size.Vcpus),
+			Disk:         size.Disk,
+			Transfer:     size.Transfer,
+			Regions:      size.Regions,
+			Available:    size.Available,
+		})
+	}
+	return sizes, nil
+}
+
+// PlanPrice returns price of the configured droplet size.
+func (p *providerDigitalOcean) PlanPrice() (*tunnelPrice, error) {
+	sizes, err := p.ListSizes()
+	if err != nil {
+		return nil, err
+	}
+	for _, size := range sizes {
+		if size.Slug == p.options.DigitalOceanParams.Plan {
+			return &tunnelPrice{
+				Plan:         size.Slug,
+				Hourly:       float64(size.PriceHourly),
+				Monthly:      float64(size.PriceMonthly),
+				MonthlyHours: digitalOceanMonthlyHours,
+			}, nil
+		}
+	}
+	log.WithField("plan", p.options.DigitalOceanParams.Plan).Error(
+		"Plan is not in the list of DigitalOcean sizes")
+	return nil, errors.New("unknown plan")
+}
+
+func (p *providerDigitalOcean) ListRegions() ([]*digitalOceanRegion, error) {
+	generic, err := p.client.DoRequest(p.createListRegionsRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanListRegionsResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanListRegionsResponse, but got something else (BUG)")
+		return nil, errors.New("DigitalOceanListRegions RPC bug")
+	} else if result.GetError() != nil {
+		p.logError("RPC method returned an error", result.GetError())
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetRegions() == nil {
+		log.Error("Result and error objects are both empty (BUG)")
+		return nil, errors.New("DigitalOceanListRegionsResponse RPC bug")
+	}
+
+	regions := []*digitalOceanRegion{}
+	for _, region := range result.GetRegions().GetL() {
+		regions = append(regions, &digitalOceanRegion{
+			Slug:      region.Slug,
+			Name:      region.Name,
+			Available: region.Available,
+			Sizes:     region.Sizes,
+		})
+	}
+	return regions, nil
+}
+
+func (p *providerDigitalOcean) ListImages() ([]*digitalOceanImage, error) {
+	generic, err := p.client.DoRequest(p.createListImagesRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	result := generic.GetDigitalOceanListImagesResult()
+	if result == nil {
+		log.Error("Expected DigitalOceanListImagesResponse, but got something else (BUG)")
+		return nil, errors.New("DigitalOceanListImages RPC bug")
+	} else if result.GetError() != nil {
+		p.logError("RPC method returned an error", result.GetError())
+		return nil, errors.New("rpc method returned an error")
+	} else if result.GetImages() == nil {
+		log.Error("Result and error objects are both empty (BUG)")
+		return nil, errors.New("DigitalOceanListImagesResponse RPC bug")
+	}
+
+	images := []*digitalOceanImage{}
+	for _, image := range result.GetImages().GetL() {
+		createdAt, _ := p.parseDate(image.CreatedAt)
+		images = append(images, &digitalOceanImage{
+			ID:           image.Id,
+			Name:         image.Name,
+			Distribution: image.Distribution,
+			Slug:         image.Slug,
+			MinDiskSize:  image.MinDiskSize,
+			Regions:      image.Regions,
+			CreatedAt:    createdAt,
+		})
+	}
+	return images, nil
+}
+
+func (p *providerDigitalOcean) tunnelInstance(droplet *protoapi.DigitalOceanDroplet) tunnelInstance {
+	createdAt, _ := p.parseDate(droplet.CreatedAt)
+	return tunnelInstance{
+		Provider:  providerTypeDigitalOcean,
+		Label:     droplet.Name,
+		IPv4:      droplet.Ipv4,
+		IPv6:      droplet.Ipv6,
+		CreatedAt: createdAt,
+	}
+}
+
+func (p *providerDigitalOcean) createAuth() *protoapi.DigitalOceanAuth {
+	return &protoapi.DigitalOceanAuth{
+		AccessToken: p.options.DigitalOceanParams.AccessToken,
+	}
+}
+
+func (p *providerDigitalOcean) createCreateTunnelRequest() *protoapi.Request {
+	wg, obfs4, obfs6 := netServicesOptions(p.options)
+	command := &protoapi.DigitalOceanCreateTunnelRequest{
+		Auth:                   p.createAuth(),
+		Region:                 p.options.DigitalOceanParams.Region,
+		Size:                   p.options.DigitalOceanParams.Plan,
+		RootPassword:           p.options.RootUser.Password,
+		RegularAccountName:     p.options.NormalUser.UserName,
+		RegularAccountPassword: p.options.NormalUser.Password,
+		SshKeys:                p.options.AllUsers.SSHKeys,
+		WireguardOptions:       wg,
+		Obfsproxy4Options:      obfs4,
+		Obfsproxy6Options:      obfs6,
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanCreateTunnel{DigitalOceanCreateTunnel: command},
+	}
+}
+
+func (p *providerDigitalOcean) createRebuildTunnelRequest() *protoapi.Request {
+	wg, obfs4, obfs6 := netServicesOptions(p.options)
+	command := &protoapi.DigitalOceanRebuildTunnelRequest{
+		Auth:                   p.createAuth(),
+		RootPassword:           p.options.RootUser.Password,
+		RegularAccountName:     p.options.NormalUser.UserName,
+		RegularAccountPassword: p.options.NormalUser.Password,
+		SshKeys:                p.options.AllUsers.SSHKeys,
+		WireguardOptions:       wg,
+		Obfsproxy4Options:      obfs4,
+		Obfsproxy6Options:      obfs6,
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanRebuildTunnel{DigitalOceanRebuildTunnel: command},
+	}
+}
+
+func (p *providerDigitalOcean) createDestroyTunnelRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanDestroyTunnelRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanDestroyTunnel{DigitalOceanDestroyTunnel: command},
+	}
+}
+
+func (p *providerDigitalOcean) createTunnelStatusRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanGetTunnelStatusRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanTunnelStatus{DigitalOceanTunnelStatus: command},
+	}
+}
+
+func (p *providerDigitalOcean) createListDropletsRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanListDropletsRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanListDroplets{DigitalOceanListDroplets: command},
+	}
+}
+
+func (p *providerDigitalOcean) createListSizesRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanListSizesRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanListSizes{DigitalOceanListSizes: command},
+	}
+}
+
+func (p *providerDigitalOcean) createListRegionsRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanListRegionsRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanListRegions{DigitalOceanListRegions: command},
+	}
+}
+
+func (p *providerDigitalOcean) createListImagesRequest() *protoapi.Request {
+	command := &protoapi.DigitalOceanListImagesRequest{
+		Auth: p.createAuth(),
+	}
+	return &protoapi.Request{
+		R: &protoapi.Request_DigitalOceanListImages{DigitalOceanListImages: command},
+	}
+}
+
+func (p *providerDigitalOcean) logDroplet(droplet *protoapi.DigitalOceanDroplet, msg string) {
+	log.WithFields(log.Fields{
+		"name":   droplet.Name,
+		"ipv4":   droplet.Ipv4,
+		"ipv6":   droplet.Ipv6,
+		"size":   droplet.Size,
+		"region": droplet.Region,
+		"status": droplet.Status,
+	}).Info(msg)
+}
+
+func (p *providerDigitalOcean) logError(msg string, errObject *protoapi.DigitalOceanError) {
+	fields := log.Fields{}
+	if len(errObject.Id) > 0 {
+		fields["id"] = errObject.Id
+	}
+	if hpErr := errObject.GetError(); hpErr != nil && len(hpErr.Message) > 0 {
+		fields["server-error"] = hpErr.Message
+	}
+	log.WithFields(fields).Error(msg)
+}
+
+func (p *providerDigitalOcean) parseDate(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Unix(0, 0), err
+}
+
+// digitalOceanNotFound tells whether error says that tunnel droplet doesn't
+// exist.
+func digitalOceanNotFound(errObject *protoapi.DigitalOceanError) bool {
+	return errObject.GetId() == "not_found" || isNotFoundMessage(errObject.GetError().GetMessage())
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"protoapi"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDigitalOceanProvider(t *testing.T, client aHolepuncherClient) *providerDigitalOcean {
+	o := validTestOptions()
+	o.Runtime.Provider = providerTypeDigitalOcean.String()
+	o.DigitalOceanParams.AccessToken = "token"
+	o.DigitalOceanParams.Region = "ams3"
+	o.DigitalOceanParams.Plan = "s-1vcpu-1gb"
+	o.RootUser.Password = "root-password"
+	o.NormalUser.UserName = "user"
+	o.NormalUser.Password = "user-password"
+	o.AllUsers.SSHKeys = []string{"ssh-ed25519 AAAA"}
+
+	p, err := newDigitalOceanProvider(client, o)
+	require.NoError(t, err)
+	return p
+}
+
+func testDigitalOceanDroplet() *protoapi.DigitalOceanDroplet {
+	return &protoapi.DigitalOceanDroplet{
+		Id:        1,
+		Name:      "holepuncher",
+		Region:    "ams3",
+		Size:      "s-1vcpu-1gb",
+		Status:    "active",
+		Ipv4:      []string{"192.0.2.1"},
+		Ipv6:      []string{"2001:db8::1"},
+		CreatedAt: "2018-06-01T12:00:00Z",
+		Vcpus:     1,
+	}
+}
+
+func testDigitalOceanError() *protoapi.DigitalOceanError {
+	return &protoapi.DigitalOceanError{
+		Error: &protoapi.Error{Message: "failure"},
+		Id:    "unprocessable_entity",
+	}
+}
+
+// digitalOceanRPCTestCase describes a providerDigitalOcean method along with
+// responses that exercise all of its branches.
+type digitalOceanRPCTestCase struct {
+	name    string
+	call    func(p *providerDigitalOcean) (interface{}, error)
+	success *protoapi.Response
+	failure *protoapi.Response
+	empty   *protoapi.Response
+}
+
+func digitalOceanRPCTestCases() []digitalOceanRPCTestCase {
+	return []digitalOceanRPCTestCase{
+		{
+			name: "CreateTunnel",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.CreateTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanCreateTunnelResult{
+				DigitalOceanCreateTunnelResult: &protoapi.DigitalOceanCreateTunnelResponse{
+					Droplet: testDigitalOceanDroplet(),
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanCreateTunnelResult{
+				DigitalOceanCreateTunnelResult: &protoapi.DigitalOceanCreateTunnelResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanCreateTunnelResult{
+				DigitalOceanCreateTunnelResult: &protoapi.DigitalOceanCreateTunnelResponse{},
+			}},
+		},
+		{
+			name: "RebuildTunnel",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.RebuildTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanRebuildTunnelResult{
+				DigitalOceanRebuildTunnelResult: &protoapi.DigitalOceanRebuildTunnelResponse{
+					Droplet: testDigitalOceanDroplet(),
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanRebuildTunnelResult{
+				DigitalOceanRebuildTunnelResult: &protoapi.DigitalOceanRebuildTunnelResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanRebuildTunnelResult{
+				DigitalOceanRebuildTunnelResult: &protoapi.DigitalOceanRebuildTunnelResponse{},
+			}},
+		},
+		{
+			name: "DestroyTunnel",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return nil, p.DestroyTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanDestroyTunnelResult{
+				DigitalOceanDestroyTunnelResult: &protoapi.DigitalOceanDestroyTunnelResponse{},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanDestroyTunnelResult{
+				DigitalOceanDestroyTunnelResult: &protoapi.DigitalOceanDestroyTunnelResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+		},
+		{
+			name: "TunnelStatus",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.TunnelStatus() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanTunnelStatusResult{
+				DigitalOceanTunnelStatusResult: &protoapi.DigitalOceanGetTunnelStatusResponse{
+					Droplet: testDigitalOceanDroplet(),
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanTunnelStatusResult{
+				DigitalOceanTunnelStatusResult: &protoapi.DigitalOceanGetTunnelStatusResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanTunnelStatusResult{
+				DigitalOceanTunnelStatusResult: &protoapi.DigitalOceanGetTunnelStatusResponse{},
+			}},
+		},
+		{
+			name: "ListDroplets",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.ListDroplets() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanListDropletsResult{
+				DigitalOceanListDropletsResult: &protoapi.DigitalOceanListDropletsResponse{
+					Droplets: &protoapi.DigitalOceanDropletList{
+						L: []*protoapi.DigitalOceanDroplet{testDigitalOceanDroplet()},
+					},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanListDropletsResult{
+				DigitalOceanListDropletsResult: &protoapi.DigitalOceanListDropletsResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanListDropletsResult{
+				DigitalOceanListDropletsResult: &protoapi.DigitalOceanListDropletsResponse{},
+			}},
+		},
+		{
+			name: "ListSizes",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.ListSizes() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanListSizesResult{
+				DigitalOceanListSizesResult: &protoapi.DigitalOceanListSizesResponse{
+					Sizes: &protoapi.DigitalOceanSizeList{L: []*protoapi.DigitalOceanSize{
+						{Slug: "s-1vcpu-1gb", PriceHourly: 0.00744, PriceMonthly: 5, Vcpus: 1,
+							Memory: 1024, Regions: []string{"ams3"}, Available: true},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanListSizesResult{
+				DigitalOceanListSizesResult: &protoapi.DigitalOceanListSizesResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanListSizesResult{
+				DigitalOceanListSizesResult: &protoapi.DigitalOceanListSizesResponse{},
+			}},
+		},
+		{
+			name: "ListRegions",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.ListRegions() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanListRegionsResult{
+				DigitalOceanListRegionsResult: &protoapi.DigitalOceanListRegionsResponse{
+					Regions: &protoapi.DigitalOceanRegionList{L: []*protoapi.DigitalOceanRegion{
+						{Slug: "ams3", Name: "Amsterdam 3", Available: true},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanListRegionsResult{
+				DigitalOceanListRegionsResult: &protoapi.DigitalOceanListRegionsResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanListRegionsResult{
+				DigitalOceanListRegionsResult: &protoapi.DigitalOceanListRegionsResponse{},
+			}},
+		},
+		{
+			name: "ListImages",
+			call: func(p *providerDigitalOcean) (interface{}, error) { return p.ListImages() },
+			success: &protoapi.Response{R: &protoapi.Response_DigitalOceanListImagesResult{
+				DigitalOceanListImagesResult: &protoapi.DigitalOceanListImagesResponse{
+					Images: &protoapi.DigitalOceanImageList{L: []*protoapi.DigitalOceanImage{
+						{Id: 1, Slug: "debian-9-x64", Distribution: "Debian", CreatedAt: "2017-06-16T20:02:29Z"},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_DigitalOceanListImagesResult{
+				DigitalOceanListImagesResult: &protoapi.DigitalOceanListImagesResponse{
+					Error: testDigitalOceanError(),
+				},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_DigitalOceanListImagesResult{
+				DigitalOceanListImagesResult: &protoapi.DigitalOceanListImagesResponse{},
+			}},
+		},
+	}
+}
+
+func TestNewDigitalOceanProviderValidation(t *testing.T) {
+	cases := map[string]func(o *programOptions){
+		"missing access token": func(o *programOptions) { o.DigitalOceanParams.AccessToken = "" },
+		"missing plan":         func(o *programOptions) { o.DigitalOceanParams.Plan = "" },
+		"missing region":       func(o *programOptions) { o.DigitalOceanParams.Region = "" },
+		"invalid general":      func(o *programOptions) { o.Runtime.Provider = "" },
+	}
+	for name, mutate := range cases {
+		o := validTestOptions()
+		o.DigitalOceanParams.AccessToken = "token"
+		o.DigitalOceanParams.Region = "ams3"
+		o.DigitalOceanParams.Plan = "s-1vcpu-1gb"
+		mutate(o)
+		_, err := newDigitalOceanProvider(&fakeHolepuncherClient{}, o)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestDigitalOceanRPCSuccess(t *testing.T) {
+	for _, tc := range digitalOceanRPCTestCases() {
+		client := &fakeHolepuncherClient{response: tc.success}
+		_, err := tc.call(newTestDigitalOceanProvider(t, client))
+		assert.NoError(t, err, tc.name)
+		assert.Len(t, client.requests, 1, tc.name)
+	}
+}
+
+func TestDigitalOceanRPCTransportError(t *testing.T) {
+	for _, tc := range digitalOceanRPCTestCases() {
+		client := &fakeHolepuncherClient{err: errors.New("connection refused")}
+		result, err := tc.call(newTestDigitalOceanProvider(t, client))
+		assert.EqualError(t, err, "connection refused", tc.name)
+		assert.Nil(t, result, tc.name)
+	}
+}
+
+func TestDigitalOceanRPCUnexpectedResponse(t *testing.T) {
+	for _, tc := range digitalOceanRPCTestCases() {
+		client := &fakeHolepuncherClient{response: &protoapi.Response{}}
+		_, err := tc.call(newTestDigitalOceanProvider(t, client))
+		assert.Error(t, err, tc.name)
+		assert.Contains(t, err.Error(), "RPC bug", tc.name)
+	}
+}
+
+func TestDigitalOceanRPCError(t *testing.T) {
+	for _, tc := range digitalOceanRPCTestCases() {
+		client := &fakeHolepuncherClient{response: tc.failure}
+		_, err := tc.call(newTestDigitalOceanProvider(t, client))
+		assert.EqualError(t, err, "rpc method returned an error", tc.name)
+	}
+}
+
+func TestDigitalOceanRPCBothEmpty(t *testing.T) {
+	for _, tc := range digitalOceanRPCTestCases() {
+		if tc.empty == nil {
+			continue
+		}
+		client := &fakeHolepuncherClient{response: tc.empty}
+		_, err := tc.call(newTestDigitalOceanProvider(t, client))
+		assert.Error(t, err, tc.name)
+		assert.Contains(t, err.Error(), "RPC bug", tc.name)
+	}
+}
+
+func TestDigitalOceanCreateTunnel(t *testing.T) {
+	client := &fakeHolepuncherClient{response: digitalOceanRPCTestCases()[0].success}
+	p := newTestDigitalOceanProvider(t, client)
+
+	result, err := p.CreateTunnel()
+	require.NoError(t, err)
+	assert.Equal(t, providerTypeDigitalOcean, result.Instance.Provider)
+	assert.Equal(t, "holepuncher", result.Instance.Label)
+	assert.Equal(t, []string{"192.0.2.1"}, result.Instance.IPv4)
+	assert.Equal(t, []string{"2001:db8::1"}, result.Instance.IPv6)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), result.Instance.CreatedAt)
+	assert.Equal(t, creationParamsFromProgramOptions(p.options), result.CreationParams)
+
+	require.Len(t, client.requests, 1)
+	request := client.requests[0].GetDigitalOceanCreateTunnel()
+	require.NotNil(t, request)
+	assert.Equal(t, "token", request.Auth.AccessToken)
+	assert.Equal(t, "ams3", request.Region)
+	assert.Equal(t, "s-1vcpu-1gb", request.Size)
+	assert.Equal(t, "root-password", request.RootPassword)
+	assert.Equal(t, "user", request.RegularAccountName)
+	assert.Equal(t, "user-password", request.RegularAccountPassword)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA"}, request.SshKeys)
+	assert.Equal(t, uint32(55000), request.WireguardOptions.Port)
+	assert.Equal(t, uint32(56000), request.Obfsproxy4Options.Port)
+	assert.Equal(t, uint32(57000), request.Obfsproxy6Options.Port)
+}
+
+func TestDigitalOceanRebuildTunnelRequest(t *testing.T) {
+	p := newTestDigitalOceanProvider(t, &fakeHolepuncherClient{})
+	p.options.WireGuard.Enable = false
+
+	request := p.createRebuildTunnelRequest().GetDigitalOceanRebuildTunnel()
+	require.NotNil(t, request)
+	assert.Equal(t, "token", request.Auth.AccessToken)
+	assert.Equal(t, "root-password", request.RootPassword)
+	assert.Nil(t, request.WireguardOptions)
+	assert.NotNil(t, request.Obfsproxy4Options)
+}
+
+func TestDigitalOceanListSizes(t *testing.T) {
+	client := &fakeHolepuncherClient{response: digitalOceanRPCTestCases()[5].success}
+	sizes, err := newTestDigitalOceanProvider(t, client).ListSizes()
+	require.NoError(t, err)
+	require.Len(t, sizes, 1)
+	assert.Equal(t, "s-1vcpu-1gb", sizes[0].Slug)
+	assert.Equal(t, float32(5), sizes[0].PriceMonthly)
+	assert.Equal(t, uint(1), sizes[0].Vcpus)
+	assert.Equal(t, []string{"ams3"}, sizes[0].Regions)
+	assert.True(t, sizes[0].Available)
+}
+
+func TestDigitalOceanListDroplets(t *testing.T) {
+	client := &fakeHolepuncherClient{response: digitalOceanRPCTestCases()[4].success}
+	droplets, err := newTestDigitalOceanProvider(t, client).ListDroplets()
+	require.NoError(t, err)
+	require.Len(t, droplets, 1)
+	assert.Equal(t, int64(1), droplets[0].ID)
+	assert.Equal(t, "active", droplets[0].Status)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), droplets[0].CreatedAt)
+}
+
+func TestDigitalOceanPlanPrice(t *testing.T) {
+	client := &fakeHolepuncherClient{response: digitalOceanRPCTestCases()[5].success}
+	p := newTestDigitalOceanProvider(t, client)
+	price, err := p.PlanPrice()
+	require.NoError(t, err)
+	assert.Equal(t, "s-1vcpu-1gb", price.Plan)
+	assert.InDelta(t, 5, price.Monthly, 1e-9)
+
+	p.options.DigitalOceanParams.Plan = "s-8vcpu-16gb"
+	_, err = p.PlanPrice()
+	assert.Error(t, err)
+}
+
+func TestDigitalOceanTunnelStatusNotFound(t *testing.T) {
+	cases := map[*protoapi.DigitalOceanError]bool{
+		{Id: "not_found", Error: &protoapi.Error{Message: "The resource you were accessing could not be found."}}: true,
+		{Id: "unauthorized", Error: &protoapi.Error{Message: "Unable to authenticate you."}}:                      false,
+		testDigitalOceanError(): false,
+	}
+	for errObject, expected := range cases {
+		client := &fakeHolepuncherClient{response: &protoapi.Response{
+			R: &protoapi.Response_DigitalOceanTunnelStatusResult{
+				DigitalOceanTunnelStatusResult: &protoapi.DigitalOceanGetTunnelStatusResponse{Error: errObject},
+			},
+		}}
+		_, err := newTestDigitalOceanProvider(t, client).TunnelStatus()
+		assert.EqualError(t, err, "rpc method returned an error")
+		assert.Equal(t, expected, isTunnelNotFoundError(err))
+	}
+}
@@ -12,6 +12,12 @@ import (
 type providerLinode struct {
 	client  aHolepuncherClient
 	options *programOptions
+
+	// Set once selection policy is resolved.
+	plans      []*linodePlan
+	candidates *linodePlacementCandidates
+	// Checks price of every plan selection policy tries, may be nil.
+	budgetCheck func(price *tunnelPrice) error
 }
 
 type linodeInstance struct {
@@ -73,11 +79,13 @@ func newLinodeProvider(client aHolepuncherClient, opts *programOptions) (*provid
 		return nil, err
 	}
 
+	// Region and plan may be chosen by selection policy.
+	selection := opts.LinodeParams.Selection.Enabled()
 	if len(opts.LinodeParams.AccessToken) == 0 {
 		return nil, logConfigurationError("linode: access token is empty or missing")
-	} else if len(opts.LinodeParams.Plan) == 0 {
+	} else if len(opts.LinodeParams.Plan) == 0 && !selection {
 		return nil, logConfigurationError("linode: plan is empty or missing")
-	} else if len(opts.LinodeParams.Region) == 0 {
+	} else if len(opts.LinodeParams.Region) == 0 && !selection {
 		return nil, logConfigurationError("linode: region is empty or missing")
 	}
 
@@ -88,6 +96,13 @@ func newLinodeProvider(client aHolepuncherClient, opts *programOptions) (*provid
 }
 
 func (p *providerLinode) CreateTunnel() (*createTunnelResult, error) {
+	if p.options.LinodeParams.Selection.Enabled() {
+		return p.createTunnelWithPolicy()
+	}
+	return p.createTunnel()
+}
+
+func (p *providerLinode) createTunnel() (*createTunnelResult, error) {
 	generic, err := p.client.DoRequest(p.createCreateTunnelRequest())
 	if err != nil {
 		return nil, err
@@ -99,7 +114,7 @@ func (p *providerLinode) CreateTunnel() (*createTunnelResult, error) {
 		return nil, errors.New("LinodeCreateTunnel RPC bug")
 	} else if linodeErr := result.GetError(); linodeErr != nil {
 		p.logError("RPC method returned an error", linodeErr)
-		return nil, errors.New("rpc method returned an error")
+		return nil, &linodeRPCError{linodeErr: linodeErr}
 	} else if result.GetInstance() == nil {
 		// Should be unreachable unless there's a bug in the server code.
 		log.Error("Both result and error objects are empty (BUG)")
@@ -189,7 +204,7 @@ func (p *providerLinode) TunnelStatus() (*tunnelInstance, error) {
 		return nil, errors.New("LinodeGetTunnelStatus RPC bug")
 	} else if result.GetError() != nil {
 		p.logError("RPC method returned an error", result.GetError())
-		return nil, errors.New("rpc method returned an error")
+		return nil, &tunnelStatusError{notFound: linodeNotFound(result.GetError())}
 	} else if result.GetInstance() == nil {
 		log.Error("Result and error objects are both empty (BUG)")
 		return nil, errors.New("LinodeGetTunnelStatus RPC bug")
@@ -284,6 +299,38 @@ func (p *providerLinode) ListPlans() ([]*linodePlan, error) {
 	return plans, nil
 }
 
+// PlanPrice returns price of the configured plan.
+func (p *providerLinode) PlanPrice() (*tunnelPrice, error) {
+	if p.options.LinodeParams.Selection.Enabled() {
+		if err := p.resolvePlacement(); err != nil {
+			return nil, err
+		}
+	}
+	if p.plans == nil {
+		plans, err := p.ListPlans()
+		if err != nil {
+			return nil, err
+		}
+		return linodePlanPrice(plans, p.options.LinodeParams.Plan)
+	}
+	return linodePlanPrice(p.plans, p.options.LinodeParams.Plan)
+}
+
+func linodePlanPrice(plans []*linodePlan, id string) (*tunnelPrice, error) {
+	for _, plan := range plans {
+		if plan.ID == id {
+			return &tunnelPrice{
+				Plan:         plan.ID,
+				Hourly:       float64(plan.PriceHourly),
+				Monthly:      float64(plan.PriceMonthly),
+				MonthlyHours: linodeMonthlyHours,
+			}, nil
+		}
+	}
+	log.WithField("plan", id).Error("Plan is not in the list of Linode plans")
+	return nil, errors.New("unknown plan")
+}
+
 func (p *providerLinode) ListRegions() ([]*linodeRegion, error) {
 	generic, err := p.client.DoRequest(p.createListRegionsRequest())
 	if err != nil {
@@ -381,38 +428,8 @@ func (p *providerLinode) createAuth() *protoapi.LinodeAuth {
 	}
 }
 
-func (p *providerLinode) netServicesOptions() (
-	*protoapi.WireguardOptions,
-	*protoapi.ObfsproxyIPv4Options,
-	*protoapi.ObfsproxyIPv6Options,
-) {
-	var wireguardOptions *protoapi.WireguardOptions
-	var obfs4Options *protoapi.ObfsproxyIPv4Options
-	var obfs6Options *protoapi.ObfsproxyIPv6Options
-	if p.options.WireGuard.Enable {
-		wireguardOptions = &protoapi.WireguardOptions{
-			Port:      uint32(p.options.WireGuard.Port),
-			ServerKey: p.options.WireGuard.ServerKey,
-			PeerKeys:  p.options.WireGuard.PeerKeys,
-		}
-	}
-	if p.options.ObfsproxyIPv4.Enable {
-		obfs4Options = &protoapi.ObfsproxyIPv4Options{
-			Port:   uint32(p.options.ObfsproxyIPv4.Port),
-			Secret: p.options.ObfsproxyIPv4.Secret,
-		}
-	}
-	if p.options.ObfsproxyIPv6.Enable {
-		obfs6Options = &protoapi.ObfsproxyIPv6Options{
-			Port:   uint32(p.options.ObfsproxyIPv6.Port),
-			Secret: p.options.ObfsproxyIPv6.Secret,
-		}
-	}
-	return wireguardOptions, obfs4Options, obfs6Options
-}
-
 func (p *providerLinode) createCreateTunnelRequest() *protoapi.Request {
-	wg, obfs4, obfs6 := p.netServicesOptions()
+	wg, obfs4, obfs6 := netServicesOptions(p.options)
 	command := &protoapi.LinodeCreateTunnelRequest{
 		Auth:                   p.createAuth(),
 		Region:                 p.options.LinodeParams.Region,
@@ -431,7 +448,7 @@ func (p *providerLinode) createCreateTunnelRequest() *protoapi.Request {
 }
 
 func (p *providerLinode) createRebuildTunnelRequest() *protoapi.Request {
-	wg, obfs4, obfs6 := p.netServicesOptions()
+	wg, obfs4, obfs6 := netServicesOptions(p.options)
 	command := &protoapi.LinodeRebuildTunnelRequest{
 		Auth:                   p.createAuth(),
 		RootPassword:           p.options.RootUser.Password,
@@ -554,3 +571,12 @@ func (p *providerLinode) parseDate(value string) (time.Time, error) {
 	}
 	return time.Unix(0, 0), err
 }
+
+// linodeNotFound tells whether error says that tunnel instance doesn't exist.
+func linodeNotFound(errObject *protoapi.LinodeError) bool {
+	messages := []string{errObject.GetError().GetMessage()}
+	for _, detail := range errObject.GetDetails() {
+		messages = append(messages, detail.GetReason())
+	}
+	return isNotFoundMessage(messages...)
+}
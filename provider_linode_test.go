@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"protoapi"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLinodeProvider(t *testing.T, client aHolepuncherClient) *providerLinode {
+	o := validTestOptions()
+	o.LinodeParams.AccessToken = "token"
+	o.LinodeParams.Region = "eu-central"
+	o.LinodeParams.Plan = "g6-nanode-1"
+	o.RootUser.Password = "root-password"
+	o.NormalUser.UserName = "user"
+	o.NormalUser.Password = "user-password"
+	o.AllUsers.SSHKeys = []string{"ssh-ed25519 AAAA"}
+
+	p, err := newLinodeProvider(client, o)
+	require.NoError(t, err)
+	return p
+}
+
+func testLinodeInstance() *protoapi.LinodeInstance {
+	return &protoapi.LinodeInstance{
+		Id:        1,
+		Label:     "holepuncher",
+		Region:    "eu-central",
+		Plan:      "g6-nanode-1",
+		Ipv4:      []string{"192.0.2.1"},
+		Ipv6:      []string{"2001:db8::1"},
+		CreatedAt: "2018-06-01T12:00:00",
+		UpdatedAt: "2018-06-02T12:00:00",
+		Vcpus:     1,
+	}
+}
+
+func testLinodeError() *protoapi.LinodeError {
+	return &protoapi.LinodeError{
+		Error: &protoapi.Error{Message: "failure"},
+		Details: []*protoapi.LinodeErrorDetail{
+			{Field: "region", Reason: "region is unavailable"},
+			{Field: "plan", Reason: "plan is unavailable"},
+		},
+	}
+}
+
+// linodeRPCTestCase describes a providerLinode method along with responses
+// that exercise all of its branches.
+type linodeRPCTestCase struct {
+	name    string
+	call    func(p *providerLinode) (interface{}, error)
+	success *protoapi.Response
+	failure *protoapi.Response
+	empty   *protoapi.Response
+}
+
+func linodeRPCTestCases() []linodeRPCTestCase {
+	return []linodeRPCTestCase{
+		{
+			name: "CreateTunnel",
+			call: func(p *providerLinode) (interface{}, error) { return p.CreateTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeCreateTunnelResult{
+				LinodeCreateTunnelResult: &protoapi.LinodeCreateTunnelResponse{Instance: testLinodeInstance()},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeCreateTunnelResult{
+				LinodeCreateTunnelResult: &protoapi.LinodeCreateTunnelResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeCreateTunnelResult{
+				LinodeCreateTunnelResult: &protoapi.LinodeCreateTunnelResponse{},
+			}},
+		},
+		{
+			name: "RebuildTunnel",
+			call: func(p *providerLinode) (interface{}, error) { return p.RebuildTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeRebuildTunnelResult{
+				LinodeRebuildTunnelResult: &protoapi.LinodeRebuildTunnelResponse{Instance: testLinodeInstance()},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeRebuildTunnelResult{
+				LinodeRebuildTunnelResult: &protoapi.LinodeRebuildTunnelResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeRebuildTunnelResult{
+				LinodeRebuildTunnelResult: &protoapi.LinodeRebuildTunnelResponse{},
+			}},
+		},
+		{
+			name: "DestroyTunnel",
+			call: func(p *providerLinode) (interface{}, error) { return nil, p.DestroyTunnel() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeDestroyTunnelResult{
+				LinodeDestroyTunnelResult: &protoapi.LinodeDestroyTunnelResponse{},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeDestroyTunnelResult{
+				LinodeDestroyTunnelResult: &protoapi.LinodeDestroyTunnelResponse{Error: testLinodeError()},
+			}},
+		},
+		{
+			name: "TunnelStatus",
+			call: func(p *providerLinode) (interface{}, error) { return p.TunnelStatus() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeTunnelStatusResult{
+				LinodeTunnelStatusResult: &protoapi.LinodeGetTunnelStatusResponse{Instance: testLinodeInstance()},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeTunnelStatusResult{
+				LinodeTunnelStatusResult: &protoapi.LinodeGetTunnelStatusResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeTunnelStatusResult{
+				LinodeTunnelStatusResult: &protoapi.LinodeGetTunnelStatusResponse{},
+			}},
+		},
+		{
+			name: "ListInstances",
+			call: func(p *providerLinode) (interface{}, error) { return p.ListInstances() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeListInstancesResult{
+				LinodeListInstancesResult: &protoapi.LinodeListInstancesResponse{
+					Instances: &protoapi.LinodeInstanceList{L: []*protoapi.LinodeInstance{testLinodeInstance()}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeListInstancesResult{
+				LinodeListInstancesResult: &protoapi.LinodeListInstancesResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeListInstancesResult{
+				LinodeListInstancesResult: &protoapi.LinodeListInstancesResponse{},
+			}},
+		},
+		{
+			name: "ListPlans",
+			call: func(p *providerLinode) (interface{}, error) { return p.ListPlans() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeListPlansResult{
+				LinodeListPlansResult: &protoapi.LinodeListPlansResponse{
+					Plans: &protoapi.LinodePlanList{L: []*protoapi.LinodePlan{
+						{Id: "g6-nanode-1", PriceHourly: 0.0075, NetworkOut: 1000, Vcpus: 1},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeListPlansResult{
+				LinodeListPlansResult: &protoapi.LinodeListPlansResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeListPlansResult{
+				LinodeListPlansResult: &protoapi.LinodeListPlansResponse{},
+			}},
+		},
+		{
+			name: "ListRegions",
+			call: func(p *providerLinode) (interface{}, error) { return p.ListRegions() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeListRegionsResult{
+				LinodeListRegionsResult: &protoapi.LinodeListRegionsResponse{
+					Regions: &protoapi.LinodeRegionList{L: []*protoapi.LinodeRegion{
+						{Id: "eu-central", Country: "de"},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeListRegionsResult{
+				LinodeListRegionsResult: &protoapi.LinodeListRegionsResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeListRegionsResult{
+				LinodeListRegionsResult: &protoapi.LinodeListRegionsResponse{},
+			}},
+		},
+		{
+			name: "ListImages",
+			call: func(p *providerLinode) (interface{}, error) { return p.ListImages() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeListImagesResult{
+				LinodeListImagesResult: &protoapi.LinodeListImagesResponse{
+					Images: &protoapi.LinodeImageList{L: []*protoapi.LinodeImage{
+						{Id: "linode/debian9", CreatedAt: "2017-06-16T20:02:29"},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeListImagesResult{
+				LinodeListImagesResult: &protoapi.LinodeListImagesResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeListImagesResult{
+				LinodeListImagesResult: &protoapi.LinodeListImagesResponse{},
+			}},
+		},
+		{
+			name: "ListStackScripts",
+			call: func(p *providerLinode) (interface{}, error) { return p.ListStackScripts() },
+			success: &protoapi.Response{R: &protoapi.Response_LinodeListStackscriptsResult{
+				LinodeListStackscriptsResult: &protoapi.LinodeListStackScriptsResponse{
+					Stackscripts: &protoapi.LinodeStackScriptList{L: []*protoapi.LinodeStackScript{
+						{Id: 1, Label: "holepuncher"},
+					}},
+				},
+			}},
+			failure: &protoapi.Response{R: &protoapi.Response_LinodeListStackscriptsResult{
+				LinodeListStackscriptsResult: &protoapi.LinodeListStackScriptsResponse{Error: testLinodeError()},
+			}},
+			empty: &protoapi.Response{R: &protoapi.Response_LinodeListStackscriptsResult{
+				LinodeListStackscriptsResult: &protoapi.LinodeListStackScriptsResponse{},
+			}},
+		},
+	}
+}
+
+func TestNewLinodeProviderValidation(t *testing.T) {
+	cases := map[string]func(o *programOptions){
+		"missing access token": func(o *programOptions) { o.LinodeParams.AccessToken = "" },
+		"missing plan":         func(o *programOptions) { o.LinodeParams.Plan = "" },
+		"missing region":       func(o *programOptions) { o.LinodeParams.Region = "" },
+		"invalid general":      func(o *programOptions) { o.Runtime.Provider = "" },
+	}
+	for name, mutate := range cases {
+		o := validTestOptions()
+		o.LinodeParams.AccessToken = "token"
+		o.LinodeParams.Region = "eu-central"
+		o.LinodeParams.Plan = "g6-nanode-1"
+		mutate(o)
+		_, err := newLinodeProvider(&fakeHolepuncherClient{}, o)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLinodeRPCSuccess(t *testing.T) {
+	for _, tc := range linodeRPCTestCases() {
+		client := &fakeHolepuncherClient{response: tc.success}
+		_, err := tc.call(newTestLinodeProvider(t, client))
+		assert.NoError(t, err, tc.name)
+		assert.Len(t, client.requests, 1, tc.name)
+	}
+}
+
+func TestLinodeRPCTransportError(t *testing.T) {
+	for _, tc := range linodeRPCTestCases() {
+		client := &fakeHolepuncherClient{err: errors.New("connection refused")}
+		result, err := tc.call(newTestLinodeProvider(t, client))
+		assert.EqualError(t, err, "connection refused", tc.name)
+		assert.Nil(t, result, tc.name)
+	}
+}
+
+func TestLinodeRPCUnexpectedResponse(t *testing.T) {
+	for _, tc := range linodeRPCTestCases() {
+		client := &fakeHolepuncherClient{response: &protoapi.Response{}}
+		_, err := tc.call(newTestLinodeProvider(t, client))
+		assert.Error(t, err, tc.name)
+		assert.Contains(t, err.Error(), "RPC bug", tc.name)
+	}
+}
+
+func TestLinodeRPCErrorDetails(t *testing.T) {
+	for _, tc := range linodeRPCTestCases() {
+		client := &fakeHolepuncherClient{response: tc.failure}
+		_, err := tc.call(newTestLinodeProvider(t, client))
+		assert.EqualError(t, err, "rpc method returned an error", tc.name)
+	}
+}
+
+func TestLinodeRPCBothEmpty(t *testing.T) {
+	for _, tc := range linodeRPCTestCases() {
+		if tc.empty == nil {
+			continue
+		}
+		client := &fakeHolepuncherClient{response: tc.empty}
+		_, err := tc.call(newTestLinodeProvider(t, client))
+		assert.Error(t, err, tc.name)
+		assert.Contains(t, err.Error(), "RPC bug", tc.name)
+	}
+}
+
+func TestLinodeCreateTunnel(t *testing.T) {
+	client := &fakeHolepuncherClient{response: linodeRPCTestCases()[0].success}
+	p := newTestLinodeProvider(t, client)
+
+	result, err := p.CreateTunnel()
+	require.NoError(t, err)
+	assert.Equal(t, providerTypeLinode, result.Instance.Provider)
+	assert.Equal(t, "holepuncher", result.Instance.Label)
+	assert.Equal(t, []string{"192.0.2.1"}, result.Instance.IPv4)
+	assert.Equal(t, []string{"2001:db8::1"}, result.Instance.IPv6)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), result.Instance.CreatedAt)
+	assert.Equal(t, creationParamsFromProgramOptions(p.options), result.CreationParams)
+
+	require.Len(t, client.requests, 1)
+	request := client.requests[0].GetLinodeCreateTunnel()
+	require.NotNil(t, request)
+	assert.Equal(t, "token", request.Auth.AccessToken)
+	assert.Equal(t, "eu-central", request.Region)
+	assert.Equal(t, "g6-nanode-1", request.Plan)
+	assert.Equal(t, "root-password", request.RootPassword)
+	assert.Equal(t, "user", request.RegularAccountName)
+	assert.Equal(t, "user-password", request.RegularAccountPassword)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA"}, request.SshKeys)
+	assert.Equal(t, uint32(55000), request.WireguardOptions.Port)
+	assert.Equal(t, uint32(56000), request.Obfsproxy4Options.Port)
+	assert.Equal(t, uint32(57000), request.Obfsproxy6Options.Port)
+}
+
+func TestLinodeCreateTunnelRequestOmitsDisabledServices(t *testing.T) {
+	p := newTestLinodeProvider(t, &fakeHolepuncherClient{})
+	p.options.WireGuard.Enable = false
+	p.options.ObfsproxyIPv4.Enable = false
+	p.options.ObfsproxyIPv6.Enable = false
+
+	request := p.createCreateTunnelRequest().GetLinodeCreateTunnel()
+	assert.Nil(t, request.WireguardOptions)
+	assert.Nil(t, request.Obfsproxy4Options)
+	assert.Nil(t, request.Obfsproxy6Options)
+}
+
+func TestLinodeListPlans(t *testing.T) {
+	client := &fakeHolepuncherClient{response: linodeRPCTestCases()[5].success}
+	plans, err := newTestLinodeProvider(t, client).ListPlans()
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+	assert.Equal(t, "g6-nanode-1", plans[0].ID)
+	assert.Equal(t, float32(0.0075), plans[0].PriceHourly)
+	assert.Equal(t, uint64(1000), plans[0].Bandwidth)
+	assert.Equal(t, uint(1), plans[0].Vcpus)
+}
+
+func TestLinodePlanPrice(t *testing.T) {
+	client := &fakeHolepuncherClient{response: linodeRPCTestCases()[5].success}
+	p := newTestLinodeProvider(t, client)
+	price, err := p.PlanPrice()
+	require.NoError(t, err)
+	assert.Equal(t, "g6-nanode-1", price.Plan)
+	assert.InDelta(t, 0.0075, price.Hourly, 1e-9)
+
+	p.options.LinodeParams.Plan = "g6-dedicated-2"
+	_, err = p.PlanPrice()
+	assert.Error(t, err)
+	assert.Nil(t, lookupPlanPrice(p))
+}
+
+func TestLinodeParseDate(t *testing.T) {
+	p := &providerLinode{}
+
+	d, err := p.parseDate("2018-06-01T12:00:00")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), d)
+
+	d, err = p.parseDate("2018-06-01T12:00:00+0200")
+	assert.NoError(t, err)
+	assert.True(t, d.Equal(time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)))
+
+	d, err = p.parseDate("garbage")
+	assert.Error(t, err)
+	assert.Equal(t, time.Unix(0, 0), d)
+}
+
+func TestLinodeTunnelStatusNotFound(t *testing.T) {
+	notFound := &protoapi.LinodeError{
+		Details: []*protoapi.LinodeErrorDetail{{Reason: "Not found"}},
+	}
+	cases := map[*protoapi.LinodeError]bool{
+		notFound:          true,
+		testLinodeError(): false,
+		{Error: &protoapi.Error{Message: "Invalid Token"}}: false,
+	}
+	for errObject, expected := range cases {
+		client := &fakeHolepuncherClient{response: &protoapi.Response{R: &protoapi.Response_LinodeTunnelStatusResult{
+			LinodeTunnelStatusResult: &protoapi.LinodeGetTunnelStatusResponse{Error: errObject},
+		}}}
+		_, err := newTestLinodeProvider(t, client).TunnelStatus()
+		assert.EqualError(t, err, "rpc method returned an error")
+		assert.Equal(t, expected, isTunnelNotFoundError(err))
+	}
+}
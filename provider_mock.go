@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mockServerAddress = "http://holepuncher-mock.invalid"
+	mockProtobufKey   = "6d6f636b6d6f636b6d6f636b6d6f636b6d6f636b6d6f636b6d6f636b6d6f636b"
+	mockAccessToken   = "mock-access-token"
+)
+
+// mockTransport routes HTTP requests to an in-process mock server, so that
+// no network access is needed.
+type mockTransport struct {
+	server *mockServer
+}
+
+func (t *mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.server.ServeHTTP(recorder, r)
+	response := recorder.Result()
+	response.Request = r
+	return response, nil
+}
+
+func mockStateFilename(runtimeDir string) string {
+	return path.Join(runtimeDir, "mock_state.json")
+}
+
+// applyMockDefaults fills settings that are irrelevant in mock mode, but are
+// required to pass validation.
+func applyMockDefaults(o *programOptions) {
+	if len(o.Runtime.ServerAddress) == 0 {
+		o.Runtime.ServerAddress = mockServerAddress
+	}
+	if len(o.ProtobufClient.ServerKey) == 0 {
+		o.ProtobufClient.ServerKey = mockProtobufKey
+	}
+	if len(o.ProtobufClient.PeerKey) == 0 {
+		o.ProtobufClient.PeerKey = mockProtobufKey
+	}
+	if len(o.MockParams.Backend) == 0 {
+		o.MockParams.Backend = providerTypeLinode.String()
+	}
+
+	if len(o.LinodeParams.AccessToken) == 0 {
+		o.LinodeParams.AccessToken = mockAccessToken
+	}
+	if len(o.LinodeParams.Region) == 0 {
+		o.LinodeParams.Region = "eu-central"
+	}
+	if len(o.LinodeParams.Plan) == 0 {
+		o.LinodeParams.Plan = "g6-nanode-1"
+	}
+	if len(o.DigitalOceanParams.AccessToken) == 0 {
+		o.DigitalOceanParams.AccessToken = mockAccessToken
+	}
+	if len(o.DigitalOceanParams.Region) == 0 {
+		o.DigitalOceanParams.Region = "ams3"
+	}
+	if len(o.DigitalOceanParams.Plan) == 0 {
+		o.DigitalOceanParams.Plan = "s-1vcpu-1gb"
+	}
+}
+
+func newMockHTTPClient(options *programOptions) (*http.Client, error) {
+	server, err := newMockServer(options, mockStateFilename(options.Runtime.RuntimeDir))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &mockTransport{server: server}}, nil
+}
+
+// newMockProvider returns the provider selected by provider_mock.backend
+// wired to an in-process mock server.
+func newMockProvider(client aHolepuncherClient, options *programOptions) (aCloudProvider, error) {
+	switch options.MockParams.Backend {
+	case providerTypeLinode.String():
+		return newLinodeProvider(client, options)
+	case providerTypeDigitalOcean.String():
+		return newDigitalOceanProvider(client, options)
+	default:
+		log.WithField("backend", options.MockParams.Backend).Error("Mock backend is not supported")
+		return nil, errors.New("unsupported mock backend")
+	}
+}
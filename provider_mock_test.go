@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMockOptions(t *testing.T, backend string) *programOptions {
+	o := validTestOptions()
+	o.Runtime.Provider = providerTypeMock.String()
+	o.Runtime.RuntimeDir = tempRuntimeDir(t)
+	o.MockParams.Backend = backend
+	applyMockDefaults(o)
+	return o
+}
+
+// newTestMockClient returns client talking to mock server through mock
+// transport. Backoff delays are recorded instead of slept.
+func newTestMockClient(t *testing.T, o *programOptions) (*holepuncherClient, *[]time.Duration) {
+	server, err := newMockServer(o, mockStateFilename(o.Runtime.RuntimeDir))
+	require.NoError(t, err)
+	client, err := newHolepuncherClient(o, &http.Client{Transport: &mockTransport{server: server}})
+	require.NoError(t, err)
+	delays := &[]time.Duration{}
+	client.sleep = func(d time.Duration) { *delays = append(*delays, d) }
+	return client, delays
+}
+
+func newTestMockProvider(t *testing.T, o *programOptions) (aCloudProvider, *[]time.Duration) {
+	client, delays := newTestMockClient(t, o)
+	provider, err := newMockProvider(client, o)
+	require.NoError(t, err)
+	return provider, delays
+}
+
+func TestMockProviderLifecycle(t *testing.T) {
+	for _, backend := range []providerType{providerTypeLinode, providerTypeDigitalOcean} {
+		o := testMockOptions(t, backend.String())
+		provider, delays := newTestMockProvider(t, o)
+
+		result, err := provider.CreateTunnel()
+		require.NoError(t, err, backend.String())
+		assert.Equal(t, "holepuncher-mock-1", result.Instance.Label)
+		assert.NotEmpty(t, result.Instance.IPv4)
+		_, err = provider.CreateTunnel()
+		assert.Error(t, err, "tunnel already exists")
+
+		// State is shared by separate invocations.
+		provider, _ = newTestMockProvider(t, o)
+		status, err := provider.TunnelStatus()
+		require.NoError(t, err)
+		assert.Equal(t, result.Instance.Label, status.Label)
+		assert.Equal(t, result.Instance.IPv4, status.IPv4)
+
+		require.NoError(t, provider.DestroyTunnel())
+		_, err = provider.TunnelStatus()
+		assert.True(t, isTunnelNotFoundError(err), backend.String())
+		assert.Error(t, provider.DestroyTunnel())
+		assert.Empty(t, *delays)
+	}
+}
+
+func TestMockProviderFailingCreate(t *testing.T) {
+	o := testMockOptions(t, providerTypeLinode.String())
+	o.MockParams.Fail = []string{"LinodeCreateTunnel"}
+	provider, _ := newTestMockProvider(t, o)
+
+	_, err := provider.CreateTunnel()
+	require.Error(t, err)
+	assert.False(t, isAmbiguousRPCError(err))
+	_, err = provider.TunnelStatus()
+	assert.True(t, isTunnelNotFoundError(err), "nothing must be created")
+
+	o = testMockOptions(t, providerTypeLinode.String())
+	o.MockParams.FailHTTP = []string{"LinodeCreateTunnel"}
+	provider, delays := newTestMockProvider(t, o)
+	_, err = provider.CreateTunnel()
+	require.Error(t, err)
+	assert.False(t, isAmbiguousRPCError(err), "server answered")
+	assert.Empty(t, *delays, "create is not retried")
+	_, err = provider.TunnelStatus()
+	assert.True(t, isTunnelNotFoundError(err))
+}
+
+func TestNewMockProviderBackend(t *testing.T) {
+	o := testMockOptions(t, "vultr")
+	client, _ := newTestMockClient(t, o)
+	_, err := newMockProvider(client, o)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"protoapi"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHolepuncherClient replies to every request with a canned response and
+// records requests it has seen.
+type fakeHolepuncherClient struct {
+	response *protoapi.Response
+	err      error
+	requests []*protoapi.Request
+}
+
+func (c *fakeHolepuncherClient) DoRequest(m *protoapi.Request) (*protoapi.Response, error) {
+	c.requests = append(c.requests, m)
+	return c.response, c.err
+}
+
+func TestCreationParamsFromProgramOptions(t *testing.T) {
+	o := validTestOptions()
+	o.NormalUser.UserName = "user"
+	o.NormalUser.Password = "secret"
+
+	params := creationParamsFromProgramOptions(o)
+	assert.Equal(t, "user", params.RegularUserName)
+	assert.Equal(t, "secret", params.RegularUserPassword)
+	assert.True(t, params.WireGuardEnabled)
+	assert.Equal(t, o.WireGuard.ServerKey, params.WireGuardServerKey)
+	assert.Equal(t, o.WireGuard.PeerKeys, params.WireGuardPeerKeys)
+	assert.Equal(t, o.WireGuard.Port, params.WireGuardPort)
+	assert.True(t, params.ObfsproxyIPv4Enabled)
+	assert.Equal(t, o.ObfsproxyIPv4.Secret, params.ObfsproxyIPv4Secret)
+	assert.Equal(t, o.ObfsproxyIPv4.Port, params.ObfsproxyIPv4Port)
+	assert.True(t, params.ObfsproxyIPv6Enabled)
+	assert.Equal(t, o.ObfsproxyIPv6.Secret, params.ObfsproxyIPv6Secret)
+	assert.Equal(t, o.ObfsproxyIPv6.Port, params.ObfsproxyIPv6Port)
+}
+
+func TestCreationParamsFromProgramOptionsSkipsDisabledServices(t *testing.T) {
+	o := validTestOptions()
+	o.WireGuard.Enable = false
+	o.ObfsproxyIPv4.Enable = false
+	o.ObfsproxyIPv6.Enable = false
+
+	params := creationParamsFromProgramOptions(o)
+	assert.False(t, params.WireGuardEnabled)
+	assert.Empty(t, params.WireGuardServerKey)
+	assert.Empty(t, params.WireGuardPeerKeys)
+	assert.Zero(t, params.WireGuardPort)
+	assert.False(t, params.ObfsproxyIPv4Enabled)
+	assert.Empty(t, params.ObfsproxyIPv4Secret)
+	assert.Zero(t, params.ObfsproxyIPv4Port)
+	assert.False(t, params.ObfsproxyIPv6Enabled)
+	assert.Empty(t, params.ObfsproxyIPv6Secret)
+	assert.Zero(t, params.ObfsproxyIPv6Port)
+}
+
+func TestProviderTypeString(t *testing.T) {
+	assert.Equal(t, "linode", providerTypeLinode.String())
+	assert.Equal(t, "digital_ocean", providerTypeDigitalOcean.String())
+	assert.Equal(t, "mock", providerTypeMock.String())
+	assert.Equal(t, "42 (unsupported)", providerType(42).String())
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// tunnelRotator replaces tunnel of a session with one that has new
+// addresses.
+//
+// Holepuncher server identifies tunnels by provider account, so replacement
+// has to be created in another account before the current tunnel can be
+// destroyed. Session alternates between its own profile and a spare one.
+type tunnelRotator struct {
+	// Options of the current tunnel.
+	current *programOptions
+	// Returns options with session's own profile applied.
+	loadOptions func() (*programOptions, error)
+	newProvider func(options *programOptions) (aCloudProvider, error)
+	wait        func(provider aCloudProvider, params *tunnelCreationParams) (*tunnelInstance, error)
+	now         func() time.Time
+}
+
+// providerAccount identifies provider account the options refer to.
+func providerAccount(o *programOptions) string {
+	switch o.Runtime.Provider {
+	case providerTypeLinode.String():
+		return o.Runtime.Provider + ":" + o.LinodeParams.AccessToken
+	case providerTypeDigitalOcean.String():
+		return o.Runtime.Provider + ":" + o.DigitalOceanParams.AccessToken
+	case providerTypeMock.String():
+		return o.Runtime.Provider + ":" + o.MockParams.Backend
+	default:
+		return o.Runtime.Provider
+	}
+}
+
+// targetOptions returns options and profile name replacement tunnel should
+// be created with.
+func (r *tunnelRotator) targetOptions(cache *sessionCache, spare string) (*programOptions, string, error) {
+	profile := spare
+	if cache.Profile == spare {
+		profile = ""
+	}
+
+	options, err := r.loadOptions()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(profile) > 0 && !applyProfile(options, profile) {
+		return nil, "", logConfigurationError("rotation: spare profile does not exist",
+			log.Fields{"profile": profile})
+	}
+	options.CachedProfile = profile
+	if providerAccount(options) == providerAccount(r.current) {
+		return nil, "", logConfigurationError(
+			"rotation: spare profile must use another provider or access token",
+			log.Fields{"profile": spare})
+	}
+	return options, profile, nil
+}
+
+// Rotate creates replacement tunnel, waits until it's reachable, switches
+// session to it and only then destroys the current tunnel.
+func (r *tunnelRotator) Rotate(spare string) error {
+	cache, err := restoreSessionCache(r.current)
+	if err != nil {
+		return err
+	}
+	target, profile, err := r.targetOptions(cache, spare)
+	if err != nil {
+		return err
+	}
+	currentProvider, err := r.newProvider(r.current)
+	if err != nil {
+		return err
+	}
+	targetProvider, err := r.newProvider(target)
+	if err != nil {
+		return err
+	}
+
+	fields := log.Fields{
+		"session":  exportSessionName(r.current),
+		"provider": target.Runtime.Provider,
+	}
+	if len(profile) > 0 {
+		fields["profile"] = profile
+	}
+	log.WithFields(fields).Info("Creating replacement tunnel")
+	started := r.now()
+	replacement := &sessionCache{
+		ExpiresAt:    cache.ExpiresAt,
+		LastActivity: cache.LastActivity,
+		Price:        lookupPlanPrice(targetProvider),
+		Profile:      profile,
+	}
+	// Replacement inherits expiry of the current tunnel.
+	ttl := time.Duration(0)
+	if cache.ExpiresAt != nil {
+		ttl = cache.ExpiresAt.Sub(started)
+	}
+	if err = checkTunnelBudget(targetProvider, target, replacement.Price, ttl, started); err != nil {
+		return err
+	}
+	replacement.Region, replacement.Plan = tunnelPlacement(target)
+	result, err := targetProvider.CreateTunnel()
+	if err == nil || isAmbiguousRPCError(err) {
+		// Selection policy may have fallen back to another region and plan.
+		replacement.Region, replacement.Plan = tunnelPlacement(target)
+		replacement.Price = createdPlanPrice(targetProvider, target, replacement.Price)
+	}
+	if isAmbiguousRPCError(err) {
+		if instance, findErr := findCreatedTunnel(targetProvider, started, err); findErr == nil {
+			log.WithField("label", instance.Label).Warning(
+				"Replacement tunnel exists despite the error, using it")
+			result = &createTunnelResult{
+				CreationParams: creationParamsFromProgramOptions(target),
+				Instance:       *instance,
+			}
+			err = nil
+		}
+	}
+	if err != nil {
+		appendHistory(target, newHistoryRecord(target, historyActionRotate, replacement, started, r.now(), err))
+		if isAmbiguousRPCError(err) {
+			log.WithFields(fields).Warning("Replacement tunnel may have been created anyway " +
+				"and has to be destroyed manually")
+		}
+		log.Error("Unable to create replacement tunnel, keeping current one")
+		return err
+	}
+
+	replacement.InstanceInfo = &result.Instance
+	replacement.CreationParams = &result.CreationParams
+	instance, err := r.wait(targetProvider, replacement.CreationParams)
+	if err != nil {
+		appendHistory(target, newHistoryRecord(target, historyActionRotate, replacement, started, r.now(), err))
+		log.Error("Replacement tunnel is not reachable, destroying it")
+		destroyStarted := r.now()
+		destroyErr := targetProvider.DestroyTunnel()
+		appendHistory(target, newDestroyHistoryRecord(target, replacement, destroyStarted, r.now(), destroyErr))
+		if destroyErr != nil {
+			log.WithField("label", result.Instance.Label).Error(
+				"Unable to destroy replacement tunnel, it has to be destroyed manually")
+		}
+		return err
+	}
+	if instance != nil {
+		replacement.InstanceInfo.IPv4 = instance.IPv4
+		replacement.InstanceInfo.IPv6 = instance.IPv6
+	}
+	if err = saveSessionCache(replacement, r.current); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"label": replacement.InstanceInfo.Label,
+		"ipv4":  replacement.InstanceInfo.IPv4,
+		"ipv6":  replacement.InstanceInfo.IPv6,
+	}).Info("Session switched to replacement tunnel")
+	appendHistory(target, newHistoryRecord(target, historyActionRotate, replacement, started, r.now(), nil))
+	// Session belongs to the replacement from now on, whatever happens to
+	// the previous tunnel.
+	previous := r.current
+	r.current = target
+
+	destroyStarted := r.now()
+	err = currentProvider.DestroyTunnel()
+	// Failed destroy is recorded in history, which is where the user learns
+	// about the tunnel left behind. Session doesn't track it anymore, so its
+	// cost so far is recorded either way.
+	record := newDestroyHistoryRecord(previous, cache, destroyStarted, r.now(), err)
+	record.setCost(cache)
+	appendHistory(previous, record)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"label":    cache.InstanceInfo.Label,
+			"provider": previous.Runtime.Provider,
+			"profile":  cache.Profile,
+		}).Error("Session was switched, but previous tunnel could not be destroyed and " +
+			"keeps running, destroy it manually")
+		return err
+	}
+	log.WithField("label", cache.InstanceInfo.Label).Info("Previous tunnel was destroyed")
+	return nil
+}
+
+// Rebuild reinstalls tunnel in place. Addresses are kept, so this is only
+// useful when they are not blocked.
+func (r *tunnelRotator) Rebuild() error {
+	cache, err := restoreSessionCache(r.current)
+	if err != nil {
+		return err
+	}
+	provider, err := r.newProvider(r.current)
+	if err != nil {
+		return err
+	}
+	rebuildable, ok := provider.(aRebuildableCloudProvider)
+	if !ok {
+		log.WithField("provider", r.current.Runtime.Provider).Error(
+			"Provider does not support rebuilding tunnels")
+		return errors.New("rebuild is not supported")
+	}
+
+	log.Warning("Rebuilding tunnel in place, its addresses are kept")
+	started := r.now()
+	result, err := rebuildable.RebuildTunnel()
+	if err != nil {
+		appendHistory(r.current, newHistoryRecord(r.current, historyActionRebuild, cache, started, r.now(), err))
+	}
+	if isAmbiguousRPCError(err) {
+		return reconcileRebuiltTunnel(provider, err)
+	} else if err != nil {
+		return err
+	}
+
+	rebuilt := &sessionCache{
+		InstanceInfo:   &result.Instance,
+		CreationParams: &result.CreationParams,
+		ExpiresAt:      cache.ExpiresAt,
+		LastActivity:   cache.LastActivity,
+		Price:          cache.Price,
+		Profile:        cache.Profile,
+		Region:         cache.Region,
+		Plan:           cache.Plan,
+	}
+	appendHistory(r.current, newHistoryRecord(r.current, historyActionRebuild, rebuilt, started, r.now(), nil))
+	if err = saveSessionCache(rebuilt, r.current); err != nil {
+		return err
+	}
+	instance, err := r.wait(provider, rebuilt.CreationParams)
+	if instance != nil {
+		rebuilt.InstanceInfo.IPv4 = instance.IPv4
+		rebuilt.InstanceInfo.IPv6 = instance.IPv6
+		if saveErr := saveSessionCache(rebuilt, r.current); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+func handleRotateCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	if err = verifySessionCacheIsWritable(options.Runtime.RuntimeDir); err != nil {
+		return err
+	}
+	spare := c.String("spare-profile")
+	if !c.Bool("rebuild") && len(spare) == 0 {
+		return logConfigurationError("rotation: --spare-profile is required unless --rebuild is used")
+	}
+	// Replacement that can't be verified would always be destroyed.
+	params := creationParamsFromProgramOptions(options)
+	if !c.Bool("rebuild") && !tunnelReadinessCanBeVerified(options, &params) {
+		return logConfigurationError("rotation: readiness of replacement tunnel can't be verified, " +
+			"configure wireguard_client.private_key_files or enable obfsproxy")
+	}
+
+	rotator := &tunnelRotator{
+		current: options,
+		loadOptions: func() (*programOptions, error) {
+			loaded, err := newProgramOptions(c.GlobalString("config"))
+			if err != nil {
+				return nil, err
+			}
+			return loaded, applySessionProfile(loaded, options.Session)
+		},
+		newProvider: newCloudProviderFromOptions,
+		wait: func(provider aCloudProvider, params *tunnelCreationParams) (*tunnelInstance, error) {
+			waiter := newTunnelWaiter(provider, options, c.Duration("wait-timeout"), c.Duration("wait-interval"))
+			return waiter.Wait(params)
+		},
+		now: time.Now,
+	}
+	rotate := func() error {
+		// Options of the current tunnel change with every rotation.
+		lock, err := lockSessionFromContext(c, rotator.current)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+
+		if c.Bool("rebuild") {
+			return rotator.Rebuild()
+		}
+		return rotator.Rotate(spare)
+	}
+
+	every := c.Duration("every")
+	if every <= 0 {
+		return rotate()
+	}
+	log.WithField("every", every).Info("Rotating tunnel on schedule")
+	for {
+		if err = rotate(); err != nil {
+			log.WithField("cause", err).Warning("Rotation failed, will retry on next schedule")
+		}
+		time.Sleep(every)
+	}
+}
+
+func rotateCommand() cli.Command {
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "spare-profile",
+			Usage: "create replacement tunnel using provider account from `PROFILE`",
+		},
+		cli.BoolFlag{
+			Name:  "rebuild",
+			Usage: "rebuild tunnel in place instead, keeping its addresses",
+		},
+		cli.DurationFlag{
+			Name:  "every",
+			Usage: "keep running and rotate tunnel every `DURATION`",
+		},
+	}
+	return cli.Command{
+		Name:   "rotate",
+		Usage:  "replace tunnel with a new one with different addresses",
+		Action: handleRotateCommand,
+		Flags:  append(flags, waitTimingFlags()...),
+	}
+}
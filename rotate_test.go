@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRebuildableProvider struct {
+	fakeCloudProvider
+	rebuildResult *rebuildTunnelResult
+	rebuildErr    error
+}
+
+func (p *fakeRebuildableProvider) RebuildTunnel() (*rebuildTunnelResult, error) {
+	return p.rebuildResult, p.rebuildErr
+}
+
+func testRotationOptions(t *testing.T) *programOptions {
+	o := testSessionOptions(t, "")
+	o.Runtime.Provider = providerTypeLinode.String()
+	o.LinodeParams.AccessToken = "primary"
+	o.Profiles = map[string]profileOptions{"spare": {}}
+	spare := o.Profiles["spare"]
+	spare.LinodeParams.AccessToken = "spare"
+	o.Profiles["spare"] = spare
+	return o
+}
+
+// newTestTunnelRotator returns rotator with a fake provider per access
+// token.
+func newTestTunnelRotator(
+	t *testing.T,
+	providers map[string]aCloudProvider,
+	waitErr error,
+) *tunnelRotator {
+	options := testRotationOptions(t)
+	return &tunnelRotator{
+		current: options,
+		loadOptions: func() (*programOptions, error) {
+			copied := *testRotationOptions(t)
+			copied.Runtime.RuntimeDir = options.Runtime.RuntimeDir
+			return &copied, nil
+		},
+		newProvider: func(o *programOptions) (aCloudProvider, error) {
+			return providers[o.LinodeParams.AccessToken], nil
+		},
+		wait: func(p aCloudProvider, params *tunnelCreationParams) (*tunnelInstance, error) {
+			return nil, waitErr
+		},
+		now: func() time.Time { return time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC) },
+	}
+}
+
+func testReplacementResult() *createTunnelResult {
+	replacement := testSessionCache()
+	replacement.InstanceInfo.Label = "replacement"
+	replacement.InstanceInfo.IPv4 = []string{"192.0.2.2"}
+	return &createTunnelResult{
+		CreationParams: *replacement.CreationParams,
+		Instance:       *replacement.InstanceInfo,
+	}
+}
+
+func TestTunnelRotatorRotate(t *testing.T) {
+	primary := &fakeCloudProvider{}
+	spare := &fakeCloudProvider{createResult: testReplacementResult()}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary, "spare": spare}, nil)
+	current := testSessionCache()
+	setSessionTTL(current, 10*time.Hour, current.InstanceInfo.CreatedAt)
+	require.NoError(t, saveSessionCache(current, r.current))
+
+	require.NoError(t, r.Rotate("spare"))
+	assert.Equal(t, 1, spare.createCalls)
+	assert.Equal(t, 1, primary.destroyCalls)
+	assert.Equal(t, 0, spare.destroyCalls)
+
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "replacement", cache.InstanceInfo.Label)
+	assert.Equal(t, "spare", cache.Profile)
+	assert.Equal(t, current.ExpiresAt.Unix(), cache.ExpiresAt.Unix())
+	assert.Equal(t, "spare", r.current.LinodeParams.AccessToken)
+
+	// Next rotation goes back to session's own profile.
+	primary.createResult = testReplacementResult()
+	require.NoError(t, r.Rotate("spare"))
+	assert.Equal(t, 1, primary.createCalls)
+	assert.Equal(t, 1, spare.destroyCalls)
+	cache, err = restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "", cache.Profile)
+}
+
+func TestTunnelRotatorKeepsCurrentTunnelOnFailure(t *testing.T) {
+	primary := &fakeCloudProvider{}
+	spare := &fakeCloudProvider{createResult: testReplacementResult()}
+	providers := map[string]aCloudProvider{"primary": primary, "spare": spare}
+	r := newTestTunnelRotator(t, providers, errors.New("timed out waiting for tunnel"))
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	assert.Error(t, r.Rotate("spare"))
+	assert.Equal(t, 1, spare.destroyCalls)
+	assert.Equal(t, 0, primary.destroyCalls)
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "holepuncher", cache.InstanceInfo.Label)
+
+	spare.createErr = errors.New("rpc method returned an error")
+	assert.Error(t, r.Rotate("spare"))
+	assert.Equal(t, 0, primary.destroyCalls)
+}
+
+func TestTunnelRotatorChecksBudget(t *testing.T) {
+	primary := &fakeCloudProvider{}
+	spare := &fakePricedProvider{
+		fakeCloudProvider: fakeCloudProvider{createResult: testReplacementResult()},
+		price:             &tunnelPrice{Plan: "g6-standard-1", Hourly: 0.015},
+	}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary, "spare": spare}, nil)
+	r.current.Budget.Monthly = 1
+	r.current.Budget.Action = budgetActionRefuse
+	loadOptions := r.loadOptions
+	r.loadOptions = func() (*programOptions, error) {
+		o, err := loadOptions()
+		o.Budget = r.current.Budget
+		return o, err
+	}
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	assert.EqualError(t, r.Rotate("spare"), "budget exceeded")
+	assert.Equal(t, 0, spare.createCalls)
+	assert.NotNil(t, spare.budgetCheck, "plans tried at create time must be checked")
+
+	r.current.Budget.Monthly = 100
+	require.NoError(t, r.Rotate("spare"))
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "g6-standard-1", cache.Price.Plan)
+}
+
+// fallbackProvider creates tunnel in another region than configured, like
+// selection policy does.
+type fallbackProvider struct {
+	fakeCloudProvider
+	options *programOptions
+}
+
+func (p *fallbackProvider) CreateTunnel() (*createTunnelResult, error) {
+	p.options.LinodeParams.Region = "eu-central"
+	p.options.LinodeParams.Plan = "g6-standard-1"
+	return p.fakeCloudProvider.CreateTunnel()
+}
+
+func TestTunnelRotatorRecordsFallbackPlacement(t *testing.T) {
+	primary := &fakeCloudProvider{}
+	spare := &fallbackProvider{fakeCloudProvider: fakeCloudProvider{createResult: testReplacementResult()}}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary}, nil)
+	r.newProvider = func(o *programOptions) (aCloudProvider, error) {
+		if o.LinodeParams.AccessToken == "spare" {
+			o.LinodeParams.Region = "eu-west"
+			spare.options = o
+			return spare, nil
+		}
+		return primary, nil
+	}
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	require.NoError(t, r.Rotate("spare"))
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-central", cache.Region)
+	assert.Equal(t, "g6-standard-1", cache.Plan)
+	records, err := loadHistory(r.current.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, records)
+	assert.Equal(t, "eu-central", records[0].Region)
+}
+
+func TestTunnelRotatorSwitchesSessionWhenDestroyFails(t *testing.T) {
+	primary := &fakeCloudProvider{destroyErr: errors.New("rpc method returned an error")}
+	spare := &fakeCloudProvider{createResult: testReplacementResult()}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary, "spare": spare}, nil)
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	assert.Error(t, r.Rotate("spare"))
+	assert.Equal(t, "spare", r.current.LinodeParams.AccessToken)
+	records, err := loadHistory(r.current.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, historyActionDestroy, records[1].Action)
+	assert.Equal(t, historyOutcomeFailed, records[1].Outcome)
+	assert.Equal(t, "holepuncher", records[1].Label)
+
+	// Scheduled rotation carries on from the replacement.
+	primary.createResult = testReplacementResult()
+	require.NoError(t, r.Rotate("spare"))
+	assert.Equal(t, 1, spare.destroyCalls)
+}
+
+func TestTunnelRotatorReconcilesAmbiguousCreate(t *testing.T) {
+	primary := &fakeCloudProvider{}
+	created := testReplacementResult().Instance
+	created.CreatedAt = time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC)
+	spare := &fakeCloudProvider{
+		createErr: &transportError{cause: errors.New("timeout")},
+		status:    &created,
+	}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary, "spare": spare}, nil)
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	require.NoError(t, r.Rotate("spare"))
+	assert.Equal(t, 1, primary.destroyCalls)
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "replacement", cache.InstanceInfo.Label)
+
+	// Tunnel that existed before the request is not the replacement.
+	r = newTestTunnelRotator(t, map[string]aCloudProvider{"primary": primary, "spare": spare}, nil)
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+	created.CreatedAt = created.CreatedAt.Add(-time.Hour)
+	assert.Error(t, r.Rotate("spare"))
+	assert.Equal(t, 1, primary.destroyCalls)
+	assert.Equal(t, "primary", r.current.LinodeParams.AccessToken)
+}
+
+func TestTunnelRotatorRequiresAnotherAccount(t *testing.T) {
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{}, nil)
+	require.NoError(t, saveSessionCache(testSessionCache(), r.current))
+
+	assert.Error(t, r.Rotate("missing"))
+	r.current.Profiles["same"] = profileOptions{}
+	r.loadOptions = func() (*programOptions, error) {
+		copied := *r.current
+		return &copied, nil
+	}
+	assert.Error(t, r.Rotate("same"))
+}
+
+func TestTunnelRotatorRebuild(t *testing.T) {
+	rebuilt := testReplacementResult()
+	provider := &fakeRebuildableProvider{rebuildResult: &rebuildTunnelResult{
+		CreationParams: rebuilt.CreationParams,
+		Instance:       rebuilt.Instance,
+	}}
+	r := newTestTunnelRotator(t, map[string]aCloudProvider{"primary": provider}, nil)
+	current := testSessionCache()
+	current.Price = testTunnelPrice
+	require.NoError(t, saveSessionCache(current, r.current))
+
+	require.NoError(t, r.Rebuild())
+	cache, err := restoreSessionCache(r.current)
+	require.NoError(t, err)
+	assert.Equal(t, "replacement", cache.InstanceInfo.Label)
+	assert.Equal(t, testTunnelPrice, cache.Price)
+
+	r = newTestTunnelRotator(t, map[string]aCloudProvider{"primary": &fakeCloudProvider{}}, nil)
+	require.NoError(t, saveSessionCache(current, r.current))
+	assert.Error(t, r.Rebuild())
+}
+
+func TestApplyCachedProfile(t *testing.T) {
+	o := testRotationOptions(t)
+	require.NoError(t, applyCachedProfile(o))
+	assert.Equal(t, "primary", o.LinodeParams.AccessToken)
+
+	cache := testSessionCache()
+	cache.Profile = "spare"
+	require.NoError(t, saveSessionCache(cache, o))
+	require.NoError(t, applyCachedProfile(o))
+	assert.Equal(t, "spare", o.LinodeParams.AccessToken)
+}
@@ -2,24 +2,105 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 type sessionCache struct {
 	InstanceInfo   *tunnelInstance       `json:"instance_info"`
 	CreationParams *tunnelCreationParams `json:"creation_params"`
+
+	// Tunnel is destroyed by `watch` after this moment.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Last time the tunnel was reported to be in use.
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	// Price of the plan at creation time, if provider reported it.
+	Price *tunnelPrice `json:"price,omitempty"`
+	// Profile the tunnel was created with when it's not the session's own,
+	// e.g. after rotation into a spare account.
+	Profile string `json:"profile,omitempty"`
+	// Region and plan the tunnel was created with.
+	Region string `json:"region,omitempty"`
+	Plan   string `json:"plan,omitempty"`
+}
+
+const defaultSessionName = "default"
+
+// sessionSummary is a brief description of a session for listing.
+type sessionSummary struct {
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+	Label     string    `json:"label"`
+	IPv4      []string  `json:"ipv4"`
+	IPv6      []string  `json:"ipv6"`
+	CreatedAt time.Time `json:"created_at"`
+	// Why session cache couldn't be read.
+	Error string `json:"error,omitempty"`
+}
+
+// sessionNamePattern restricts session names to characters that are safe
+// to use in file names.
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// sessionCacheFilename returns path to session cache. Default session is
+// stored in session.json for compatibility with older versions, named
+// sessions are stored in session-<name>.json.
+func sessionCacheFilename(runtimeDir string, session string) string {
+	if len(session) == 0 || session == defaultSessionName {
+		return path.Join(runtimeDir, "session.json")
+	}
+	return path.Join(runtimeDir, "session-"+session+".json")
 }
 
-func sessionCacheFilename(runtimeDir string) string {
-	return path.Join(runtimeDir, "session.json")
+func validateSessionName(session string) error {
+	if len(session) > 0 && !sessionNamePattern.MatchString(session) {
+		return logConfigurationError("invalid session name", log.Fields{"session": session})
+	}
+	return nil
+}
+
+// listSessions returns names of sessions that have a cache file in runtime
+// dir.
+func listSessions(runtimeDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(runtimeDir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"dir":   runtimeDir,
+		}).Error("Couldn't list runtime directory")
+		return nil, err
+	}
+
+	sessions := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if name == "session.json" {
+			sessions = append(sessions, defaultSessionName)
+		} else if strings.HasPrefix(name, "session-") {
+			session := strings.TrimSuffix(strings.TrimPrefix(name, "session-"), ".json")
+			if sessionNamePattern.MatchString(session) {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	sort.Strings(sessions)
+	return sessions, nil
 }
 
-func restoreSessionCache(runtimeDir string) (*sessionCache, error) {
-	filename := sessionCacheFilename(runtimeDir)
-	sessionFile, err := os.Open(filename)
+func restoreSessionCache(options *programOptions) (*sessionCache, error) {
+	filename := sessionCacheFilename(options.Runtime.RuntimeDir, options.Session)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"cause":    err,
@@ -27,12 +108,15 @@ func restoreSessionCache(runtimeDir string) (*sessionCache, error) {
 		}).Error("Error opening file for reading")
 		return nil, err
 	}
-	defer sessionFile.Close()
+	if data, err = decryptSessionCache(data, options); err != nil {
+		return nil, err
+	}
+	if data, err = migrateSessionCache(data); err != nil {
+		return nil, err
+	}
 
 	result := &sessionCache{}
-	decoder := json.NewDecoder(sessionFile)
-	err = decoder.Decode(result)
-	if err != nil {
+	if err = json.Unmarshal(data, result); err != nil {
 		log.WithFields(log.Fields{
 			"cause":    err,
 			"filename": filename,
@@ -42,9 +126,26 @@ func restoreSessionCache(runtimeDir string) (*sessionCache, error) {
 	return result, nil
 }
 
-func saveSessionCache(cache *sessionCache, runtimeDir string) error {
-	filename := sessionCacheFilename(runtimeDir)
-	sessionFile, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// saveSessionCache replaces session cache atomically. The file is readable
+// by owner only, since it contains passwords and keys.
+func saveSessionCache(cache *sessionCache, options *programOptions) error {
+	versioned := &versionedSessionCache{Version: sessionCacheVersion, sessionCache: cache}
+	data, err := json.MarshalIndent(versioned, "", "\t")
+	if err != nil {
+		log.WithField("cause", err).Error("Error saving session cache")
+		return err
+	}
+	if data, err = encryptSessionCache(append(data, '\n'), options); err != nil {
+		return err
+	}
+	filename := sessionCacheFilename(options.Runtime.RuntimeDir, options.Session)
+	return writeFileAtomic(filename, data, 0600)
+}
+
+// writeFileAtomic writes data to temporary file in the same directory and
+// renames it over filename, so that readers never see partial data.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".tmp-")
 	if err != nil {
 		log.WithFields(log.Fields{
 			"cause": err,
@@ -52,19 +153,70 @@ func saveSessionCache(cache *sessionCache, runtimeDir string) error {
 		}).Error("Error opening file for writing")
 		return err
 	}
-	defer sessionFile.Close()
+	defer os.Remove(tmp.Name())
 
-	encoder := json.NewEncoder(sessionFile)
-	encoder.SetIndent("", "\t")
-	if err = encoder.Encode(cache); err != nil {
-		log.WithField("cause", err).Error("Error saving session cache")
+	if err = tmp.Chmod(perm); err == nil {
+		if _, err = tmp.Write(data); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"path":  filename,
+		}).Error("Error writing file")
+		return err
+	}
+	return nil
+}
+
+// inheritSessionState copies bookkeeping state of the session that doesn't
+// come from provider from previous cache, e.g. when the tunnel is rebuilt.
+func inheritSessionState(cache *sessionCache, previous *sessionCache) {
+	if previous == nil {
+		return
+	}
+	cache.ExpiresAt = previous.ExpiresAt
+	cache.LastActivity = previous.LastActivity
+	cache.Price = previous.Price
+	cache.Profile = previous.Profile
+	cache.Region = previous.Region
+	cache.Plan = previous.Plan
+}
+
+// applyCachedProfile applies profile recorded in session cache, so that
+// commands reach the account the tunnel actually lives in.
+func applyCachedProfile(o *programOptions) error {
+	cache, err := restoreSessionCacheIfExists(o)
+	if err != nil || cache == nil || len(cache.Profile) == 0 {
 		return err
 	}
+	o.CachedProfile = cache.Profile
+	if !applyProfile(o, cache.Profile) {
+		log.WithField("profile", cache.Profile).Warning(
+			"Profile recorded in session cache does not exist anymore")
+	}
 	return nil
 }
 
-func clearSessionCache(runtimeDir string) error {
-	filename := sessionCacheFilename(runtimeDir)
+// restoreSessionCacheIfExists returns nil cache instead of an error when
+// session has no cache. Cache that exists, but can't be read is an error.
+func restoreSessionCacheIfExists(options *programOptions) (*sessionCache, error) {
+	filename := sessionCacheFilename(options.Runtime.RuntimeDir, options.Session)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return restoreSessionCache(options)
+}
+
+func clearSessionCache(options *programOptions) error {
+	filename := sessionCacheFilename(options.Runtime.RuntimeDir, options.Session)
 	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
 		log.WithFields(log.Fields{
 			"cause":    err,
@@ -89,6 +241,18 @@ func verifySessionCacheIsWritable(runtimeDir string) error {
 			"cause": "not a directory",
 			"dir":   runtimeDir,
 		}).Error("Couldn't validate runtime dir")
+		return errors.New("runtime dir is not a directory")
+	}
+
+	probe, err := ioutil.TempFile(runtimeDir, ".holepuncher-probe-")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cause": err,
+			"dir":   runtimeDir,
+		}).Error("Runtime dir is not writable")
+		return err
 	}
+	probe.Close()
+	os.Remove(probe.Name())
 	return nil
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	sessionEncryptionPassphrase = "passphrase"
+	sessionEncryptionPeerKey    = "peer_key"
+
+	// Passphrase is read from this variable when it's not in config.
+	sessionPassphraseEnv = "HOLEPUNCHER_SESSION_PASSPHRASE"
+
+	encryptedSessionFormat = "holepuncher-encrypted-session"
+	sessionKDFScrypt       = "scrypt"
+	sessionKDFPeerKey      = "hkdf-peer-key"
+	sessionKeySize         = 32
+	sessionSaltSize        = 16
+)
+
+// sessionScryptN is scrypt cost parameter. Tests lower it.
+var sessionScryptN = 1 << 15
+
+// sessionScryptKeyFn derives keys with scrypt. Tests count calls.
+var sessionScryptKeyFn = scrypt.Key
+
+// sessionScryptKey is a key derived with scrypt. Derivation is deliberately
+// slow, so derived keys are kept for the lifetime of the process.
+type sessionScryptKey struct {
+	passphrase string
+	n          int
+	salt       []byte
+	key        []byte
+}
+
+var (
+	sessionScryptKeysMutex sync.Mutex
+	sessionScryptKeys      []*sessionScryptKey
+)
+
+// deriveSessionScryptKey returns key for passphrase and salt, deriving it
+// only if it wasn't derived before.
+func deriveSessionScryptKey(passphrase string, salt []byte) ([]byte, error) {
+	sessionScryptKeysMutex.Lock()
+	defer sessionScryptKeysMutex.Unlock()
+	for _, k := range sessionScryptKeys {
+		if k.passphrase == passphrase && k.n == sessionScryptN && bytes.Equal(k.salt, salt) {
+			return k.key, nil
+		}
+	}
+
+	key, err := sessionScryptKeyFn([]byte(passphrase), salt, sessionScryptN, 8, 1, sessionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	sessionScryptKeys = append(sessionScryptKeys, &sessionScryptKey{
+		passphrase: passphrase,
+		n:          sessionScryptN,
+		salt:       salt,
+		key:        key,
+	})
+	return key, nil
+}
+
+// derivedSessionScryptSalt returns salt of a key already derived from
+// passphrase, or nil. Saving session cache with it avoids another
+// derivation. Every save still uses a fresh random nonce.
+func derivedSessionScryptSalt(passphrase string) []byte {
+	sessionScryptKeysMutex.Lock()
+	defer sessionScryptKeysMutex.Unlock()
+	for _, k := range sessionScryptKeys {
+		if k.passphrase == passphrase && k.n == sessionScryptN {
+			return k.salt
+		}
+	}
+	return nil
+}
+
+// encryptedSessionCache is stored instead of plain session cache when
+// encryption is enabled. Data is session cache JSON sealed with AES-GCM.
+type encryptedSessionCache struct {
+	Format string `json:"format"`
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+func sessionPassphrase(options *programOptions) string {
+	if passphrase := os.Getenv(sessionPassphraseEnv); len(passphrase) > 0 {
+		return passphrase
+	}
+	return options.SessionCache.Passphrase
+}
+
+// sessionCacheKey derives encryption key using given key derivation
+// function.
+func sessionCacheKey(options *programOptions, kdf string, salt []byte) ([]byte, error) {
+	switch kdf {
+	case sessionKDFScrypt:
+		passphrase := sessionPassphrase(options)
+		if len(passphrase) == 0 {
+			return nil, logConfigurationError("session cache: passphrase is empty or missing",
+				log.Fields{"env": sessionPassphraseEnv})
+		}
+		return deriveSessionScryptKey(passphrase, salt)
+	case sessionKDFPeerKey:
+		if len(options.ProtobufClient.PeerKey) == 0 {
+			return nil, logConfigurationError("session cache: client_protobuf.peer_key is empty or missing")
+		}
+		peerKey, err := decodeProtobufKey(options.ProtobufClient.PeerKey, "client_protobuf.peer_key")
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, sessionKeySize)
+		reader := hkdf.New(sha256.New, peerKey, salt, []byte("holepuncher session cache"))
+		if _, err = io.ReadFull(reader, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		log.WithField("kdf", kdf).Error("Session cache is encrypted with unknown key derivation function")
+		return nil, errors.New("unknown session cache kdf")
+	}
+}
+
+func newSessionCacheCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSessionCache seals session cache JSON if encryption is enabled and
+// returns data as is otherwise.
+func encryptSessionCache(data []byte, options *programOptions) ([]byte, error) {
+	var kdf string
+	switch options.SessionCache.Encryption {
+	case "":
+		return data, nil
+	case sessionEncryptionPassphrase:
+		kdf = sessionKDFScrypt
+	case sessionEncryptionPeerKey:
+		kdf = sessionKDFPeerKey
+	default:
+		return nil, logConfigurationError("session cache: encryption must be either passphrase or peer_key",
+			log.Fields{"encryption": options.SessionCache.Encryption})
+	}
+
+	sealed := &encryptedSessionCache{
+		Format: encryptedSessionFormat,
+		KDF:    kdf,
+	}
+	if kdf == sessionKDFScrypt {
+		sealed.Salt = derivedSessionScryptSalt(sessionPassphrase(options))
+	}
+	if sealed.Salt == nil {
+		sealed.Salt = make([]byte, sessionSaltSize)
+		if _, err := rand.Read(sealed.Salt); err != nil {
+			return nil, err
+		}
+	}
+	key, err := sessionCacheKey(options, kdf, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSessionCacheCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(sealed.Nonce); err != nil {
+		return nil, err
+	}
+	sealed.Data = aead.Seal(nil, sealed.Nonce, data, []byte(sealed.Format))
+	return json.MarshalIndent(sealed, "", "\t")
+}
+
+// decryptSessionCache returns session cache JSON. Plain caches are returned
+// as is, so that enabling encryption doesn't strand existing sessions.
+func decryptSessionCache(data []byte, options *programOptions) ([]byte, error) {
+	sealed := &encryptedSessionCache{}
+	if err := json.Unmarshal(data, sealed); err != nil || sealed.Format != encryptedSessionFormat {
+		return data, nil
+	}
+
+	key, err := sessionCacheKey(options, sealed.KDF, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSessionCacheCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		log.Error("Encrypted session cache is malformed")
+		return nil, errors.New("malformed session cache")
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(sealed.Format))
+	if err != nil {
+		log.WithField("kdf", sealed.KDF).Error("Unable to decrypt session cache, wrong passphrase or key")
+		return nil, errors.New("unable to decrypt session cache")
+	}
+	return plain, nil
+}
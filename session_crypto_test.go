@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/scrypt"
+)
+
+func lowerSessionScryptCost(t *testing.T) {
+	n := sessionScryptN
+	sessionScryptN = 1 << 4
+	t.Cleanup(func() { sessionScryptN = n })
+}
+
+func TestEncryptedSessionCacheRoundTrip(t *testing.T) {
+	lowerSessionScryptCost(t)
+	os.Unsetenv(sessionPassphraseEnv)
+
+	cases := map[string]func(o *programOptions){
+		"passphrase": func(o *programOptions) {
+			o.SessionCache.Encryption = sessionEncryptionPassphrase
+			o.SessionCache.Passphrase = "correct horse"
+		},
+		"peer key": func(o *programOptions) {
+			o.SessionCache.Encryption = sessionEncryptionPeerKey
+			o.ProtobufClient.PeerKey = "cdd7217aa315719f2e048fbe2962dee80a51e43b24c41dc73e2d129b23db178f"
+		},
+	}
+	for name, configure := range cases {
+		o := testSessionOptions(t, "")
+		configure(o)
+		cache := testSessionCache()
+		cache.CreationParams.RegularUserPassword = "user-password"
+
+		require.NoError(t, saveSessionCache(cache, o), name)
+		data, err := ioutil.ReadFile(sessionCacheFilename(o.Runtime.RuntimeDir, o.Session))
+		require.NoError(t, err, name)
+		assert.Contains(t, string(data), encryptedSessionFormat, name)
+		assert.NotContains(t, string(data), cache.CreationParams.RegularUserPassword, name)
+		assert.NotContains(t, string(data), cache.InstanceInfo.IPv4[0], name)
+
+		// Decryption doesn't depend on the encryption setting.
+		o.SessionCache.Encryption = ""
+		restored, err := restoreSessionCache(o)
+		require.NoError(t, err, name)
+		assert.Equal(t, cache, restored, name)
+	}
+}
+
+func TestSessionScryptKeyIsDerivedOnce(t *testing.T) {
+	lowerSessionScryptCost(t)
+	os.Unsetenv(sessionPassphraseEnv)
+	derivations := 0
+	t.Cleanup(func() { sessionScryptKeyFn = scrypt.Key })
+	sessionScryptKeyFn = func(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+		derivations++
+		return scrypt.Key(password, salt, N, r, p, keyLen)
+	}
+
+	o := testSessionOptions(t, "")
+	o.SessionCache.Encryption = sessionEncryptionPassphrase
+	o.SessionCache.Passphrase = "derived once"
+	for i := 0; i < 3; i++ {
+		require.NoError(t, saveSessionCache(testSessionCache(), o))
+		_, err := restoreSessionCache(o)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, derivations)
+}
+
+func TestEncryptedSessionCacheWrongPassphrase(t *testing.T) {
+	lowerSessionScryptCost(t)
+	os.Unsetenv(sessionPassphraseEnv)
+	o := testSessionOptions(t, "")
+	o.SessionCache.Encryption = sessionEncryptionPassphrase
+	o.SessionCache.Passphrase = "correct horse"
+	require.NoError(t, saveSessionCache(testSessionCache(), o))
+
+	o.SessionCache.Passphrase = "battery staple"
+	_, err := restoreSessionCache(o)
+	assert.EqualError(t, err, "unable to decrypt session cache")
+
+	o.SessionCache.Passphrase = ""
+	_, err = restoreSessionCache(o)
+	assert.Error(t, err)
+
+	os.Setenv(sessionPassphraseEnv, "correct horse")
+	defer os.Unsetenv(sessionPassphraseEnv)
+	_, err = restoreSessionCache(o)
+	assert.NoError(t, err)
+}
+
+func TestPlainSessionCacheIsReadWithEncryptionEnabled(t *testing.T) {
+	o := testSessionOptions(t, "")
+	require.NoError(t, saveSessionCache(testSessionCache(), o))
+
+	o.SessionCache.Encryption = sessionEncryptionPassphrase
+	restored, err := restoreSessionCache(o)
+	require.NoError(t, err)
+	assert.Equal(t, testSessionCache(), restored)
+}
+
+func TestEncryptSessionCacheUnknownMode(t *testing.T) {
+	o := validTestOptions()
+	o.SessionCache.Encryption = "rot13"
+	_, err := encryptSessionCache([]byte("{}"), o)
+	assert.Error(t, err)
+	assert.Error(t, validateGeneralProgramOptions(o))
+}
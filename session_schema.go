@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionCacheVersion is version of session cache schema written by this
+// program. Bump it and add a migration whenever the schema changes.
+//
+// Version 1 has no version field and stores provider as a number.
+const sessionCacheVersion = 2
+
+// sessionCacheMigrations upgrade generic session cache of the version given
+// by key to the next one.
+var sessionCacheMigrations = map[int]func(cache map[string]interface{}) error{
+	1: migrateSessionCacheV1,
+}
+
+// versionedSessionCache is what is actually stored in session cache file.
+type versionedSessionCache struct {
+	Version int `json:"version"`
+	*sessionCache
+}
+
+// migrateSessionCacheV1 replaces provider number with its name. Numbers of
+// unknown providers are refused, since their names can't be recovered.
+func migrateSessionCacheV1(cache map[string]interface{}) error {
+	info, ok := cache["instance_info"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	number, ok := info["provider"].(json.Number)
+	if !ok {
+		return nil
+	}
+	value, err := strconv.Atoi(number.String())
+	if err != nil {
+		return err
+	}
+	switch provider := providerType(value); provider {
+	case providerTypeLinode, providerTypeDigitalOcean, providerTypeMock:
+		info["provider"] = provider.String()
+		return nil
+	default:
+		return errors.Errorf("unknown provider %d", value)
+	}
+}
+
+// migrateSessionCache upgrades session cache JSON to the current version.
+// Caches written by newer versions are refused rather than misread.
+func migrateSessionCache(data []byte) ([]byte, error) {
+	cache := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cache); err != nil {
+		log.WithField("cause", err).Error("Error parsing session cache")
+		return nil, err
+	}
+
+	version := 1
+	if number, ok := cache["version"].(json.Number); ok {
+		parsed, err := strconv.Atoi(number.String())
+		if err != nil || parsed < 1 {
+			log.WithField("version", number).Error("Session cache has invalid version")
+			return nil, errors.New("invalid session cache version")
+		}
+		version = parsed
+	}
+	if version > sessionCacheVersion {
+		log.WithFields(log.Fields{
+			"version":   version,
+			"supported": sessionCacheVersion,
+		}).Error("Session cache was written by a newer version of holepuncher-cli, upgrade it")
+		return nil, errors.New("unsupported session cache version")
+	} else if version == sessionCacheVersion {
+		return data, nil
+	}
+
+	for ; version < sessionCacheVersion; version++ {
+		if err := sessionCacheMigrations[version](cache); err != nil {
+			log.WithFields(log.Fields{
+				"cause":   err,
+				"version": version,
+			}).Error("Unable to migrate session cache")
+			return nil, err
+		}
+	}
+	log.WithField("version", version).Debug("Migrated session cache")
+	cache["version"] = version
+	return json.Marshal(cache)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSessionCacheV1 = `{
+	"instance_info": {
+		"provider": 1,
+		"label": "holepuncher",
+		"ipv4": ["192.0.2.1"],
+		"ipv6": null,
+		"created_at": "2018-06-01T12:00:00Z"
+	},
+	"creation_params": {
+		"regular_user_name": "user",
+		"wireguard_enabled": true,
+		"wireguard_port": 55000
+	}
+}`
+
+func TestRestoreSessionCacheV1(t *testing.T) {
+	o := testSessionOptions(t, "")
+	filename := sessionCacheFilename(o.Runtime.RuntimeDir, o.Session)
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testSessionCacheV1), 0600))
+
+	cache, err := restoreSessionCache(o)
+	require.NoError(t, err)
+	assert.Equal(t, providerTypeDigitalOcean, cache.InstanceInfo.Provider)
+	assert.Equal(t, "holepuncher", cache.InstanceInfo.Label)
+	assert.Equal(t, "user", cache.CreationParams.RegularUserName)
+	assert.Equal(t, uint(55000), cache.CreationParams.WireGuardPort)
+}
+
+func TestMigrateSessionCacheV1RefusesUnknownProvider(t *testing.T) {
+	_, err := migrateSessionCache([]byte(`{"instance_info": {"provider": 7}}`))
+	assert.EqualError(t, err, "unknown provider 7")
+}
+
+func TestSaveSessionCacheWritesCurrentVersion(t *testing.T) {
+	o := testSessionOptions(t, "")
+	require.NoError(t, saveSessionCache(testSessionCache(), o))
+
+	data, err := ioutil.ReadFile(sessionCacheFilename(o.Runtime.RuntimeDir, o.Session))
+	require.NoError(t, err)
+	stored := struct {
+		Version      int `json:"version"`
+		InstanceInfo struct {
+			Provider string `json:"provider"`
+		} `json:"instance_info"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, sessionCacheVersion, stored.Version)
+	assert.Equal(t, "linode", stored.InstanceInfo.Provider)
+}
+
+func TestMigrateSessionCacheRefusesNewerVersion(t *testing.T) {
+	_, err := migrateSessionCache([]byte(`{"version": 1000}`))
+	assert.EqualError(t, err, "unsupported session cache version")
+
+	_, err = migrateSessionCache([]byte(`{"version": 0}`))
+	assert.Error(t, err)
+}
+
+func TestMigrateSessionCacheKeepsCurrentVersion(t *testing.T) {
+	data := []byte(`{"version": 2, "instance_info": {"provider": "mock"}}`)
+	migrated, err := migrateSessionCache(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, migrated)
+}
+
+func TestProviderTypeJSON(t *testing.T) {
+	data, err := json.Marshal(providerTypeDigitalOcean)
+	require.NoError(t, err)
+	assert.Equal(t, `"digital_ocean"`, string(data))
+
+	var p providerType
+	require.NoError(t, json.Unmarshal([]byte(`"mock"`), &p))
+	assert.Equal(t, providerTypeMock, p)
+	assert.Error(t, json.Unmarshal([]byte(`"vultr"`), &p))
+	assert.Error(t, json.Unmarshal([]byte(`1`), &p))
+}
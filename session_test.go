@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempRuntimeDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "holepuncher-runtime-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func testSessionOptions(t *testing.T, session string) *programOptions {
+	o := validTestOptions()
+	o.Runtime.RuntimeDir = tempRuntimeDir(t)
+	o.Session = session
+	return o
+}
+
+func testSessionCache() *sessionCache {
+	params := creationParamsFromProgramOptions(validTestOptions())
+	return &sessionCache{
+		InstanceInfo: &tunnelInstance{
+			Provider:  providerTypeLinode,
+			Label:     "holepuncher",
+			IPv4:      []string{"192.0.2.1"},
+			IPv6:      []string{"2001:db8::1"},
+			CreatedAt: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		CreationParams: &params,
+	}
+}
+
+func TestSessionCacheRoundTrip(t *testing.T) {
+	o := testSessionOptions(t, "")
+	cache := testSessionCache()
+
+	require.NoError(t, saveSessionCache(cache, o))
+	restored, err := restoreSessionCache(o)
+	require.NoError(t, err)
+	assert.Equal(t, cache, restored)
+}
+
+func TestSaveSessionCacheIsPrivateAndAtomic(t *testing.T) {
+	o := testSessionOptions(t, "")
+	filename := sessionCacheFilename(o.Runtime.RuntimeDir, o.Session)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{}"), 0644))
+
+	require.NoError(t, saveSessionCache(testSessionCache(), o))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Temporary file is gone.
+	entries, err := ioutil.ReadDir(o.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestSessionCacheClear(t *testing.T) {
+	o := testSessionOptions(t, "")
+	require.NoError(t, saveSessionCache(testSessionCache(), o))
+
+	require.NoError(t, clearSessionCache(o))
+	_, err := os.Stat(sessionCacheFilename(o.Runtime.RuntimeDir, o.Session))
+	assert.True(t, os.IsNotExist(err))
+
+	// Clearing missing cache is not an error.
+	assert.NoError(t, clearSessionCache(o))
+}
+
+func TestRestoreSessionCacheErrors(t *testing.T) {
+	o := testSessionOptions(t, "")
+	_, err := restoreSessionCache(o)
+	assert.Error(t, err, "missing cache")
+
+	filename := sessionCacheFilename(o.Runtime.RuntimeDir, o.Session)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0644))
+	_, err = restoreSessionCache(o)
+	assert.Error(t, err, "malformed cache")
+}
+
+func TestRestoreSessionCacheIfExists(t *testing.T) {
+	o := testSessionOptions(t, "")
+	cache, err := restoreSessionCacheIfExists(o)
+	require.NoError(t, err)
+	assert.Nil(t, cache)
+
+	filename := sessionCacheFilename(o.Runtime.RuntimeDir, o.Session)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0600))
+	_, err = restoreSessionCacheIfExists(o)
+	assert.Error(t, err, "unreadable cache must not be taken for a missing one")
+	_, err = activeSessionCaches(o)
+	assert.Error(t, err)
+}
+
+func TestSessionCacheFilename(t *testing.T) {
+	assert.Equal(t, "/run/session.json", sessionCacheFilename("/run", ""))
+	assert.Equal(t, "/run/session.json", sessionCacheFilename("/run", defaultSessionName))
+	assert.Equal(t, "/run/session-eu1.json", sessionCacheFilename("/run", "eu1"))
+}
+
+func TestNamedSessionsAreIndependent(t *testing.T) {
+	o := testSessionOptions(t, "")
+	eu1, err := sessionOptions(o, "eu1")
+	require.NoError(t, err)
+	us1, err := sessionOptions(o, "us1")
+	require.NoError(t, err)
+
+	first := testSessionCache()
+	second := testSessionCache()
+	second.InstanceInfo.Label = "second"
+	require.NoError(t, saveSessionCache(first, eu1))
+	require.NoError(t, saveSessionCache(second, us1))
+	require.NoError(t, saveSessionCache(first, o))
+
+	restored, err := restoreSessionCache(eu1)
+	require.NoError(t, err)
+	assert.Equal(t, first, restored)
+	restored, err = restoreSessionCache(us1)
+	require.NoError(t, err)
+	assert.Equal(t, second, restored)
+
+	names, err := listSessions(o.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultSessionName, "eu1", "us1"}, names)
+
+	require.NoError(t, clearSessionCache(eu1))
+	names, err = listSessions(o.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultSessionName, "us1"}, names)
+}
+
+func TestValidateSessionName(t *testing.T) {
+	for _, name := range []string{"", "eu1", "us-east_2", "a.b"} {
+		assert.NoError(t, validateSessionName(name), name)
+	}
+	for _, name := range []string{"../etc", ".hidden", "a/b", "with space"} {
+		assert.Error(t, validateSessionName(name), name)
+	}
+}
+
+func TestVerifySessionCacheIsWritable(t *testing.T) {
+	dir := tempRuntimeDir(t)
+	assert.NoError(t, verifySessionCacheIsWritable(dir))
+	assert.Error(t, verifySessionCacheIsWritable(path.Join(dir, "missing")))
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "probe file must be removed")
+}
+
+func TestVerifySessionCacheIsWritableNotADirectory(t *testing.T) {
+	filename := path.Join(tempRuntimeDir(t), "file")
+	require.NoError(t, ioutil.WriteFile(filename, nil, 0644))
+	assert.Error(t, verifySessionCacheIsWritable(filename))
+}
+
+func TestVerifySessionCacheIsWritableReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir := tempRuntimeDir(t)
+	require.NoError(t, os.Chmod(dir, 0500))
+	defer os.Chmod(dir, 0700)
+	assert.Error(t, verifySessionCacheIsWritable(dir))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// States of a session after reconciliation with provider.
+const (
+	syncStateInSync    = "in_sync"
+	syncStateUpdated   = "updated"
+	syncStateMissing   = "missing"
+	syncStatePruned    = "pruned"
+	syncStateUntracked = "untracked"
+	syncStateAdopted   = "adopted"
+	syncStateNone      = "none"
+)
+
+type sessionSyncResult struct {
+	Session string   `json:"session"`
+	State   string   `json:"state"`
+	Label   string   `json:"label,omitempty"`
+	IPv4    []string `json:"ipv4,omitempty"`
+	IPv6    []string `json:"ipv6,omitempty"`
+	Changes []string `json:"changes,omitempty"`
+}
+
+// sessionSyncer reconciles session cache with tunnel reported by provider.
+type sessionSyncer struct {
+	options  *programOptions
+	provider aCloudProvider
+	// Record live tunnel that has no session cache.
+	adopt bool
+	// Clear session cache of tunnel that doesn't exist anymore.
+	prune bool
+}
+
+// Sync queries tunnel status and reconciles session cache with it.
+func (s *sessionSyncer) Sync() (*sessionSyncResult, error) {
+	status, err := s.provider.TunnelStatus()
+	return s.reconcile(status, err)
+}
+
+// reconcile compares tunnel status with session cache. Only errors saying
+// that the instance is not found mean that the tunnel doesn't exist, other
+// errors leave the state unknown.
+func (s *sessionSyncer) reconcile(status *tunnelInstance, statusErr error) (*sessionSyncResult, error) {
+	if statusErr != nil && !isTunnelNotFoundError(statusErr) {
+		log.Error("Unable to query tunnel status, session cache is left as is")
+		return nil, statusErr
+	}
+
+	// Unreadable cache must not be overwritten by adoption.
+	cache, err := restoreSessionCacheIfExists(s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &sessionSyncResult{Session: exportSessionName(s.options)}
+	switch {
+	case statusErr != nil && cache == nil:
+		result.State = syncStateNone
+	case statusErr != nil:
+		return s.reconcileMissing(result, cache)
+	case cache == nil:
+		return s.reconcileUntracked(result, status)
+	default:
+		return s.reconcileExisting(result, cache, status)
+	}
+	return result, nil
+}
+
+func (s *sessionSyncer) reconcileMissing(result *sessionSyncResult, cache *sessionCache) (*sessionSyncResult, error) {
+	result.State = syncStateMissing
+	result.Label = cache.InstanceInfo.Label
+	fields := log.Fields{
+		"session": result.Session,
+		"label":   cache.InstanceInfo.Label,
+	}
+	if !s.prune {
+		log.WithFields(fields).Warning("Tunnel recorded in session cache does not exist anymore, " +
+			"use sync --prune to clear the session")
+		return result, nil
+	}
+
+	if err := clearSessionCache(s.options); err != nil {
+		return nil, err
+	}
+	log.WithFields(fields).Info("Cleared session of tunnel that does not exist anymore")
+	result.State = syncStatePruned
+	return result, nil
+}
+
+func (s *sessionSyncer) reconcileUntracked(result *sessionSyncResult, status *tunnelInstance) (*sessionSyncResult, error) {
+	result.State = syncStateUntracked
+	result.Label = status.Label
+	result.IPv4 = status.IPv4
+	result.IPv6 = status.IPv6
+	fields := log.Fields{
+		"session": result.Session,
+		"label":   status.Label,
+	}
+	if !s.adopt {
+		log.WithFields(fields).Warning("Tunnel exists, but session has no record of it, " +
+			"use sync --adopt to record it")
+		return result, nil
+	}
+
+	started := time.Now()
+	cache := s.adoptedSessionCache(status)
+	err := saveSessionCache(cache, s.options)
+	appendHistory(s.options, newHistoryRecord(s.options, historyActionAdopt, cache, started, time.Now(), err))
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(fields).Warning("Adopted tunnel assuming it was created with the current configuration")
+	result.State = syncStateAdopted
+	return result, nil
+}
+
+// adoptedSessionCache records tunnel the session didn't create. Creation
+// params are not reported by provider, so they are assumed to match the
+// current configuration.
+func (s *sessionSyncer) adoptedSessionCache(status *tunnelInstance) *sessionCache {
+	params := creationParamsFromProgramOptions(s.options)
+	cache := &sessionCache{
+		InstanceInfo:   status,
+		CreationParams: &params,
+		Price:          lookupPlanPrice(s.provider),
+	}
+	cache.Region, cache.Plan = tunnelPlacement(s.options)
+	return cache
+}
+
+func (s *sessionSyncer) reconcileExisting(
+	result *sessionSyncResult,
+	cache *sessionCache,
+	status *tunnelInstance,
+) (*sessionSyncResult, error) {
+	result.Label = status.Label
+	result.IPv4 = status.IPv4
+	result.IPv6 = status.IPv6
+
+	recorded := cache.InstanceInfo
+	if recorded.Label != status.Label {
+		result.Changes = append(result.Changes,
+			fmt.Sprintf("label: %s -> %s", recorded.Label, status.Label))
+	}
+	if !reflect.DeepEqual(recorded.IPv4, status.IPv4) && (len(recorded.IPv4) > 0 || len(status.IPv4) > 0) {
+		result.Changes = append(result.Changes,
+			fmt.Sprintf("ipv4: %v -> %v", recorded.IPv4, status.IPv4))
+	}
+	if !reflect.DeepEqual(recorded.IPv6, status.IPv6) && (len(recorded.IPv6) > 0 || len(status.IPv6) > 0) {
+		result.Changes = append(result.Changes,
+			fmt.Sprintf("ipv6: %v -> %v", recorded.IPv6, status.IPv6))
+	}
+	if len(result.Changes) == 0 {
+		result.State = syncStateInSync
+		return result, nil
+	}
+
+	if recorded.Label != status.Label {
+		log.WithFields(log.Fields{
+			"session":  result.Session,
+			"recorded": recorded.Label,
+			"live":     status.Label,
+		}).Warning("Tunnel was replaced outside of this session")
+		// Nothing recorded about the old tunnel applies to the new one, so
+		// the new tunnel is adopted. It still lives in the same account.
+		started := time.Now()
+		profile := cache.Profile
+		cache = s.adoptedSessionCache(status)
+		cache.Profile = profile
+		err := saveSessionCache(cache, s.options)
+		appendHistory(s.options, newHistoryRecord(s.options, historyActionAdopt, cache, started, time.Now(), err))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		recorded.IPv4 = status.IPv4
+		recorded.IPv6 = status.IPv6
+		if err := saveSessionCache(cache, s.options); err != nil {
+			return nil, err
+		}
+	}
+	for _, change := range result.Changes {
+		log.WithField("session", result.Session).Info("Session updated, " + change)
+	}
+	result.State = syncStateUpdated
+	return result, nil
+}
+
+// lockSessionForInfo locks session, so that `info` queries tunnel status
+// that no other operation makes stale before it's reconciled with session
+// cache. Nil lock is returned if session is busy, and cached data is shown
+// instead.
+func lockSessionForInfo(c *cli.Context, options *programOptions) (*sessionLock, error) {
+	lock, holder, err := tryAcquireSessionLock(options, c.GlobalDuration("wait-lock"))
+	if err == errSessionLocked {
+		log.WithFields(log.Fields{
+			"session": exportSessionName(options),
+			"pid":     holder,
+		}).Warning("Another operation on the session is in progress, showing cached tunnel info")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = verifyCachedProfile(options); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// reconcileSessionForInfo brings session cache up to date with tunnel
+// status queried by `info` under session lock. It never adopts or prunes,
+// and failures only skip reconciliation.
+func reconcileSessionForInfo(
+	provider aCloudProvider,
+	options *programOptions,
+	status *tunnelInstance,
+	statusErr error,
+) {
+	if statusErr != nil && !isTunnelNotFoundError(statusErr) {
+		return
+	}
+	syncer := &sessionSyncer{options: options, provider: provider}
+	if _, err := syncer.reconcile(status, statusErr); err != nil {
+		log.Warning("Session cache was not reconciled with tunnel status")
+	}
+}
+
+func handleSyncCommand(c *cli.Context) error {
+	printer, err := newOutputPrinterFromContext(c)
+	if err != nil {
+		return err
+	}
+	provider, options, err := newCloudProviderFromContext(c)
+	if err != nil {
+		return err
+	}
+	lock, err := lockSessionFromContext(c, options)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	syncer := &sessionSyncer{
+		options:  options,
+		provider: provider,
+		adopt:    c.Bool("adopt"),
+		prune:    c.Bool("prune"),
+	}
+	result, err := syncer.Sync()
+	if err != nil {
+		return err
+	}
+	return printer.Print(result)
+}
+
+func syncCommand() cli.Command {
+	return cli.Command{
+		Name:   "sync",
+		Usage:  "reconcile session with tunnel reported by provider",
+		Action: handleSyncCommand,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "adopt",
+				Usage: "record live tunnel the session has no record of",
+			},
+			cli.BoolFlag{
+				Name:  "prune",
+				Usage: "clear session if its tunnel does not exist anymore",
+			},
+		},
+	}
+}
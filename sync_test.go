@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSessionSyncer(t *testing.T, provider aCloudProvider) *sessionSyncer {
+	return &sessionSyncer{options: testSessionOptions(t, ""), provider: provider}
+}
+
+func TestSessionSyncInSync(t *testing.T) {
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{status: testSessionCache().InstanceInfo})
+	require.NoError(t, saveSessionCache(testSessionCache(), syncer.options))
+
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateInSync, result.State)
+	assert.Empty(t, result.Changes)
+}
+
+func TestSessionSyncRefreshesIPs(t *testing.T) {
+	status := testSessionCache().InstanceInfo
+	status.IPv4 = []string{"192.0.2.7"}
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{status: status})
+	recorded := testSessionCache()
+	expiresAt := time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC)
+	recorded.ExpiresAt = &expiresAt
+	require.NoError(t, saveSessionCache(recorded, syncer.options))
+
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateUpdated, result.State)
+	assert.Equal(t, []string{"ipv4: [192.0.2.1] -> [192.0.2.7]"}, result.Changes)
+
+	cache, err := restoreSessionCache(syncer.options)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.7"}, cache.InstanceInfo.IPv4)
+	assert.Equal(t, recorded.InstanceInfo.CreatedAt, cache.InstanceInfo.CreatedAt)
+	require.NotNil(t, cache.ExpiresAt, "bookkeeping state must be kept")
+	assert.True(t, expiresAt.Equal(*cache.ExpiresAt))
+}
+
+func TestSessionSyncReplacedTunnel(t *testing.T) {
+	status := testSessionCache().InstanceInfo
+	status.Label = "holepuncher-2"
+	status.CreatedAt = status.CreatedAt.Add(time.Hour)
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{status: status})
+	expiresAt := status.CreatedAt.Add(time.Hour)
+	recorded := testSessionCache()
+	recorded.CreationParams.WireGuardPort = 51821
+	recorded.ExpiresAt = &expiresAt
+	recorded.Price = &tunnelPrice{Plan: "g6-standard-4", Hourly: 0.06}
+	recorded.Region, recorded.Plan = "eu-west", "g6-standard-4"
+	require.NoError(t, saveSessionCache(recorded, syncer.options))
+
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateUpdated, result.State)
+	cache, err := restoreSessionCache(syncer.options)
+	require.NoError(t, err)
+	assert.Equal(t, "holepuncher-2", cache.InstanceInfo.Label)
+	assert.True(t, status.CreatedAt.Equal(cache.InstanceInfo.CreatedAt))
+	assert.Equal(t, creationParamsFromProgramOptions(syncer.options), *cache.CreationParams)
+	assert.Nil(t, cache.ExpiresAt, "expiry of the old tunnel must not apply")
+	assert.Nil(t, cache.Price)
+	region, plan := tunnelPlacement(syncer.options)
+	assert.Equal(t, region, cache.Region)
+	assert.Equal(t, plan, cache.Plan)
+
+	records, err := loadHistory(syncer.options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, historyActionAdopt, records[0].Action)
+	assert.Equal(t, "holepuncher-2", records[0].Label)
+}
+
+func TestSessionSyncMissingTunnel(t *testing.T) {
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{statusErr: &tunnelStatusError{notFound: true}})
+	require.NoError(t, saveSessionCache(testSessionCache(), syncer.options))
+	filename := sessionCacheFilename(syncer.options.Runtime.RuntimeDir, "")
+
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateMissing, result.State)
+	_, err = os.Stat(filename)
+	assert.NoError(t, err, "session must be kept without --prune")
+
+	syncer.prune = true
+	result, err = syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStatePruned, result.State)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSessionSyncUntrackedTunnel(t *testing.T) {
+	status := testSessionCache().InstanceInfo
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{status: status})
+
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateUntracked, result.State)
+	_, err = restoreSessionCache(syncer.options)
+	assert.Error(t, err, "nothing must be saved without --adopt")
+
+	syncer.adopt = true
+	result, err = syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateAdopted, result.State)
+	cache, err := restoreSessionCache(syncer.options)
+	require.NoError(t, err)
+	assert.Equal(t, status.Label, cache.InstanceInfo.Label)
+	assert.Equal(t, creationParamsFromProgramOptions(syncer.options), *cache.CreationParams)
+
+	records, err := loadHistory(syncer.options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, historyActionAdopt, records[0].Action)
+	assert.Equal(t, status.Label, records[0].Label)
+}
+
+func TestSessionSyncNoTunnel(t *testing.T) {
+	syncer := newTestSessionSyncer(t, &fakeCloudProvider{statusErr: &tunnelStatusError{notFound: true}})
+	result, err := syncer.Sync()
+	require.NoError(t, err)
+	assert.Equal(t, syncStateNone, result.State)
+}
+
+func TestSessionSyncKeepsCacheOnQueryErrors(t *testing.T) {
+	for _, statusErr := range []error{
+		&transportError{cause: errors.New("timeout")},
+		errors.New("LinodeGetTunnelStatus RPC bug"),
+		// E.g. a revoked token or an API outage.
+		&tunnelStatusError{},
+	} {
+		syncer := newTestSessionSyncer(t, &fakeCloudProvider{statusErr: statusErr})
+		syncer.prune = true
+		require.NoError(t, saveSessionCache(testSessionCache(), syncer.options))
+
+		_, err := syncer.Sync()
+		assert.Equal(t, statusErr, err)
+		_, err = restoreSessionCache(syncer.options)
+		assert.NoError(t, err)
+	}
+}
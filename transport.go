@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRequestTimeout = 150 * time.Second
+
+	// Values of runtime.proxy with special meaning.
+	proxyFromEnvironment = "env"
+	proxyDirect          = "direct"
+
+	spkiPinPrefix = "sha256/"
+)
+
+// newHTTPClient creates HTTP client for talking to Holepuncher server.
+func newHTTPClient(options *programOptions) (*http.Client, error) {
+	if options.Runtime.Provider == providerTypeMock.String() {
+		return newMockHTTPClient(options)
+	}
+
+	transport, err := newHTTPTransport(options)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultRequestTimeout
+	if options.Runtime.RequestTimeout > 0 {
+		timeout = time.Duration(options.Runtime.RequestTimeout) * time.Second
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+func newHTTPTransport(options *programOptions) (*http.Transport, error) {
+	proxy, err := proxyFuncFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsConfigFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+// proxyFuncFromOptions interprets runtime.proxy setting. Empty value and
+// "env" honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables,
+// "direct" disables proxying altogether. Everything else must be an URL of
+// HTTP (CONNECT) or SOCKS5 proxy.
+func proxyFuncFromOptions(options *programOptions) (func(*http.Request) (*url.URL, error), error) {
+	value := strings.TrimSpace(options.Runtime.Proxy)
+	switch strings.ToLower(value) {
+	case "", proxyFromEnvironment:
+		return http.ProxyFromEnvironment, nil
+	case proxyDirect:
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, logConfigurationError("runtime: malformed proxy address",
+			log.Fields{"proxy": value, "error": err.Error()})
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// Go's SOCKS5 dialer always lets the proxy resolve host names.
+		proxyURL.Scheme = "socks5"
+	default:
+		return nil, logConfigurationError("runtime: unsupported proxy scheme",
+			log.Fields{"proxy": value, "scheme": proxyURL.Scheme})
+	}
+	if len(proxyURL.Host) == 0 {
+		return nil, logConfigurationError("runtime: proxy address has no host",
+			log.Fields{"proxy": value})
+	}
+
+	log.WithField("proxy", proxyURL.Redacted()).Debug("Using upstream proxy")
+	return http.ProxyURL(proxyURL), nil
+}
+
+// tlsConfigFromOptions builds TLS settings for the control channel. Custom CA
+// bundle replaces system roots, SPKI pins are checked in addition to regular
+// chain verification.
+func tlsConfigFromOptions(options *programOptions) (*tls.Config, error) {
+	rt := &options.Runtime
+	if len(rt.TLSCAFile) == 0 && len(rt.TLSPins) == 0 &&
+		len(rt.TLSClientCert) == 0 && len(rt.TLSClientKey) == 0 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(strings.ToLower(rt.ServerAddress), "https://") {
+		log.WithField("server", rt.ServerAddress).Warning(
+			"TLS settings are configured, but server address is not https")
+	}
+
+	config := &tls.Config{}
+	if len(rt.TLSCAFile) > 0 {
+		pem, err := ioutil.ReadFile(rt.TLSCAFile)
+		if err != nil {
+			return nil, logConfigurationError("runtime: unable to read CA bundle",
+				log.Fields{"path": rt.TLSCAFile, "error": err.Error()})
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, logConfigurationError("runtime: CA bundle contains no certificates",
+				log.Fields{"path": rt.TLSCAFile})
+		}
+	}
+
+	if len(rt.TLSClientCert) > 0 || len(rt.TLSClientKey) > 0 {
+		if len(rt.TLSClientCert) == 0 || len(rt.TLSClientKey) == 0 {
+			return nil, logConfigurationError(
+				"runtime: tls_client_cert and tls_client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(rt.TLSClientCert, rt.TLSClientKey)
+		if err != nil {
+			return nil, logConfigurationError("runtime: unable to load client certificate",
+				log.Fields{"cert": rt.TLSClientCert, "key": rt.TLSClientKey, "error": err.Error()})
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(rt.TLSPins) > 0 {
+		pins, err := parseSPKIPins(rt.TLSPins)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return verifySPKIPins(pins, chains)
+		}
+	}
+	return config, nil
+}
+
+// parseSPKIPins decodes pins in "sha256/<base64>" format. The prefix is
+// optional.
+func parseSPKIPins(values []string) ([][]byte, error) {
+	pins := [][]byte{}
+	for _, value := range values {
+		encoded := strings.TrimPrefix(strings.TrimSpace(value), spkiPinPrefix)
+		pin, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, logConfigurationError("runtime: malformed SPKI pin",
+				log.Fields{"pin": value})
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifySPKIPins succeeds if any certificate of any verified chain has
+// public key matching one of the pins.
+func verifySPKIPins(pins [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+
+	fields := log.Fields{}
+	if len(chains) > 0 && len(chains[0]) > 0 {
+		fields["subject"] = chains[0][0].Subject.String()
+		fields["spki"] = spkiPin(chains[0][0])
+	}
+	log.WithFields(fields).Error("Server certificate does not match any of configured pins")
+	return errors.New("certificate pin mismatch")
+}
+
+// spkiPin returns pin of certificate's public key in "sha256/<base64>"
+// format.
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(digest[:])
+}
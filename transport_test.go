@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func resolveTestProxy(t *testing.T, proxy string) string {
+	o := validTestOptions()
+	o.Runtime.Proxy = proxy
+	client, err := newHTTPClient(o)
+	require.NoError(t, err)
+
+	transport := client.Transport.(*http.Transport)
+	if transport.Proxy == nil {
+		return ""
+	}
+	request, _ := http.NewRequest(http.MethodGet, "http://holepuncher.example.com/", nil)
+	proxyURL, err := transport.Proxy(request)
+	require.NoError(t, err)
+	if proxyURL == nil {
+		return ""
+	}
+	return proxyURL.String()
+}
+
+func TestProxyFromOptions(t *testing.T) {
+	assert.Equal(t, "socks5://127.0.0.1:9050", resolveTestProxy(t, "socks5://127.0.0.1:9050"))
+	assert.Equal(t, "socks5://127.0.0.1:9050", resolveTestProxy(t, "socks5h://127.0.0.1:9050"))
+	assert.Equal(t, "http://user:pw@proxy:3128", resolveTestProxy(t, "http://user:pw@proxy:3128"))
+	assert.Equal(t, "", resolveTestProxy(t, "direct"))
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	o := validTestOptions()
+	for _, value := range []string{"", "env", "ENV"} {
+		o.Runtime.Proxy = value
+		client, err := newHTTPClient(o)
+		require.NoError(t, err)
+		assert.NotNil(t, client.Transport.(*http.Transport).Proxy, value)
+	}
+}
+
+func TestProxyValidation(t *testing.T) {
+	o := validTestOptions()
+	for _, value := range []string{"ftp://proxy:21", "socks5://", "http://[::1"} {
+		o.Runtime.Proxy = value
+		_, err := newHTTPClient(o)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	o := validTestOptions()
+	client, err := newHTTPClient(o)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRequestTimeout, client.Timeout)
+
+	o.Runtime.RequestTimeout = 10
+	client, err = newHTTPClient(o)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, client.Timeout)
+}
+
+func newTestTLSServer(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	f, err := ioutil.TempFile("", "holepuncher-ca-*.pem")
+	require.NoError(t, err)
+	defer f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	return server, f.Name()
+}
+
+func getWithTLSOptions(t *testing.T, server *httptest.Server, mutate func(o *programOptions)) error {
+	o := validTestOptions()
+	o.Runtime.ServerAddress = server.URL
+	o.Runtime.Proxy = "direct"
+	mutate(o)
+
+	client, err := newHTTPClient(o)
+	if err != nil {
+		return err
+	}
+	response, err := client.Get(server.URL)
+	if err == nil {
+		response.Body.Close()
+	}
+	return err
+}
+
+func TestTLSCustomCA(t *testing.T) {
+	server, caFile := newTestTLSServer(t)
+
+	assert.Error(t, getWithTLSOptions(t, server, func(o *programOptions) {}),
+		"self-signed certificate must not be trusted by default")
+	assert.NoError(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile
+	}))
+	assert.Error(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile + ".missing"
+	}))
+}
+
+func TestTLSPinning(t *testing.T) {
+	server, caFile := newTestTLSServer(t)
+	pin := spkiPin(server.Certificate())
+
+	assert.NoError(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile
+		o.Runtime.TLSPins = []string{pin}
+	}))
+	assert.NoError(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile
+		o.Runtime.TLSPins = []string{strings.TrimPrefix(pin, spkiPinPrefix)}
+	}), "prefix is optional")
+	assert.Error(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile
+		o.Runtime.TLSPins = []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	}), "pin mismatch")
+	assert.Error(t, getWithTLSOptions(t, server, func(o *programOptions) {
+		o.Runtime.TLSCAFile = caFile
+		o.Runtime.TLSPins = []string{"sha256/garbage"}
+	}), "malformed pin")
+}
+
+func TestTLSClientCertValidation(t *testing.T) {
+	o := validTestOptions()
+	o.Runtime.TLSClientCert = "/nonexistent/cert.pem"
+	_, err := newHTTPClient(o)
+	assert.Error(t, err, "key is missing")
+
+	o.Runtime.TLSClientKey = "/nonexistent/key.pem"
+	_, err = newHTTPClient(o)
+	assert.Error(t, err, "files are missing")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultWaitTimeout  = 10 * time.Minute
+	defaultWaitInterval = 5 * time.Second
+	probeDialTimeout    = 3 * time.Second
+)
+
+// serviceProbe is a single service port the tunnel is expected to listen on.
+type serviceProbe struct {
+	Service string
+	Network string
+	Address string
+	// Keys WireGuard service is probed with.
+	WireGuardKeys *wireGuardProbeKeys
+}
+
+func (p *serviceProbe) String() string {
+	return fmt.Sprintf("%s %s/%s", p.Service, p.Address, p.Network)
+}
+
+// tunnelWaiter waits until a freshly created or rebuilt tunnel becomes
+// usable.
+type tunnelWaiter struct {
+	provider aCloudProvider
+	// Client settings used to probe WireGuard, may be nil.
+	options  *programOptions
+	timeout  time.Duration
+	interval time.Duration
+	probe    func(p *serviceProbe) error
+	progress io.Writer
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+func newTunnelWaiter(
+	provider aCloudProvider,
+	options *programOptions,
+	timeout time.Duration,
+	interval time.Duration,
+) *tunnelWaiter {
+	return &tunnelWaiter{
+		provider: provider,
+		options:  options,
+		timeout:  timeout,
+		interval: interval,
+		probe:    probeService,
+		progress: os.Stderr,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// serviceProbes returns probes of every service enabled in creation params on
+// each address of the instance. WireGuard is only probed if keys are known.
+func serviceProbes(
+	instance *tunnelInstance,
+	params *tunnelCreationParams,
+	keys *wireGuardProbeKeys,
+) []*serviceProbe {
+	probes := []*serviceProbe{}
+	add := func(service, network string, addresses []string, port uint, probeKeys *wireGuardProbeKeys) {
+		for _, address := range addresses {
+			probes = append(probes, &serviceProbe{
+				Service:       service,
+				Network:       network,
+				Address:       net.JoinHostPort(address, strconv.Itoa(int(port))),
+				WireGuardKeys: probeKeys,
+			})
+		}
+	}
+
+	if params.WireGuardEnabled && keys != nil {
+		add("wireguard", "udp", instance.IPv4, params.WireGuardPort, keys)
+		add("wireguard", "udp", instance.IPv6, params.WireGuardPort, keys)
+	}
+	if params.ObfsproxyIPv4Enabled {
+		add("obfsproxy", "tcp", instance.IPv4, params.ObfsproxyIPv4Port, nil)
+	}
+	if params.ObfsproxyIPv6Enabled {
+		add("obfsproxy", "tcp", instance.IPv6, params.ObfsproxyIPv6Port, nil)
+	}
+	return probes
+}
+
+// tunnelReadinessCanBeVerified tells whether any service of tunnel created
+// with params can be probed by Wait.
+func tunnelReadinessCanBeVerified(options *programOptions, params *tunnelCreationParams) bool {
+	return params.ObfsproxyIPv4Enabled || params.ObfsproxyIPv6Enabled ||
+		wireGuardProbeKeysFromOptions(options, params) != nil
+}
+
+// probeService checks that service responds. TCP services are checked by
+// connecting. WireGuard doesn't answer unauthenticated datagrams, so it is
+// checked by a handshake on behalf of a peer.
+func probeService(p *serviceProbe) error {
+	if p.Network == "udp" && p.WireGuardKeys == nil {
+		return errors.New("udp service can only be probed by wireguard handshake")
+	}
+	conn, err := net.DialTimeout(p.Network, p.Address, probeDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if p.Network != "udp" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(probeDialTimeout))
+	return probeWireGuard(conn, p.WireGuardKeys)
+}
+
+// Wait polls tunnel status until the instance has addresses and then probes
+// its services until all of them respond. Instance reported by the provider
+// is returned, since addresses may be assigned only after the instance
+// boots.
+func (w *tunnelWaiter) Wait(params *tunnelCreationParams) (*tunnelInstance, error) {
+	started := w.now()
+	deadline := started.Add(w.timeout)
+
+	var instance *tunnelInstance
+	for {
+		status, err := w.provider.TunnelStatus()
+		if err == nil && (len(status.IPv4) > 0 || len(status.IPv6) > 0) {
+			instance = status
+			break
+		}
+		w.report(started, "waiting for tunnel instance status")
+		if !w.now().Add(w.interval).Before(deadline) {
+			fmt.Fprintln(w.progress)
+			log.WithField("timeout", w.timeout).Error("Tunnel instance did not come up in time")
+			return nil, errors.New("timed out waiting for tunnel")
+		}
+		w.sleep(w.interval)
+	}
+
+	keys := wireGuardProbeKeysFromOptions(w.options, params)
+	if params.WireGuardEnabled && keys == nil {
+		log.Warning("WireGuard readiness is not verified, " +
+			"configure wireguard_client.private_key_files to probe it with a handshake")
+	}
+	probes := serviceProbes(instance, params, keys)
+	if len(probes) == 0 {
+		log.Error("None of tunnel services can be probed, tunnel readiness is unverified")
+		return instance, errors.New("tunnel readiness is unverified")
+	}
+	pending := probes
+	for {
+		failed := []*serviceProbe{}
+		for _, probe := range pending {
+			if err := w.probe(probe); err != nil {
+				log.WithFields(log.Fields{
+					"cause":   err,
+					"service": probe.String(),
+				}).Debug("Service is not reachable yet")
+				failed = append(failed, probe)
+			}
+		}
+		pending = failed
+		w.report(started, fmt.Sprintf("%d/%d services reachable",
+			len(probes)-len(pending), len(probes)))
+		if len(pending) == 0 {
+			fmt.Fprintln(w.progress)
+			log.WithField("elapsed", w.now().Sub(started).Round(time.Second)).
+				Info("Tunnel is ready")
+			return instance, nil
+		}
+
+		if !w.now().Add(w.interval).Before(deadline) {
+			unreachable := []string{}
+			for _, probe := range pending {
+				unreachable = append(unreachable, probe.String())
+			}
+			fmt.Fprintln(w.progress)
+			log.WithFields(log.Fields{
+				"timeout":     w.timeout,
+				"unreachable": strings.Join(unreachable, ", "),
+			}).Error("Tunnel services did not become reachable in time")
+			return instance, errors.New("timed out waiting for tunnel services")
+		}
+		w.sleep(w.interval)
+	}
+}
+
+func (w *tunnelWaiter) report(started time.Time, state string) {
+	fmt.Fprintf(w.progress, "\r[%s] %s\033[K", w.now().Sub(started).Round(time.Second), state)
+}
+
+// waitFlags are accepted by commands that create or rebuild tunnels.
+func waitFlags() []cli.Flag {
+	wait := cli.BoolFlag{
+		Name:  "wait",
+		Usage: "wait until tunnel services become reachable",
+	}
+	return append([]cli.Flag{wait}, waitTimingFlags()...)
+}
+
+// waitTimingFlags configure tunnelWaiter.
+func waitTimingFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.DurationFlag{
+			Name:  "wait-timeout",
+			Usage: "give up waiting after `DURATION`",
+			Value: defaultWaitTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "wait-interval",
+			Usage: "poll tunnel every `DURATION`",
+			Value: defaultWaitInterval,
+		},
+	}
+}
+
+// waitForTunnelIfRequested implements --wait. Session cache is updated with
+// addresses reported once the tunnel is up.
+func waitForTunnelIfRequested(
+	c *cli.Context,
+	provider aCloudProvider,
+	cache *sessionCache,
+	options *programOptions,
+) error {
+	if !c.Bool("wait") {
+		return nil
+	}
+	waiter := newTunnelWaiter(provider, options, c.Duration("wait-timeout"), c.Duration("wait-interval"))
+	instance, err := waiter.Wait(cache.CreationParams)
+	if instance != nil && (len(instance.IPv4) > 0 || len(instance.IPv6) > 0) {
+		cache.InstanceInfo.IPv4 = instance.IPv4
+		cache.InstanceInfo.IPv6 = instance.IPv6
+		if saveErr := saveSessionCache(cache, options); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
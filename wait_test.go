@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTunnelWaiter returns waiter driven by fake clock which advances on
+// every sleep.
+func newTestTunnelWaiter(
+	options *programOptions,
+	provider aCloudProvider,
+	probe func(p *serviceProbe) error,
+) *tunnelWaiter {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	w := newTunnelWaiter(provider, options, time.Minute, 10*time.Second)
+	w.probe = probe
+	w.progress = ioutil.Discard
+	w.now = func() time.Time { return now }
+	w.sleep = func(d time.Duration) { now = now.Add(d) }
+	return w
+}
+
+func TestServiceProbes(t *testing.T) {
+	cache := testSessionCache()
+	probes := serviceProbes(cache.InstanceInfo, cache.CreationParams, &wireGuardProbeKeys{})
+
+	names := []string{}
+	for _, probe := range probes {
+		names = append(names, probe.String())
+	}
+	assert.Equal(t, []string{
+		"wireguard 192.0.2.1:55000/udp",
+		"wireguard [2001:db8::1]:55000/udp",
+		"obfsproxy 192.0.2.1:56000/tcp",
+		"obfsproxy [2001:db8::1]:57000/tcp",
+	}, names)
+
+	// WireGuard can't be probed without keys.
+	assert.Len(t, serviceProbes(cache.InstanceInfo, cache.CreationParams, nil), 2)
+	cache.CreationParams.WireGuardEnabled = false
+	cache.CreationParams.ObfsproxyIPv6Enabled = false
+	assert.Len(t, serviceProbes(cache.InstanceInfo, cache.CreationParams, &wireGuardProbeKeys{}), 1)
+}
+
+func TestTunnelWaiterReady(t *testing.T) {
+	options, cache, _ := testWireGuardExport(t)
+	provider := &fakeCloudProvider{statusErr: errors.New("booting")}
+
+	probeCalls := 0
+	w := newTestTunnelWaiter(options, provider, func(p *serviceProbe) error {
+		if p.Service == "wireguard" {
+			assert.NotNil(t, p.WireGuardKeys)
+		}
+		probeCalls++
+		if p.Network == "tcp" && probeCalls < 7 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	sleep := w.sleep
+	w.sleep = func(d time.Duration) {
+		provider.status, provider.statusErr = cache.InstanceInfo, nil
+		sleep(d)
+	}
+
+	instance, err := w.Wait(cache.CreationParams)
+	require.NoError(t, err)
+	assert.Equal(t, cache.InstanceInfo, instance)
+	assert.Equal(t, 2, provider.statusCalls)
+	// 4 probes, then 2 failed tcp probes are retried twice.
+	assert.Equal(t, 8, probeCalls)
+}
+
+func TestTunnelWaiterTimeout(t *testing.T) {
+	options, cache, _ := testWireGuardExport(t)
+
+	provider := &fakeCloudProvider{statusErr: errors.New("booting")}
+	w := newTestTunnelWaiter(options, provider, func(p *serviceProbe) error { return nil })
+	_, err := w.Wait(cache.CreationParams)
+	assert.Error(t, err)
+	assert.Equal(t, 6, provider.statusCalls)
+
+	provider = &fakeCloudProvider{status: cache.InstanceInfo}
+	w = newTestTunnelWaiter(options, provider, func(p *serviceProbe) error {
+		if p.Service == "obfsproxy" {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	instance, err := w.Wait(cache.CreationParams)
+	assert.Error(t, err)
+	assert.Equal(t, cache.InstanceInfo, instance)
+}
+
+func TestTunnelWaiterWithoutWireGuardKeys(t *testing.T) {
+	cache := testSessionCache()
+	provider := &fakeCloudProvider{status: cache.InstanceInfo}
+
+	probed := []string{}
+	w := newTestTunnelWaiter(validTestOptions(), provider, func(p *serviceProbe) error {
+		probed = append(probed, p.Service)
+		return nil
+	})
+	_, err := w.Wait(cache.CreationParams)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"obfsproxy", "obfsproxy"}, probed, "wireguard is unverified")
+
+	// Readiness of WireGuard alone is never reported without a handshake.
+	cache.CreationParams.ObfsproxyIPv4Enabled = false
+	cache.CreationParams.ObfsproxyIPv6Enabled = false
+	probed = []string{}
+	_, err = w.Wait(cache.CreationParams)
+	assert.Error(t, err)
+	assert.Empty(t, probed)
+}
+
+func TestTunnelReadinessCanBeVerified(t *testing.T) {
+	o, cache, _ := testWireGuardExport(t)
+	params := cache.CreationParams
+	assert.True(t, tunnelReadinessCanBeVerified(o, params))
+
+	params.ObfsproxyIPv4Enabled = false
+	params.ObfsproxyIPv6Enabled = false
+	assert.True(t, tunnelReadinessCanBeVerified(o, params), "wireguard handshake")
+	o.WireGuardClient.PrivateKeyFiles = nil
+	assert.False(t, tunnelReadinessCanBeVerified(o, params))
+}
+
+func TestProbeServiceTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+
+	assert.NoError(t, probeService(&serviceProbe{Network: "tcp", Address: address}))
+	listener.Close()
+	assert.Error(t, probeService(&serviceProbe{Network: "tcp", Address: address}))
+}
+
+func TestProbeServiceUDPRefused(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	// Loopback reports closed UDP port immediately with ICMP port unreachable.
+	keys := testWireGuardProbeKeys(t)
+	assert.Error(t, probeService(&serviceProbe{Network: "udp", Address: address, WireGuardKeys: keys}))
+	assert.Error(t, probeService(&serviceProbe{Network: "udp", Address: address}))
+}
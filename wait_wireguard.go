@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Constants of WireGuard handshake, see https://www.wireguard.com/protocol/.
+const (
+	wireGuardConstruction   = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wireGuardIdentifier     = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wireGuardLabelMAC1      = "mac1----"
+	wireGuardInitiationType = 1
+	wireGuardResponseType   = 2
+	wireGuardInitiationSize = 148
+	wireGuardResponseSize   = 92
+	// TAI64 label of the Unix epoch.
+	tai64Epoch = 0x400000000000000a
+)
+
+// wireGuardProbeKeys are raw keys used to initiate a handshake with the
+// tunnel on behalf of a peer.
+type wireGuardProbeKeys struct {
+	ServerPublicKey []byte
+	PeerPrivateKey  []byte
+}
+
+// wireGuardProbeKeysFromOptions returns keys of the first peer whose private
+// key file is configured, or nil if there is none. WireGuard doesn't answer
+// unauthenticated datagrams, so without a peer private key WireGuard
+// readiness can't be verified.
+func wireGuardProbeKeysFromOptions(options *programOptions, params *tunnelCreationParams) *wireGuardProbeKeys {
+	if options == nil || !params.WireGuardEnabled {
+		return nil
+	}
+	files := options.WireGuardClient.PrivateKeyFiles
+	for i, publicKey := range params.WireGuardPeerKeys {
+		if i >= len(files) || len(files[i]) == 0 {
+			continue
+		}
+		privateKey, err := readWireGuardPrivateKey(files[i], publicKey)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cause": err,
+				"path":  files[i],
+			}).Warning("Peer private key can't be used to probe WireGuard, trying next peer")
+			continue
+		}
+		serverPublicKey, err := wireGuardPublicKey(params.WireGuardServerKey)
+		if err != nil {
+			log.WithField("cause", err).Error("Unable to derive WireGuard server public key")
+			return nil
+		}
+		keys := &wireGuardProbeKeys{}
+		keys.ServerPublicKey, _ = base64.StdEncoding.DecodeString(serverPublicKey)
+		keys.PeerPrivateKey, _ = base64.StdEncoding.DecodeString(privateKey)
+		return keys
+	}
+	return nil
+}
+
+func wireGuardHash(data ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func wireGuardHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// wireGuardKDF2 derives the next chaining key and a message key from input.
+func wireGuardKDF2(chainingKey, input []byte) ([]byte, []byte) {
+	prk := wireGuardHMAC(chainingKey, input)
+	next := wireGuardHMAC(prk, []byte{1})
+	return next, wireGuardHMAC(prk, next, []byte{2})
+}
+
+// wireGuardSeal encrypts handshake field. Every handshake key is used once,
+// so the nonce is always zero.
+func wireGuardSeal(key, plaintext, authData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, authData), nil
+}
+
+func tai64n(t time.Time) []byte {
+	timestamp := make([]byte, 12)
+	binary.BigEndian.PutUint64(timestamp, tai64Epoch+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(t.Nanosecond()))
+	return timestamp
+}
+
+// newWireGuardInitiation builds handshake initiation message of the peer.
+// Preshared keys are not used by tunnels, so the message has no PSK.
+func newWireGuardInitiation(keys *wireGuardProbeKeys, sender uint32, now time.Time) ([]byte, error) {
+	peerPublicKey, err := curve25519.X25519(keys.PeerPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPrivateKey := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(ephemeralPrivateKey); err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	chainingKey := wireGuardHash([]byte(wireGuardConstruction))
+	h := wireGuardHash(chainingKey, []byte(wireGuardIdentifier))
+	h = wireGuardHash(h, keys.ServerPublicKey)
+	chainingKey, _ = wireGuardKDF2(chainingKey, ephemeralPublicKey)
+	h = wireGuardHash(h, ephemeralPublicKey)
+
+	shared, err := curve25519.X25519(ephemeralPrivateKey, keys.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	chainingKey, key := wireGuardKDF2(chainingKey, shared)
+	encryptedStatic, err := wireGuardSeal(key, peerPublicKey, h)
+	if err != nil {
+		return nil, err
+	}
+	h = wireGuardHash(h, encryptedStatic)
+
+	shared, err = curve25519.X25519(keys.PeerPrivateKey, keys.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	_, key = wireGuardKDF2(chainingKey, shared)
+	encryptedTimestamp, err := wireGuardSeal(key, tai64n(now), h)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 8, wireGuardInitiationSize)
+	msg[0] = wireGuardInitiationType
+	binary.LittleEndian.PutUint32(msg[4:], sender)
+	msg = append(msg, ephemeralPublicKey...)
+	msg = append(msg, encryptedStatic...)
+	msg = append(msg, encryptedTimestamp...)
+	mac1, err := blake2s.New128(wireGuardHash([]byte(wireGuardLabelMAC1), keys.ServerPublicKey))
+	if err != nil {
+		return nil, err
+	}
+	mac1.Write(msg)
+	msg = mac1.Sum(msg)
+	// Empty mac2, there is no cookie.
+	return append(msg, make([]byte, blake2s.Size128)...), nil
+}
+
+// probeWireGuard initiates a handshake over conn and waits for the server's
+// response, which is only sent once the server authenticates the peer.
+// The server starts sending peer's traffic to the probe's address, so probes
+// must not be used while the peer is connected.
+func probeWireGuard(conn net.Conn, keys *wireGuardProbeKeys) error {
+	var index [4]byte
+	if _, err := rand.Read(index[:]); err != nil {
+		return err
+	}
+	sender := binary.LittleEndian.Uint32(index[:])
+	msg, err := newWireGuardInitiation(keys, sender, time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return err
+	}
+
+	response := make([]byte, 2*wireGuardResponseSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return err
+	}
+	if n != wireGuardResponseSize || response[0] != wireGuardResponseType ||
+		binary.LittleEndian.Uint32(response[8:]) != sender {
+		return errors.New("unexpected reply to wireguard handshake initiation")
+	}
+	return nil
+}
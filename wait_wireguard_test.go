@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+func decodeTestKey(t *testing.T, key string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	require.NoError(t, err)
+	return decoded
+}
+
+// testWireGuardHandshake returns probe keys of a fresh peer and server
+// private key.
+func testWireGuardHandshake(t *testing.T) (*wireGuardProbeKeys, []byte) {
+	server, err := generateWireGuardKeyPair()
+	require.NoError(t, err)
+	peer, err := generateWireGuardKeyPair()
+	require.NoError(t, err)
+	keys := &wireGuardProbeKeys{
+		ServerPublicKey: decodeTestKey(t, server.PublicKey),
+		PeerPrivateKey:  decodeTestKey(t, peer.PrivateKey),
+	}
+	return keys, decodeTestKey(t, server.PrivateKey)
+}
+
+func testWireGuardProbeKeys(t *testing.T) *wireGuardProbeKeys {
+	keys, _ := testWireGuardHandshake(t)
+	return keys
+}
+
+func TestWireGuardProbeKeysFromOptions(t *testing.T) {
+	o, cache, pair := testWireGuardExport(t)
+	keys := wireGuardProbeKeysFromOptions(o, cache.CreationParams)
+	require.NotNil(t, keys)
+	assert.Equal(t, decodeTestKey(t, pair.PrivateKey), keys.PeerPrivateKey)
+	serverPublicKey, err := wireGuardPublicKey(o.WireGuard.ServerKey)
+	require.NoError(t, err)
+	assert.Equal(t, decodeTestKey(t, serverPublicKey), keys.ServerPublicKey)
+
+	o.WireGuardClient.PrivateKeyFiles = nil
+	assert.Nil(t, wireGuardProbeKeysFromOptions(o, cache.CreationParams))
+	assert.Nil(t, wireGuardProbeKeysFromOptions(nil, cache.CreationParams))
+}
+
+// TestWireGuardInitiation consumes initiation the way server does.
+func TestWireGuardInitiation(t *testing.T) {
+	keys, serverPrivateKey := testWireGuardHandshake(t)
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg, err := newWireGuardInitiation(keys, 0x01020304, now)
+	require.NoError(t, err)
+	require.Len(t, msg, wireGuardInitiationSize)
+	assert.Equal(t, []byte{wireGuardInitiationType, 0, 0, 0}, msg[:4])
+	assert.Equal(t, uint32(0x01020304), binary.LittleEndian.Uint32(msg[4:]))
+
+	mac1, err := blake2s.New128(wireGuardHash([]byte(wireGuardLabelMAC1), keys.ServerPublicKey))
+	require.NoError(t, err)
+	mac1.Write(msg[:116])
+	assert.Equal(t, mac1.Sum(nil), msg[116:132])
+	assert.Equal(t, make([]byte, 16), msg[132:], "no cookie")
+
+	open := func(key, ciphertext, authData []byte) []byte {
+		aead, err := chacha20poly1305.New(key)
+		require.NoError(t, err)
+		plaintext, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, authData)
+		require.NoError(t, err)
+		return plaintext
+	}
+	ephemeralPublicKey, encryptedStatic, encryptedTimestamp := msg[8:40], msg[40:88], msg[88:116]
+	chainingKey := wireGuardHash([]byte(wireGuardConstruction))
+	h := wireGuardHash(wireGuardHash(chainingKey, []byte(wireGuardIdentifier)), keys.ServerPublicKey)
+	chainingKey, _ = wireGuardKDF2(chainingKey, ephemeralPublicKey)
+	h = wireGuardHash(h, ephemeralPublicKey)
+	shared, err := curve25519.X25519(serverPrivateKey, ephemeralPublicKey)
+	require.NoError(t, err)
+	chainingKey, key := wireGuardKDF2(chainingKey, shared)
+	peerPublicKey := open(key, encryptedStatic, h)
+	expected, err := curve25519.X25519(keys.PeerPrivateKey, curve25519.Basepoint)
+	require.NoError(t, err)
+	assert.Equal(t, expected, peerPublicKey)
+
+	h = wireGuardHash(h, encryptedStatic)
+	shared, err = curve25519.X25519(serverPrivateKey, peerPublicKey)
+	require.NoError(t, err)
+	_, key = wireGuardKDF2(chainingKey, shared)
+	assert.Equal(t, tai64n(now), open(key, encryptedTimestamp, h))
+}
+
+// serveTestWireGuard answers the first initiation with reply built from
+// sender index of the initiation.
+func serveTestWireGuard(t *testing.T, reply func(sender uint32) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		msg := make([]byte, 2*wireGuardInitiationSize)
+		n, addr, err := conn.ReadFrom(msg)
+		if err != nil || n != wireGuardInitiationSize {
+			return
+		}
+		conn.WriteTo(reply(binary.LittleEndian.Uint32(msg[4:])), addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProbeServiceWireGuard(t *testing.T) {
+	keys := testWireGuardProbeKeys(t)
+	response := func(receiver uint32) []byte {
+		msg := make([]byte, wireGuardResponseSize)
+		msg[0] = wireGuardResponseType
+		binary.LittleEndian.PutUint32(msg[8:], receiver)
+		return msg
+	}
+
+	address := serveTestWireGuard(t, response)
+	assert.NoError(t, probeService(&serviceProbe{Network: "udp", Address: address, WireGuardKeys: keys}))
+
+	address = serveTestWireGuard(t, func(sender uint32) []byte { return response(sender + 1) })
+	assert.Error(t, probeService(&serviceProbe{Network: "udp", Address: address, WireGuardKeys: keys}))
+	address = serveTestWireGuard(t, func(sender uint32) []byte { return []byte{0} })
+	assert.Error(t, probeService(&serviceProbe{Network: "udp", Address: address, WireGuardKeys: keys}))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultWatchInterval = time.Minute
+	// Shorter intervals would mostly hammer the server with status queries.
+	minWatchInterval = 10 * time.Second
+)
+
+// setSessionTTL schedules destruction of the tunnel. Zero ttl means that the
+// tunnel lives until destroyed explicitly.
+func setSessionTTL(cache *sessionCache, ttl time.Duration, now time.Time) {
+	activity := now
+	cache.LastActivity = &activity
+	if ttl <= 0 {
+		cache.ExpiresAt = nil
+		return
+	}
+	expiresAt := now.Add(ttl)
+	cache.ExpiresAt = &expiresAt
+}
+
+// tunnelExpiry tells whether tunnel should be destroyed. The returned reason
+// is empty when tunnel should be kept. Tunnel is idle when it wasn't touched
+// for idle period, counting from creation if it was never touched. Zero idle
+// period disables idle shutdown.
+func tunnelExpiry(cache *sessionCache, idle time.Duration, now time.Time) string {
+	if cache.ExpiresAt != nil && !now.Before(*cache.ExpiresAt) {
+		return "ttl expired"
+	}
+	if idle <= 0 {
+		return ""
+	}
+
+	lastActivity := cache.InstanceInfo.CreatedAt
+	if cache.LastActivity != nil {
+		lastActivity = *cache.LastActivity
+	}
+	if now.Sub(lastActivity) >= idle {
+		return "idle"
+	}
+	return ""
+}
+
+// tunnelWatcher destroys tunnels of expired and idle sessions.
+type tunnelWatcher struct {
+	// Returns options of the session with its profile applied.
+	sessionOptions func(session string) (*programOptions, error)
+	newProvider    func(options *programOptions) (aCloudProvider, error)
+	idle           time.Duration
+	now            func() time.Time
+}
+
+// checkSession destroys tunnel of the session if it's due. Returns true if
+// tunnel was destroyed.
+func (w *tunnelWatcher) checkSession(session string) (bool, error) {
+	options, err := w.sessionOptions(session)
+	if err != nil {
+		return false, err
+	}
+	// Session busy with another operation is checked next time.
+	lock, err := acquireSessionLock(options, 0)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Release()
+	if err = verifyCachedProfile(options); err != nil {
+		return false, err
+	}
+
+	cache, err := restoreSessionCache(options)
+	if err != nil {
+		return false, err
+	}
+
+	fields := log.Fields{
+		"session": session,
+		"label":   cache.InstanceInfo.Label,
+	}
+	if cache.ExpiresAt != nil {
+		fields["expires_at"] = cache.ExpiresAt.Format(time.RFC3339)
+	}
+	reason := tunnelExpiry(cache, w.idle, w.now())
+	if len(reason) == 0 {
+		log.WithFields(fields).Debug("Keeping tunnel")
+		return false, nil
+	}
+
+	fields["reason"] = reason
+	log.WithFields(fields).Info("Destroying tunnel")
+	provider, err := w.newProvider(options)
+	if err != nil {
+		return false, err
+	}
+	started := w.now()
+	err = provider.DestroyTunnel()
+	if err != nil {
+		// Tunnel destroyed by other means would never be destroyed again.
+		if _, statusErr := provider.TunnelStatus(); isTunnelNotFoundError(statusErr) {
+			log.WithFields(fields).Warning("Tunnel does not exist anymore, clearing the session")
+			// When the tunnel was destroyed is unknown, so lifetime isn't
+			// recorded, but the session stops tracking its cost.
+			record := newHistoryRecord(options, historyActionDestroy, cache, started, w.now(), nil)
+			record.setCost(cache)
+			appendHistory(options, record)
+			return false, clearSessionCache(options)
+		}
+	}
+	appendHistory(options, newDestroyHistoryRecord(options, cache, started, w.now(), err))
+	if err != nil {
+		log.WithFields(fields).Error("Unable to destroy tunnel, will retry later")
+		return false, err
+	}
+	log.WithFields(fields).Info("Tunnel instance was successfully deleted")
+	return true, clearSessionCache(options)
+}
+
+// checkSessions checks every session in sessions. Errors are logged and
+// don't prevent checking remaining sessions.
+func (w *tunnelWatcher) checkSessions(sessions []string) {
+	for _, session := range sessions {
+		if _, err := w.checkSession(session); err != nil {
+			log.WithFields(log.Fields{
+				"cause":   err,
+				"session": session,
+			}).Warning("Session check failed")
+		}
+	}
+}
+
+func validateWatchInterval(interval time.Duration) error {
+	if interval < minWatchInterval {
+		return logConfigurationError("watch: --interval is too short", log.Fields{
+			"interval": interval,
+			"minimum":  minWatchInterval,
+		})
+	}
+	return nil
+}
+
+func handleWatchCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	if !c.Bool("once") {
+		if err = validateWatchInterval(c.Duration("interval")); err != nil {
+			return err
+		}
+	}
+
+	watcher := &tunnelWatcher{
+		sessionOptions: func(session string) (*programOptions, error) {
+			named, err := newProgramOptions(c.GlobalString("config"))
+			if err != nil {
+				return nil, err
+			}
+			if err = applySessionProfile(named, session); err != nil {
+				return nil, err
+			}
+			if err = applyCachedProfile(named); err != nil {
+				return nil, err
+			}
+			return named, nil
+		},
+		newProvider: newCloudProviderFromOptions,
+		idle:        c.Duration("idle"),
+		now:         time.Now,
+	}
+
+	log.WithFields(log.Fields{
+		"idle":     watcher.idle,
+		"interval": c.Duration("interval"),
+	}).Info("Watching tunnels")
+	for {
+		// Only the selected session is watched when --session is given.
+		sessions := []string{options.Session}
+		if len(options.Session) == 0 {
+			if sessions, err = listSessions(options.Runtime.RuntimeDir); err != nil {
+				return err
+			}
+		}
+		watcher.checkSessions(sessions)
+
+		if c.Bool("once") {
+			return nil
+		}
+		time.Sleep(c.Duration("interval"))
+	}
+}
+
+func handleTouchSessionCommand(c *cli.Context) error {
+	options, err := newProgramOptionsFromContext(c)
+	if err != nil {
+		return err
+	}
+	lock, err := lockSessionFromContext(c, options)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	cache, err := restoreSessionCache(options)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	cache.LastActivity = &now
+	return saveSessionCache(cache, options)
+}
+
+func watchCommand() cli.Command {
+	return cli.Command{
+		Name:   "watch",
+		Usage:  "destroy tunnels when their ttl expires or they are idle",
+		Action: handleWatchCommand,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "idle",
+				Usage: "destroy tunnels after `DURATION` since last touch or creation (0 disables)",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Usage: "check sessions every `DURATION`, at least " + minWatchInterval.String(),
+				Value: defaultWatchInterval,
+			},
+			cli.BoolFlag{
+				Name:  "once",
+				Usage: "check sessions once and exit, e.g. when run from cron",
+			},
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelExpiry(t *testing.T) {
+	now := time.Date(2018, 6, 1, 20, 0, 0, 0, time.UTC)
+	cache := testSessionCache()
+
+	// Created at 12:00, no TTL, never touched.
+	assert.Equal(t, "", tunnelExpiry(cache, 0, now))
+	assert.Equal(t, "idle", tunnelExpiry(cache, 8*time.Hour, now))
+	assert.Equal(t, "", tunnelExpiry(cache, 9*time.Hour, now))
+
+	setSessionTTL(cache, 4*time.Hour, now.Add(-time.Hour))
+	assert.Equal(t, "", tunnelExpiry(cache, 0, now))
+	assert.Equal(t, "", tunnelExpiry(cache, 2*time.Hour, now))
+	assert.Equal(t, "idle", tunnelExpiry(cache, time.Hour, now))
+	assert.Equal(t, "ttl expired", tunnelExpiry(cache, 0, now.Add(3*time.Hour)))
+
+	setSessionTTL(cache, 0, now)
+	assert.Nil(t, cache.ExpiresAt)
+	assert.Equal(t, "", tunnelExpiry(cache, 0, now.Add(100*time.Hour)))
+}
+
+func newTestTunnelWatcher(t *testing.T, provider aCloudProvider) (*tunnelWatcher, *programOptions) {
+	options := testSessionOptions(t, "")
+	watcher := &tunnelWatcher{
+		sessionOptions: func(session string) (*programOptions, error) {
+			return sessionOptions(options, session)
+		},
+		newProvider: func(*programOptions) (aCloudProvider, error) { return provider, nil },
+		now:         func() time.Time { return time.Date(2018, 6, 1, 20, 0, 0, 0, time.UTC) },
+	}
+	return watcher, options
+}
+
+func TestTunnelWatcherDestroysExpiredTunnel(t *testing.T) {
+	provider := &fakeCloudProvider{}
+	watcher, options := newTestTunnelWatcher(t, provider)
+
+	kept := testSessionCache()
+	setSessionTTL(kept, 10*time.Hour, kept.InstanceInfo.CreatedAt)
+	require.NoError(t, saveSessionCache(kept, options))
+	expired := testSessionCache()
+	setSessionTTL(expired, time.Hour, expired.InstanceInfo.CreatedAt)
+	named, err := sessionOptions(options, "evening")
+	require.NoError(t, err)
+	require.NoError(t, saveSessionCache(expired, named))
+
+	watcher.checkSessions([]string{defaultSessionName, "evening"})
+	assert.Equal(t, 1, provider.destroyCalls)
+	sessions, err := listSessions(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultSessionName}, sessions)
+}
+
+func TestTunnelWatcherKeepsSessionOnDestroyError(t *testing.T) {
+	provider := &fakeCloudProvider{destroyErr: errors.New("rpc method returned an error")}
+	watcher, options := newTestTunnelWatcher(t, provider)
+	watcher.idle = time.Hour
+	require.NoError(t, saveSessionCache(testSessionCache(), options))
+
+	destroyed, err := watcher.checkSession(defaultSessionName)
+	assert.Error(t, err)
+	assert.False(t, destroyed)
+	_, err = os.Stat(sessionCacheFilename(options.Runtime.RuntimeDir, ""))
+	assert.NoError(t, err)
+}
+
+func TestInheritSessionState(t *testing.T) {
+	previous := testSessionCache()
+	setSessionTTL(previous, time.Hour, previous.InstanceInfo.CreatedAt)
+
+	rebuilt := testSessionCache()
+	inheritSessionState(rebuilt, previous)
+	assert.Equal(t, previous.ExpiresAt, rebuilt.ExpiresAt)
+	assert.Equal(t, previous.LastActivity, rebuilt.LastActivity)
+}
+
+func TestTunnelWatcherSkipsLockedSession(t *testing.T) {
+	o := testSessionOptions(t, "")
+	cache := testSessionCache()
+	expiresAt := cache.InstanceInfo.CreatedAt
+	cache.ExpiresAt = &expiresAt
+	require.NoError(t, saveSessionCache(cache, o))
+
+	lock, err := acquireSessionLock(o, 0)
+	require.NoError(t, err)
+	defer lock.Release()
+
+	provider := &fakeCloudProvider{}
+	watcher := &tunnelWatcher{
+		sessionOptions: func(string) (*programOptions, error) { return o, nil },
+		newProvider:    func(*programOptions) (aCloudProvider, error) { return provider, nil },
+		now:            time.Now,
+	}
+	destroyed, err := watcher.checkSession(defaultSessionName)
+	assert.Equal(t, errSessionLocked, err)
+	assert.False(t, destroyed)
+	assert.Equal(t, 0, provider.destroyCalls)
+}
+
+func TestTunnelWatcherClearsMissingTunnel(t *testing.T) {
+	provider := &fakeCloudProvider{
+		destroyErr: errors.New("rpc method returned an error"),
+		statusErr:  &tunnelStatusError{notFound: true},
+	}
+	watcher, options := newTestTunnelWatcher(t, provider)
+	watcher.idle = time.Hour
+	cache := testSessionCache()
+	cache.Price = &tunnelPrice{Plan: "g6-nanode-1", Hourly: 0.0075}
+	require.NoError(t, saveSessionCache(cache, options))
+
+	destroyed, err := watcher.checkSession(defaultSessionName)
+	require.NoError(t, err)
+	assert.False(t, destroyed)
+	_, err = os.Stat(sessionCacheFilename(options.Runtime.RuntimeDir, ""))
+	assert.True(t, os.IsNotExist(err))
+	records, err := loadHistory(options.Runtime.RuntimeDir)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, historyActionDestroy, records[0].Action)
+	assert.Empty(t, records[0].Error)
+	assert.Empty(t, records[0].Lifetime)
+	assert.Equal(t, cache.Price, records[0].Price)
+	assert.True(t, records[0].Total > 0, "cost of the tunnel must be recorded")
+}
+
+func TestValidateWatchInterval(t *testing.T) {
+	assert.NoError(t, validateWatchInterval(defaultWatchInterval))
+	assert.Error(t, validateWatchInterval(0))
+	assert.Error(t, validateWatchInterval(-time.Minute))
+	assert.Error(t, validateWatchInterval(time.Second))
+}
+
+func TestTunnelWatcherSkipsSessionSwitchedToAnotherProfile(t *testing.T) {
+	provider := &fakeCloudProvider{}
+	watcher, options := newTestTunnelWatcher(t, provider)
+	watcher.idle = time.Hour
+	cache := testSessionCache()
+	cache.Profile = "spare"
+	require.NoError(t, saveSessionCache(cache, options))
+
+	_, err := watcher.checkSession(defaultSessionName)
+	assert.Error(t, err)
+	assert.Equal(t, 0, provider.destroyCalls)
+}